@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Error codes returned by the admin API
+const (
+	ErrUnauthorized     = "unauthorized"
+	ErrForbidden        = "forbidden"
+	ErrMethodNotAllowed = "method_not_allowed"
+	ErrInvalidJSON      = "invalid_json"
+	ErrValidationFailed = "validation_failed"
+	ErrNotFound         = "not_found"
+	ErrConflict         = "conflict"
+	ErrInvalidConfig    = "invalid_config"
+	ErrInternal         = "internal_error"
+)
+
+// apiResponse is the envelope of every admin API response. Data is set when
+// OK is true, Error otherwise.
+type apiResponse struct {
+	OK    bool        `json:"ok"`
+	Data  interface{} `json:"data,omitempty"`
+	Error *apiError   `json:"error,omitempty"`
+}
+
+type apiError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// apiMessage is the data of responses to actions that have nothing else to report.
+type apiMessage struct {
+	Message string `json:"message"`
+}
+
+// fieldErrors collects validation problems by JSON field name.
+type fieldErrors map[string]string
+
+func (fe fieldErrors) add(field, format string, args ...interface{}) {
+	if _, ok := fe[field]; !ok {
+		fe[field] = fmt.Sprintf(format, args...)
+	}
+}
+
+func (fe fieldErrors) required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		fe.add(field, "is required")
+	}
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, response apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeAPIData sends a successful response carrying data.
+func writeAPIData(w http.ResponseWriter, status int, data interface{}) {
+	writeAPIResponse(w, status, apiResponse{OK: true, Data: data})
+}
+
+// writeAPIError sends an error response with the given status code.
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIResponse(w, status, apiResponse{Error: &apiError{Code: code, Message: message}})
+}
+
+// writeFieldErrors sends a validation error if any were collected, and
+// reports whether it did.
+func writeFieldErrors(w http.ResponseWriter, errs fieldErrors) bool {
+	if len(errs) == 0 {
+		return false
+	}
+	writeAPIResponse(w, http.StatusBadRequest, apiResponse{Error: &apiError{
+		Code:    ErrValidationFailed,
+		Message: "The request has invalid fields",
+		Fields:  errs,
+	}})
+	return true
+}
+
+// decodeAPIRequest reads the JSON body of a request into v. On failure the
+// error response is already written and false is returned.
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == io.EOF {
+		writeAPIError(w, http.StatusBadRequest, ErrInvalidJSON, "The request body is empty")
+		return false
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ErrInvalidJSON, fmt.Sprintf("Invalid JSON payload: %v", err))
+		return false
+	}
+	return true
+}
+
+// apiParam describes a query parameter of an endpoint.
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+	Required    bool
+}
+
+// apiRoute describes one method of an admin API endpoint. The route table
+// drives both the handler registration and the OpenAPI document.
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	// Scope the token must grant, empty for public endpoints
+	Scope string
+	// Audit log action name, empty for endpoints that are not audited
+	Audit string
+	// Zero values of the request body and response data types
+	Request  interface{}
+	Response interface{}
+	// Paged responses wrap a slice of Response in the page envelope
+	Paged bool
+	// Set for responses that are not a JSON envelope, such as event streams
+	ContentType string
+	Query       []apiParam
+	Handler     http.HandlerFunc
+}
+
+var paginationParams = []apiParam{
+	{Name: "offset", Type: "integer", Description: "Number of items to skip"},
+	{Name: "limit", Type: "integer", Description: fmt.Sprintf("Page size, at most %d", maxPageLimit)},
+}
+
+func apiRoutes() []apiRoute {
+	cellParams := []apiParam{
+		{Name: "x", Type: "integer", Description: "Left edge of the region"},
+		{Name: "y", Type: "integer", Description: "Top edge of the region"},
+		{Name: "width", Type: "integer", Description: "Width of the region, 1 by default"},
+		{Name: "height", Type: "integer", Description: "Height of the region, 1 by default"},
+	}
+
+	return []apiRoute{
+		{Method: "GET", Path: "/health", Summary: "Report that the server is up", Response: HealthResponse{}, Handler: healthHandler},
+		{Method: "GET", Path: "/healthz", Summary: "Report that the server is up", Response: HealthResponse{}, Handler: healthHandler},
+		{Method: "GET", Path: "/api/openapi.json", Summary: "This OpenAPI document", Handler: openAPIHandler},
+		{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics", Response: "", ContentType: metricsContentType, Handler: metricsHandler},
+
+		{Method: "POST", Path: "/api/loadUser", Summary: "Reserve a spawn position for a user arriving from another server", Scope: ScopeUsersLoad, Audit: "loadUser", Request: LoadUserRequest{}, Response: LoadUserRequest{}, Handler: loadUserHandler},
+		{Method: "POST", Path: "/api/kickUser", Summary: "Disconnect a user", Scope: ScopeUsersKick, Audit: "kickUser", Request: kickUserRequest{}, Response: apiMessage{}, Handler: kickUserHandler},
+		{Method: "POST", Path: "/api/kickAllUsers", Summary: "Disconnect every user", Scope: ScopeUsersKickAll, Audit: "kickAllUsers", Response: kickedUsers{}, Handler: kickAllUsersHandler},
+		{Method: "POST", Path: "/api/moveUser", Summary: "Move a user to a cell they can walk onto", Scope: ScopeUsersMove, Audit: "moveUser", Request: moveUserPayload{}, Response: PlayerInfo{}, Handler: moveUserHandler},
+		{Method: "POST", Path: "/api/teleportUser", Summary: "Move a user to a cell or into a zone, optionally ignoring terrain", Scope: ScopeUsersMove, Audit: "teleportUser", Request: teleportRequest{}, Response: PlayerInfo{}, Handler: teleportUserHandler},
+		{Method: "POST", Path: "/api/relocateUsers", Summary: "Move everyone in a rectangle to the free cells of another", Scope: ScopeUsersMove, Audit: "relocateUsers", Request: relocateRequest{}, Response: relocationResult{}, Handler: relocateUsersHandler},
+		{Method: "POST", Path: "/api/muteUser", Summary: "Mute a user", Scope: ScopeUsersMute, Audit: "muteUser", Request: sanctionRequest{}, Response: Sanction{}, Handler: muteUserHandler},
+		{Method: "POST", Path: "/api/unmuteUser", Summary: "Lift every mute of a user", Scope: ScopeUsersMute, Audit: "unmuteUser", Request: unmuteRequest{}, Response: []Sanction{}, Handler: unmuteUserHandler},
+		{Method: "POST", Path: "/api/banUser", Summary: "Ban a username or IP address", Scope: ScopeUsersBan, Audit: "banUser", Request: sanctionRequest{}, Response: Sanction{}, Handler: banUserHandler},
+		{Method: "GET", Path: "/api/sanctions", Summary: "List active sanctions", Scope: ScopeUsersBan, Response: []Sanction{}, Handler: listSanctionsHandler, Query: []apiParam{
+			{Name: "kind", Type: "string", Description: "Only sanctions of this kind (mute or ban)"},
+			{Name: "username", Type: "string", Description: "Only sanctions of this user"},
+		}},
+		{Method: "POST", Path: "/api/liftSanction", Summary: "Lift a sanction by ID", Scope: ScopeUsersBan, Audit: "liftSanction", Request: liftSanctionRequest{}, Response: Sanction{}, Handler: liftSanctionHandler},
+
+		{Method: "POST", Path: "/api/sendAnnouncement", Summary: "Broadcast an announcement to every user", Scope: ScopeChatAnnounce, Audit: "sendAnnouncement", Request: announcementRequest{}, Response: apiMessage{}, Handler: sendAnnouncementHandler},
+		{Method: "POST", Path: "/api/sendMessageToCell", Summary: "Send a message to the users in a cell", Scope: ScopeChatAnnounce, Audit: "sendMessageToCell", Request: cellMessageRequest{}, Response: apiMessage{}, Handler: sendMessageToCellHandler},
+		{Method: "POST", Path: "/api/sendMessageToUser", Summary: "Whisper to a user on this or a peer server", Scope: ScopeChatMessage, Audit: "sendMessageToUser", Request: sendMessagePayload{}, Response: whisperReceipt{}, Handler: sendMessageToUserHandler},
+
+		{Method: "GET", Path: "/api/presence", Summary: "Look up where a user is online", Scope: ScopeClusterPeer, Response: presenceInfo{}, Handler: presenceLookupHandler, Query: []apiParam{
+			{Name: "username", Type: "string", Description: "User to look up", Required: true},
+		}},
+		{Method: "POST", Path: "/api/presence", Summary: "Record a user coming online or going offline on a peer", Scope: ScopeClusterPeer, Request: presenceUpdate{}, Response: presenceUpdate{}, Handler: presenceUpdateHandler},
+		{Method: "POST", Path: "/api/registerServer", Summary: "Register a peer server", Scope: ScopeClusterPeer, Audit: "registerServer", Request: peerServer{}, Response: peerServer{}, Handler: registerServerHandler},
+		{Method: "GET", Path: "/api/servers", Summary: "List peer servers", Scope: ScopeClusterPeer, Response: []peerServer{}, Handler: listServersHandler},
+
+		{Method: "GET", Path: "/api/events", Summary: "Stream world events as server-sent events", Scope: ScopeEventsRead, Response: worldEvent{}, ContentType: "text/event-stream", Handler: eventStreamHandler, Query: []apiParam{
+			{Name: "types", Type: "string", Description: "Comma separated event types to receive, all by default"},
+			{Name: "last_event_id", Type: "integer", Description: "Resume after this event, like the Last-Event-ID header"},
+		}},
+		{Method: "GET", Path: "/api/webhooks", Summary: "List the webhooks receiving world events", Scope: ScopeWebhooks, Response: []webhookInfo{}, Handler: listWebhooksHandler},
+		{Method: "POST", Path: "/api/addWebhook", Summary: "Send world events to a URL", Scope: ScopeWebhooks, Audit: "addWebhook", Request: addWebhookRequest{}, Response: webhookInfo{}, Handler: addWebhookHandler},
+		{Method: "POST", Path: "/api/deleteWebhook", Summary: "Stop sending world events to a webhook", Scope: ScopeWebhooks, Audit: "deleteWebhook", Request: deleteWebhookRequest{}, Response: apiMessage{}, Handler: deleteWebhookHandler},
+
+		{Method: "GET", Path: "/api/audit", Summary: "Query the audit log", Scope: ScopeAuditRead, Response: []auditEntry{}, Handler: auditQueryHandler, Query: []apiParam{
+			{Name: "actor", Type: "string", Description: "Only entries of this token subject"},
+			{Name: "action", Type: "string", Description: "Only entries of this action"},
+			{Name: "since", Type: "string", Description: "RFC3339 timestamp of the oldest entry"},
+			{Name: "until", Type: "string", Description: "RFC3339 timestamp of the newest entry"},
+			{Name: "limit", Type: "integer", Description: fmt.Sprintf("Number of most recent entries, %d by default", auditDefaultLimit)},
+		}},
+
+		{Method: "GET", Path: "/api/players", Summary: "List online players", Scope: ScopeWorldRead, Response: []PlayerInfo{}, Paged: true, Handler: listPlayersHandler, Query: paginationParams},
+		{Method: "GET", Path: "/api/player", Summary: "Describe an online player", Scope: ScopeWorldRead, Response: PlayerInfo{}, Handler: getPlayerHandler, Query: []apiParam{
+			{Name: "username", Type: "string", Description: "Player to describe", Required: true},
+		}},
+		{Method: "GET", Path: "/api/region", Summary: "Describe the cells of a rectangle", Scope: ScopeWorldRead, Response: []CellInfo{}, Paged: true, Handler: getRegionHandler, Query: append(cellParams, paginationParams...)},
+		{Method: "GET", Path: "/api/entities", Summary: "List players, NPCs, items and objects on the map", Scope: ScopeWorldRead, Response: []EntityInfo{}, Paged: true, Handler: listEntitiesHandler, Query: append([]apiParam{
+			{Name: "kind", Type: "string", Description: "Only list entities of this kind"},
+		}, paginationParams...)},
+		{Method: "GET", Path: "/api/channels", Summary: "List chat channels", Scope: ScopeWorldRead, Response: []ChannelInfo{}, Paged: true, Handler: listChannelsHandler, Query: paginationParams},
+
+		{Method: "POST", Path: "/api/saveMap", Summary: "Save the map to disk", Scope: ScopeMapSave, Audit: "saveMap", Response: apiMessage{}, Handler: saveMapHandler},
+		{Method: "POST", Path: "/api/loadMap", Summary: "Reload the map from disk", Scope: ScopeMapLoad, Audit: "loadMap", Response: apiMessage{}, Handler: loadMapHandler},
+		{Method: "POST", Path: "/api/addCell", Summary: "Add a cell to the map", Scope: ScopeMapEdit, Audit: "addCell", Request: addCellRequest{}, Response: CellInfo{}, Handler: addCellHandler},
+		{Method: "POST", Path: "/api/deleteCell", Summary: "Clear a cell back to Empty", Scope: ScopeMapEdit, Audit: "deleteCell", Request: deleteCellRequest{}, Response: mapEditResult{}, Handler: deleteCellHandler},
+		{Method: "POST", Path: "/api/fillRect", Summary: "Set every cell of a rectangle to a type", Scope: ScopeMapEdit, Audit: "fillRect", Request: fillRectRequest{}, Response: mapEditResult{}, Handler: fillRectHandler},
+		{Method: "POST", Path: "/api/floodFill", Summary: "Set a cell and the connected cells of the same type to a type", Scope: ScopeMapEdit, Audit: "floodFill", Request: floodFillRequest{}, Response: mapEditResult{}, Handler: floodFillHandler},
+		{Method: "POST", Path: "/api/drawLine", Summary: "Draw a line of cells with a square brush", Scope: ScopeMapEdit, Audit: "drawLine", Request: drawLineRequest{}, Response: mapEditResult{}, Handler: drawLineHandler},
+		{Method: "POST", Path: "/api/stampMap", Summary: "Place a saved or one-off stamp on the map", Scope: ScopeMapEdit, Audit: "stampMap", Request: stampRequest{}, Response: mapEditResult{}, Handler: stampMapHandler},
+		{Method: "POST", Path: "/api/resizeMap", Summary: "Resize the map around an anchor", Scope: ScopeMapEdit, Audit: "resizeMap", Request: resizeRequest{}, Response: mapResizeResult{}, Handler: resizeMapHandler},
+		{Method: "GET", Path: "/api/mapHistory", Summary: "List recent map changes, newest first", Scope: ScopeMapEdit, Response: []mapHistoryEntry{}, Handler: mapHistoryHandler, Query: []apiParam{
+			{Name: "limit", Type: "integer", Description: fmt.Sprintf("Number of most recent changes, %d by default", mapHistoryDefaultLimit)},
+		}},
+		{Method: "POST", Path: "/api/undoMapEdit", Summary: "Undo the most recent map change", Scope: ScopeMapEdit, Audit: "undoMapEdit", Response: mapRevertResult{}, Handler: undoMapEditHandler},
+		{Method: "POST", Path: "/api/redoMapEdit", Summary: "Redo the most recently undone map change", Scope: ScopeMapEdit, Audit: "redoMapEdit", Response: mapRevertResult{}, Handler: redoMapEditHandler},
+		{Method: "GET", Path: "/api/stamps", Summary: "List the saved stamps", Scope: ScopeWorldRead, Response: []stamp{}, Handler: listStampsHandler},
+		{Method: "POST", Path: "/api/saveStamp", Summary: "Save a stamp for later use", Scope: ScopeMapEdit, Audit: "saveStamp", Request: stamp{}, Response: stamp{}, Handler: saveStampHandler},
+		{Method: "POST", Path: "/api/spawnEntity", Summary: "Place an NPC, item or object on the map", Scope: ScopeEntities, Audit: "spawnEntity", Request: spawnEntityRequest{}, Response: EntityInfo{}, Handler: spawnEntityHandler},
+		{Method: "POST", Path: "/api/removeEntity", Summary: "Take an entity off the map", Scope: ScopeEntities, Audit: "removeEntity", Request: removeEntityRequest{}, Response: EntityInfo{}, Handler: removeEntityHandler},
+		{Method: "POST", Path: "/api/moveEntity", Summary: "Move an entity to a cell", Scope: ScopeEntities, Audit: "moveEntity", Request: moveEntityRequest{}, Response: EntityInfo{}, Handler: moveEntityHandler},
+		{Method: "POST", Path: "/api/reloadNPCs", Summary: "Replace the NPCs with those of the NPC file", Scope: ScopeEntities, Audit: "reloadNPCs", Response: npcsLoaded{}, Handler: reloadNPCsHandler},
+		{Method: "POST", Path: "/api/setNPCBehaviour", Summary: "Change what an NPC does", Scope: ScopeEntities, Audit: "setNPCBehaviour", Request: setNPCBehaviourRequest{}, Response: EntityInfo{}, Handler: setNPCBehaviourHandler},
+		{Method: "GET", Path: "/api/items", Summary: "List the item definitions", Scope: ScopeWorldRead, Response: []itemDefinition{}, Handler: listItemsHandler},
+		{Method: "GET", Path: "/api/inventory", Summary: "Show a player's inventory", Scope: ScopeItems, Response: inventoryInfo{}, Handler: getInventoryHandler, Query: []apiParam{
+			{Name: "username", Type: "string", Required: true, Description: "Player whose inventory is shown"},
+		}},
+		{Method: "POST", Path: "/api/grantItem", Summary: "Add items to a player's inventory", Scope: ScopeItems, Audit: "grantItem", Request: itemGrantRequest{}, Response: inventoryInfo{}, Handler: grantItemHandler},
+		{Method: "POST", Path: "/api/removeItem", Summary: "Take items out of a player's inventory", Scope: ScopeItems, Audit: "removeItem", Request: itemGrantRequest{}, Response: inventoryInfo{}, Handler: removeItemHandler},
+		{Method: "POST", Path: "/api/kickAllUsersInCell", Summary: "Disconnect the users in a cell", Scope: ScopeUsersKick, Audit: "kickAllUsersInCell", Request: kickUsersInCellRequest{}, Response: kickedUsers{}, Handler: kickUsersInCellHandler},
+		{Method: "GET", Path: "/api/logLevel", Summary: "Show the log level and format", Scope: ScopeServerControl, Response: logLevelInfo{}, Handler: getLogLevelHandler},
+		{Method: "POST", Path: "/api/setLogLevel", Summary: "Change the log level at runtime", Scope: ScopeServerControl, Audit: "setLogLevel", Request: setLogLevelRequest{}, Response: logLevelInfo{}, Handler: setLogLevelHandler},
+		{Method: "POST", Path: "/api/reloadConfig", Summary: "Reload the settings that can change without a restart", Scope: ScopeServerControl, Audit: "reloadConfig", Response: reloadReport{}, Handler: reloadConfigHandler},
+		{Method: "POST", Path: "/api/shutdown", Summary: "Disconnect everyone and stop the game server", Scope: ScopeServerControl, Audit: "shutdown", Response: apiMessage{}, Handler: shutdownHandler},
+	}
+}
+
+// registerAPIRoutes installs the routes on mux. Every path answers methods it
+// does not support, and unknown API paths, with an error envelope.
+func registerAPIRoutes(mux *http.ServeMux, routes []apiRoute) {
+	paths := []string{}
+	methods := map[string]map[string]http.HandlerFunc{}
+
+	for _, route := range routes {
+		handler := route.Handler
+		if route.Scope != "" {
+			handler = requireScope(route.Scope, handler)
+		}
+		if route.Audit != "" {
+			handler = audited(route.Audit, handler)
+		}
+
+		if _, ok := methods[route.Path]; !ok {
+			paths = append(paths, route.Path)
+			methods[route.Path] = map[string]http.HandlerFunc{}
+		}
+		methods[route.Path][route.Method] = handler
+	}
+
+	for _, path := range paths {
+		mux.HandleFunc(path, instrumentAPI(path, methodDispatcher(methods[path])))
+	}
+
+	mux.HandleFunc("/api/", instrumentAPI("unknown", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, fmt.Sprintf("No endpoint at %s", r.URL.Path))
+	}))
+}
+
+func methodDispatcher(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	allowed := []string{}
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := handlers[r.Method]; ok {
+			handler(w, r)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeAPIError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, fmt.Sprintf("%s only accepts %s", r.URL.Path, strings.Join(allowed, ", ")))
+	}
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPISpec(apiRoutes()))
+}
+
+// openAPISpec builds an OpenAPI 3 document describing the routes. Schemas
+// are derived from the JSON tags of the request and response types.
+func openAPISpec(routes []apiRoute) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+
+	errorSchema := envelopeSchema(nil, schemas)
+	for _, route := range routes {
+		operation := map[string]interface{}{
+			"summary":     route.Summary,
+			"operationId": operationID(route),
+		}
+
+		if route.Scope != "" {
+			operation["security"] = []map[string][]string{{"rpgAuth": {}}}
+			operation["x-required-scope"] = route.Scope
+		}
+
+		if len(route.Query) > 0 {
+			params := []map[string]interface{}{}
+			for _, p := range route.Query {
+				params = append(params, map[string]interface{}{
+					"name":        p.Name,
+					"in":          "query",
+					"description": p.Description,
+					"required":    p.Required,
+					"schema":      map[string]string{"type": p.Type},
+				})
+			}
+			operation["parameters"] = params
+		}
+
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaFor(reflect.TypeOf(route.Request), schemas)},
+				},
+			}
+		}
+
+		var data map[string]interface{}
+		if route.Response != nil {
+			data = schemaFor(reflect.TypeOf(route.Response), schemas)
+			if route.Paged {
+				data = pageSchema(data)
+			}
+		}
+		// Streams and the document itself are not wrapped in an envelope
+		contentType, success := "application/json", envelopeSchema(data, schemas)
+		if route.ContentType != "" {
+			contentType, success = route.ContentType, data
+		}
+		if route.Path == "/api/openapi.json" {
+			success = map[string]interface{}{"type": "object"}
+		}
+		operation["responses"] = map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "Success",
+				"content":     map[string]interface{}{contentType: map[string]interface{}{"schema": success}},
+			},
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}},
+			},
+		}
+
+		if paths[route.Path] == nil {
+			paths[route.Path] = map[string]interface{}{}
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "RPG server admin API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"rpgAuth": map[string]string{"type": "apiKey", "in": "header", "name": "RPG_AUTH"},
+			},
+		},
+	}
+}
+
+func operationID(route apiRoute) string {
+	if route.Audit != "" {
+		return route.Audit
+	}
+	name := strings.Trim(strings.TrimPrefix(route.Path, "/api"), "/")
+	name = strings.TrimSuffix(name, ".json")
+	return strings.ToLower(route.Method) + strings.ToUpper(name[:1]) + name[1:]
+}
+
+// envelopeSchema describes an apiResponse. A nil data schema describes an error.
+func envelopeSchema(data map[string]interface{}, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{
+		"ok":    map[string]string{"type": "boolean"},
+		"error": schemaFor(reflect.TypeOf(apiError{}), schemas),
+	}
+	if data != nil {
+		properties["data"] = data
+	}
+	return map[string]interface{}{
+		"type":       "object",
+		"required":   []string{"ok"},
+		"properties": properties,
+	}
+}
+
+func pageSchema(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"total", "offset", "limit", "items"},
+		"properties": map[string]interface{}{
+			"total":  map[string]string{"type": "integer"},
+			"offset": map[string]string{"type": "integer"},
+			"limit":  map[string]string{"type": "integer"},
+			"items":  items,
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor describes a Go type as a JSON schema. Named structs are added to
+// schemas once and referenced.
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Reserve the name first so recursive types terminate
+			schemas[t.Name()] = map[string]interface{}{}
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	addStructFields(t, schemas, properties, &required)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func addStructFields(t reflect.Type, schemas map[string]interface{}, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		// Embedded structs without a tag have their fields promoted
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addStructFields(field.Type, schemas, properties, required)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = schemaFor(field.Type, schemas)
+		if !strings.Contains(tag, ",omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
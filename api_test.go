@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func decodeAPIResponse(t *testing.T, w *httptest.ResponseRecorder, data interface{}) apiResponse {
+	response := apiResponse{Data: data}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to parse API response: %v", err)
+	}
+	return response
+}
+
+func TestRegisteredRoutesRejectWrongMethod(t *testing.T) {
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, apiRoutes())
+
+	req := httptest.NewRequest("GET", "/api/saveMap", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Fatalf("Expected 405 allowing POST, got %d %q", w.Code, w.Header().Get("Allow"))
+	}
+	response := decodeAPIResponse(t, w, nil)
+	if response.OK || response.Error == nil || response.Error.Code != ErrMethodNotAllowed {
+		t.Fatalf("Unexpected error envelope: %+v", response)
+	}
+
+	// Presence answers both methods
+	req = httptest.NewRequest("DELETE", "/api/presence", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Header().Get("Allow") != "GET, POST" {
+		t.Fatalf("Expected presence to allow GET and POST, got %q", w.Header().Get("Allow"))
+	}
+
+	req = httptest.NewRequest("GET", "/api/nothingHere", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if response := decodeAPIResponse(t, w, nil); w.Code != http.StatusNotFound || response.Error.Code != ErrNotFound {
+		t.Fatalf("Expected a not_found envelope, got %d %+v", w.Code, response)
+	}
+}
+
+func TestRegisteredRoutesRequireScope(t *testing.T) {
+	previous := auditTrail
+	auditTrail = newAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	defer func() { auditTrail = previous }()
+
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, apiRoutes())
+
+	req := httptest.NewRequest("POST", "/api/kickAllUsers", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if response := decodeAPIResponse(t, w, nil); w.Code != http.StatusUnauthorized || response.Error.Code != ErrUnauthorized {
+		t.Fatalf("Expected an unauthorized envelope, got %d %+v", w.Code, response)
+	}
+}
+
+func TestHandlerValidationErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		code    string
+		fields  []string
+	}{
+		{name: "empty body", handler: kickUserHandler, body: "", code: ErrInvalidJSON},
+		{name: "malformed", handler: kickUserHandler, body: "{", code: ErrInvalidJSON},
+		{name: "unknown field", handler: kickUserHandler, body: `{"username": "bob", "colour": "red"}`, code: ErrInvalidJSON},
+		{name: "missing username", handler: kickUserHandler, body: `{"reason": "spam"}`, code: ErrValidationFailed, fields: []string{"username"}},
+		{name: "bad mute", handler: muteUserHandler, body: `{"duration_seconds": -5}`, code: ErrValidationFailed, fields: []string{"username", "duration_seconds"}},
+		{name: "bad ban ip", handler: banUserHandler, body: `{"ip": "not-an-ip"}`, code: ErrValidationFailed, fields: []string{"ip"}},
+		{name: "bad cell", handler: addCellHandler, body: `{"x": -1, "y": 2, "type": "Lava"}`, code: ErrValidationFailed, fields: []string{"x", "type"}},
+		{name: "bad whisper", handler: sendMessageToUserHandler, body: `{"from_username": "alice"}`, code: ErrValidationFailed, fields: []string{"to_username", "message"}},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/api/test", strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		c.handler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", c.name, http.StatusBadRequest, w.Code)
+			continue
+		}
+		response := decodeAPIResponse(t, w, nil)
+		if response.OK || response.Error == nil || response.Error.Code != c.code {
+			t.Errorf("%s: unexpected error envelope %+v", c.name, response.Error)
+			continue
+		}
+		if len(response.Error.Fields) != len(c.fields) {
+			t.Errorf("%s: expected errors for %v, got %v", c.name, c.fields, response.Error.Fields)
+		}
+		for _, field := range c.fields {
+			if response.Error.Fields[field] == "" {
+				t.Errorf("%s: expected an error for %s, got %v", c.name, field, response.Error.Fields)
+			}
+		}
+	}
+}
+
+func TestHandlerNotFoundEnvelope(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/kickUser", strings.NewReader(`{"username": "ghost"}`))
+	w := httptest.NewRecorder()
+	kickUserHandler(w, req)
+
+	if response := decodeAPIResponse(t, w, nil); w.Code != http.StatusNotFound || response.Error.Code != ErrNotFound {
+		t.Fatalf("Expected a not_found envelope, got %d %+v", w.Code, response)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/openapi.json", nil)
+	w := httptest.NewRecorder()
+	openAPIHandler(w, req)
+
+	var doc struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatalf("Failed to parse OpenAPI document: %v", err)
+	}
+
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Fatalf("Unexpected OpenAPI version %q", doc.OpenAPI)
+	}
+	for _, route := range apiRoutes() {
+		operation, ok := doc.Paths[route.Path][strings.ToLower(route.Method)]
+		if !ok {
+			t.Errorf("%s %s is missing from the document", route.Method, route.Path)
+			continue
+		}
+		if route.Scope != "" && operation["x-required-scope"] != route.Scope {
+			t.Errorf("%s %s documents scope %v, want %s", route.Method, route.Path, operation["x-required-scope"], route.Scope)
+		}
+	}
+
+	sanction, ok := doc.Components.Schemas["Sanction"]
+	if !ok {
+		t.Fatalf("Expected a Sanction schema, got %v", doc.Components.Schemas)
+	}
+	properties := sanction["properties"].(map[string]interface{})
+	if expires := properties["expires_at"].(map[string]interface{}); expires["format"] != "date-time" {
+		t.Fatalf("Expected expires_at to be a date-time, got %v", expires)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditFilename = "audit.jsonl"
+	// Longest request payload kept in an audit entry
+	auditPayloadLimit = 512
+	// Number of entries returned by /api/audit when no limit is given
+	auditDefaultLimit = 100
+)
+
+// Payload fields that are never written to the audit log
+var auditRedactedFields = []string{"token", "password", "secret"}
+
+var auditTrail = newAuditLog(auditFilename)
+
+const auditEntryKey apiContextKey = 1
+
+type auditCell struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// auditEntry records a single admin API request.
+type auditEntry struct {
+	Time       time.Time   `json:"time"`
+	Actor      string      `json:"actor"`
+	Action     string      `json:"action"`
+	Method     string      `json:"method"`
+	RemoteAddr string      `json:"remote_addr"`
+	Payload    string      `json:"payload,omitempty"`
+	Users      []string    `json:"users,omitempty"`
+	Cells      []auditCell `json:"cells,omitempty"`
+	Status     int         `json:"status,omitempty"`
+	Outcome    string      `json:"outcome"`
+}
+
+// auditLog is an append-only JSON lines file of admin actions.
+type auditLog struct {
+	mu       sync.Mutex
+	filename string
+}
+
+type auditFilter struct {
+	Actor  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func newAuditLog(filename string) *auditLog {
+	return &auditLog{filename: filename}
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// append writes one entry to the end of the log.
+func (al *auditLog) append(entry *auditEntry) error {
+	jsonData, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	file, err := os.OpenFile(al.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(jsonData, '\n'))
+	return err
+}
+
+// query returns the most recent entries matching the filter, oldest first.
+func (al *auditLog) query(filter auditFilter) ([]*auditEntry, error) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	file, err := os.Open(al.filename)
+	if os.IsNotExist(err) {
+		return []*auditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	matches := []*auditEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if filter.Actor != "" && entry.Actor != filter.Actor {
+			continue
+		}
+		if filter.Action != "" && entry.Action != filter.Action {
+			continue
+		}
+		if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && entry.Time.After(filter.Until) {
+			continue
+		}
+		matches = append(matches, &entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if filter.Limit > 0 && len(matches) > filter.Limit {
+		matches = matches[len(matches)-filter.Limit:]
+	}
+	return matches, nil
+}
+
+// summarizePayload compacts a JSON request body, drops secrets and truncates it.
+func summarizePayload(body []byte) string {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return ""
+	}
+
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) == nil {
+		for _, name := range auditRedactedFields {
+			if _, ok := fields[name]; ok {
+				fields[name] = "[REDACTED]"
+			}
+		}
+		if compact, err := json.Marshal(fields); err == nil {
+			body = compact
+		}
+	}
+
+	summary := string(body)
+	if len(summary) > auditPayloadLimit {
+		summary = summary[:auditPayloadLimit] + "..."
+	}
+	return summary
+}
+
+// audited records every request to the wrapped handler in the audit log.
+// It must wrap requireScope so the entry also covers rejected requests.
+func audited(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := &auditEntry{
+			Time:       time.Now().UTC(),
+			Actor:      "anonymous",
+			Action:     action,
+			Method:     r.Method,
+			RemoteAddr: r.RemoteAddr,
+		}
+
+		if r.Body != nil {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+			if err == nil {
+				entry.Payload = summarizePayload(body)
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r.WithContext(context.WithValue(r.Context(), auditEntryKey, entry)))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		entry.Status = recorder.status
+		switch {
+		case recorder.status == http.StatusUnauthorized || recorder.status == http.StatusForbidden:
+			entry.Outcome = "denied"
+		case recorder.status >= 400:
+			entry.Outcome = "failure"
+		default:
+			entry.Outcome = "success"
+		}
+
+		recordAudit(entry)
+	}
+}
+
+// recordAudit appends a finished entry to the audit log and publishes it as an event.
+func recordAudit(entry *auditEntry) {
+	if err := auditTrail.append(entry); err != nil {
+		serverLog.error("failed to write audit log", "err", err)
+	}
+	events.publish(EventAdminAction, entry)
+}
+
+// auditEntryFor returns the audit entry of the request, if it is being audited.
+func auditEntryFor(r *http.Request) *auditEntry {
+	entry, _ := r.Context().Value(auditEntryKey).(*auditEntry)
+	return entry
+}
+
+// auditUsers notes the users affected by an admin request.
+func auditUsers(r *http.Request, usernames ...string) {
+	entry := auditEntryFor(r)
+	if entry == nil {
+		return
+	}
+	for _, username := range usernames {
+		seen := false
+		for _, u := range entry.Users {
+			if u == username {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			entry.Users = append(entry.Users, username)
+		}
+	}
+}
+
+// auditCells notes a cell affected by an admin request.
+func auditCells(r *http.Request, x, y int) {
+	if entry := auditEntryFor(r); entry != nil {
+		entry.Cells = append(entry.Cells, auditCell{X: x, Y: y})
+	}
+}
+
+func auditQueryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := auditFilter{
+		Actor:  query.Get("actor"),
+		Action: strings.TrimPrefix(query.Get("action"), "/api/"),
+		Limit:  auditDefaultLimit,
+	}
+
+	var err error
+	errs := fieldErrors{}
+	if v := query.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			errs.add("since", "must be an RFC3339 timestamp")
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			errs.add("until", "must be an RFC3339 timestamp")
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 {
+			errs.add("limit", "must be a positive integer")
+		}
+	}
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	entries, err := auditTrail.query(filter)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error reading audit log: %v", err))
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, entries)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestAuditedRecordsActorPayloadAndOutcome(t *testing.T) {
+	previous := auditTrail
+	auditTrail = newAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	defer func() { auditTrail = previous }()
+
+	handler := audited("kickUser", requireScope(ScopeUsersKick, func(w http.ResponseWriter, r *http.Request) {
+		auditUsers(r, "griefer", "griefer")
+		auditCells(r, 3, 4)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	body := `{"username": "griefer", "reason": "spam", "token": "hunter2"}`
+	req := httptest.NewRequest("POST", "/api/kickUser", strings.NewReader(body))
+	req.Header.Set("RPG_AUTH", signTestClaims(t, jwt.MapClaims{"sub": "mod1", "roles": []string{RoleModerator}, "exp": time.Now().Add(time.Hour).Unix()}))
+	handler(httptest.NewRecorder(), req)
+
+	// A builder is not allowed to kick
+	req = httptest.NewRequest("POST", "/api/kickUser", strings.NewReader(body))
+	req.Header.Set("RPG_AUTH", signTestClaims(t, jwt.MapClaims{"sub": "builder1", "roles": []string{RoleBuilder}, "exp": time.Now().Add(time.Hour).Unix()}))
+	handler(httptest.NewRecorder(), req)
+
+	entries, err := auditTrail.query(auditFilter{})
+	if err != nil {
+		t.Fatalf("Failed to query audit log: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries, got %d", len(entries))
+	}
+
+	first := entries[0]
+	if first.Actor != "mod1" || first.Action != "kickUser" || first.Status != http.StatusNotFound || first.Outcome != "failure" {
+		t.Fatalf("Unexpected audit entry: %+v", first)
+	}
+	if len(first.Users) != 1 || first.Users[0] != "griefer" || len(first.Cells) != 1 || first.Cells[0] != (auditCell{X: 3, Y: 4}) {
+		t.Fatalf("Unexpected affected users or cells: %+v", first)
+	}
+	if strings.Contains(first.Payload, "hunter2") || !strings.Contains(first.Payload, `"reason":"spam"`) {
+		t.Fatalf("Unexpected payload summary: %s", first.Payload)
+	}
+
+	if entries[1].Actor != "builder1" || entries[1].Outcome != "denied" || entries[1].Status != http.StatusForbidden {
+		t.Fatalf("Unexpected denied entry: %+v", entries[1])
+	}
+}
+
+func TestAuditQueryFilters(t *testing.T) {
+	log := newAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	base := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, e := range []auditEntry{
+		{Actor: "alice", Action: "loadMap"},
+		{Actor: "bob", Action: "kickUser"},
+		{Actor: "alice", Action: "kickUser"},
+		{Actor: "alice", Action: "kickUser"},
+	} {
+		e.Time = base.Add(time.Duration(i) * time.Hour)
+		if err := log.append(&e); err != nil {
+			t.Fatalf("Failed to append audit entry: %v", err)
+		}
+	}
+
+	entries, _ := log.query(auditFilter{Actor: "alice", Action: "kickUser"})
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries for alice/kickUser, got %d", len(entries))
+	}
+
+	entries, _ = log.query(auditFilter{Since: base.Add(time.Hour), Until: base.Add(2 * time.Hour)})
+	if len(entries) != 2 || entries[0].Actor != "bob" || entries[1].Actor != "alice" {
+		t.Fatalf("Unexpected entries in time range: %+v", entries)
+	}
+
+	entries, _ = log.query(auditFilter{Limit: 1})
+	if len(entries) != 1 || !entries[0].Time.Equal(base.Add(3*time.Hour)) {
+		t.Fatalf("Expected only the most recent entry, got %+v", entries)
+	}
+}
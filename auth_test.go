@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func signTestClaims(t *testing.T, claims jwt.MapClaims) string {
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(apijwtSecret))
+	if err != nil {
+		t.Fatalf("Error creating test JWT: %v", err)
+	}
+	return tokenString
+}
+
+func TestRequireScope(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	handler := requireScope(ScopeUsersKick, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(apiSubject(r)))
+	})
+
+	cases := []struct {
+		name   string
+		token  string
+		status int
+		code   string
+	}{
+		{name: "missing token", token: "", status: http.StatusUnauthorized, code: "unauthorized"},
+		{name: "bad signature", token: "not.a.token", status: http.StatusUnauthorized, code: "unauthorized"},
+		{name: "no expiry", token: signTestClaims(t, jwt.MapClaims{"sub": "mod", "roles": []string{RoleModerator}}), status: http.StatusUnauthorized, code: "unauthorized"},
+		{name: "expired", token: signTestClaims(t, jwt.MapClaims{"sub": "mod", "roles": []string{RoleModerator}, "exp": time.Now().Add(-time.Minute).Unix()}), status: http.StatusUnauthorized, code: "unauthorized"},
+		{name: "no roles", token: signTestClaims(t, jwt.MapClaims{"sub": "nobody", "exp": exp}), status: http.StatusForbidden, code: "forbidden"},
+		{name: "wrong role", token: signTestClaims(t, jwt.MapClaims{"sub": "builder", "roles": []string{RoleBuilder}, "exp": exp}), status: http.StatusForbidden, code: "forbidden"},
+		{name: "moderator", token: signTestClaims(t, jwt.MapClaims{"sub": "mod", "roles": []string{RoleModerator}, "exp": exp}), status: http.StatusOK},
+		{name: "operator", token: signTestClaims(t, jwt.MapClaims{"sub": "op", "roles": []string{RoleOperator}, "exp": exp}), status: http.StatusOK},
+		{name: "explicit scope", token: signTestClaims(t, jwt.MapClaims{"sub": "bot", "scope": "chat:announce users:kick", "exp": exp}), status: http.StatusOK},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/api/kickUser", nil)
+		if c.token != "" {
+			req.Header.Set("RPG_AUTH", c.token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, w.Code)
+			continue
+		}
+		if c.code == "" {
+			continue
+		}
+
+		var body apiResponse
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.OK || body.Error == nil || body.Error.Code != c.code || body.Error.Message == "" {
+			t.Errorf("%s: unexpected error body %+v (%v)", c.name, body, err)
+		}
+	}
+}
+
+func TestRequireScopePassesSubject(t *testing.T) {
+	handler := requireScope(ScopeMapEdit, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(apiSubject(r)))
+	})
+
+	req := httptest.NewRequest("POST", "/api/addCell", nil)
+	req.Header.Set("RPG_AUTH", signTestClaims(t, jwt.MapClaims{"sub": "mapper", "roles": []string{RoleBuilder}, "exp": time.Now().Add(time.Hour).Unix()}))
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != "mapper" {
+		t.Fatalf("Expected the handler to see subject %q, got %d %q", "mapper", w.Code, w.Body.String())
+	}
+}
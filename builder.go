@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const spawnFilename = "spawn.json"
+
+var spawn = newSpawnStore(spawnFilename)
+
+// Help of the commands shown to players who can edit the map
+var builderHelp = []map[string]string{
+	{"command": "/setcell [x] [y] [type]", "description": "Change the type of a cell."},
+	{"command": "/fill [x] [y] [width] [height] [type]", "description": "Change the type of every cell of a rectangle."},
+	{"command": "/spawnpoint [x] [y]", "description": "Make a cell, or your own cell, where new players join the map."},
+}
+
+// spawnStore keeps the cell new players join the map on in a JSON file.
+type spawnStore struct {
+	mu       sync.Mutex
+	filename string
+	X        int `json:"x"`
+	Y        int `json:"y"`
+}
+
+func newSpawnStore(filename string) *spawnStore {
+	return &spawnStore{filename: filename}
+}
+
+func (ss *spawnStore) load() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	byteValue, err := ioutil.ReadFile(ss.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(byteValue, ss)
+}
+
+// set moves the spawn point and saves it.
+func (ss *spawnStore) set(x, y int) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.X, ss.Y = x, y
+	jsonData, err := json.Marshal(ss)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ss.filename, jsonData, 0644)
+}
+
+func (ss *spawnStore) get() (int, int) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.X, ss.Y
+}
+
+// spawnCell returns where new players join the map, or the origin when the spawn
+// point is no longer on the map.
+func spawnCell() (int, int) {
+	x, y := spawn.get()
+
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+	if !insideMapLocked(x, y) {
+		return 0, 0
+	}
+	return x, y
+}
+
+// setSpawnPoint makes a walkable cell the spawn point.
+func setSpawnPoint(x, y int, author string) error {
+	gridMutex.RLock()
+	err := error(nil)
+	if !insideMapLocked(x, y) {
+		err = errOutsideMap
+	} else if !isWalkable(grid[y][x].Type) {
+		err = errNotWalkable
+	}
+	gridMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := spawn.set(x, y); err != nil {
+		return err
+	}
+	serverLog.info("spawn point moved", "x", x, "y", y, "author", author)
+	return nil
+}
+
+// parseSessionToken verifies a session token signed with the server secret, as
+// issued for travel between servers or by the login service.
+func parseSessionToken(tokenString string) (*travelClaims, error) {
+	claims := &travelClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(serverjwtSecret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("token is not valid")
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if claims.Username == "" {
+		return nil, fmt.Errorf("token has no username")
+	}
+	return claims, nil
+}
+
+// builderUsage returns the usage line of a builder command.
+func builderUsage(command string) string {
+	for _, h := range builderHelp {
+		if strings.HasPrefix(h["command"], "/"+command+" ") {
+			return fmt.Sprintf("Usage: %s\n", h["command"])
+		}
+	}
+	return ""
+}
+
+// hasScope reports whether the roles of the player's session token grant the scope.
+func (cli *client) hasScope(scope string) bool {
+	claims := apiClaims{Roles: cli.roles}
+	return claims.hasScope(scope)
+}
+
+// builderCommand runs one of the map editing commands for a player with the
+// builder role. Changes go through the same edits as the admin API and are
+// written to the audit log with the player as the actor.
+func builderCommand(cli *client, command string, args []string) {
+	if !cli.hasScope(ScopeMapEdit) {
+		cli.conn.Write([]byte(fmt.Sprintf("You need the builder role to use /%s.\n", command)))
+		return
+	}
+
+	ints := func(values []string) ([]int, bool) {
+		parsed := make([]int, len(values))
+		for i, v := range values {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, false
+			}
+			parsed[i] = n
+		}
+		return parsed, true
+	}
+
+	entry := &auditEntry{
+		Time:       time.Now().UTC(),
+		Actor:      cli.username,
+		Method:     "GAME",
+		RemoteAddr: cli.ip,
+		Payload:    strings.TrimSpace("/" + command + " " + strings.Join(args, " ")),
+		Outcome:    "success",
+	}
+
+	var err error
+	var reply string
+	switch command {
+	case "setcell":
+		n, ok := ints(args[:min(2, len(args))])
+		if len(args) != 3 || !ok {
+			cli.conn.Write([]byte(builderUsage(command)))
+			return
+		}
+		entry.Action = "setCell"
+		entry.Cells = []auditCell{{X: n[0], Y: n[1]}}
+		err = setCellType(n[0], n[1], CellType(args[2]), cli.username)
+		reply = fmt.Sprintf("Cell (%d, %d) is now %s.\n", n[0], n[1], args[2])
+
+	case "fill":
+		n, ok := ints(args[:min(4, len(args))])
+		if len(args) != 5 || !ok {
+			cli.conn.Write([]byte(builderUsage(command)))
+			return
+		}
+		entry.Action = "fillRect"
+		area := mapRect{X: n[0], Y: n[1], Width: n[2], Height: n[3]}
+		cellType := CellType(args[4])
+		errs := fieldErrors{}
+		if area.validate(errs, "area"); len(errs) > 0 {
+			err = fmt.Errorf("the %s", errs["area"])
+			break
+		}
+		if !isCellType(cellType) {
+			err = fmt.Errorf("unknown cell type %q, expected one of %s", cellType, strings.Join(cellTypeNames(), ", "))
+			break
+		}
+
+		var result *mapEditResult
+		result, err = applyMapEdit("rect", cli.username, func() ([]cellChange, error) {
+			return rectChanges(area, cellType), nil
+		})
+		if err == nil {
+			for _, change := range result.Edit.Cells {
+				entry.Cells = append(entry.Cells, auditCell{X: change.X, Y: change.Y})
+			}
+			reply = fmt.Sprintf("Changed %d cells to %s.\n", len(result.Edit.Cells), cellType)
+		}
+
+	case "spawnpoint":
+		// Without coordinates the player's own cell becomes the spawn point
+		x, y := cli.x, cli.y
+		if len(args) > 0 {
+			n, ok := ints(args)
+			if len(args) != 2 || !ok {
+				cli.conn.Write([]byte(builderUsage(command)))
+				return
+			}
+			x, y = n[0], n[1]
+		}
+		entry.Action = "setSpawnPoint"
+		entry.Cells = []auditCell{{X: x, Y: y}}
+		err = setSpawnPoint(x, y, cli.username)
+		reply = fmt.Sprintf("New players now join at (%d, %d).\n", x, y)
+	}
+
+	if err != nil {
+		entry.Outcome = "failure"
+		reply = fmt.Sprintf("Error: %v\n", err)
+	}
+	recordAudit(entry)
+	cli.conn.Write([]byte(reply))
+}
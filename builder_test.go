@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// expectLine waits for a plain text line containing the text.
+func expectLine(t *testing.T, lines chan string, text string) {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, text) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %q", text)
+		}
+	}
+}
+
+func TestBuilderCommands(t *testing.T) {
+	initGrid()
+	isolateMapHistory(t)
+	previousAudit, previousSpawn := auditTrail, spawn
+	auditTrail = newAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	spawn = newSpawnStore(filepath.Join(t.TempDir(), "spawn.json"))
+	defer func() { auditTrail, spawn = previousAudit, previousSpawn }()
+
+	builder, lines := newPipeClient(t, "builder", 5, 5)
+	builder.roles = []string{RoleBuilder}
+	builder.commandRateLimiter = newRateLimiter(100, time.Second)
+	player, playerLines := newPipeClient(t, "player", 0, 0)
+
+	handleCommand(player, "/setcell 1 1 Water\n")
+	expectLine(t, playerLines, "You need the builder role to use /setcell.")
+	if grid[1][1].Type != Empty {
+		t.Fatalf("Expected players without the role to be refused")
+	}
+
+	handleCommand(builder, "/fill 0 2 3 2 Water\n")
+	expectLine(t, lines, "Changed 6 cells to Water.")
+	if grid[3][2].Type != Water {
+		t.Fatalf("Expected the rectangle to be filled")
+	}
+	if msg := expectAction(t, playerLines, "map_edit"); len(msg["cells"].([]interface{})) != 6 {
+		t.Fatalf("Expected the change to be broadcast, got %+v", msg)
+	}
+
+	handleCommand(builder, "/setcell 9 9 Mountain\n")
+	expectLine(t, lines, "Cell (9, 9) is now Mountain.")
+	handleCommand(builder, "/setcell 9 9\n")
+	expectLine(t, lines, "Usage: /setcell [x] [y] [type]")
+	handleCommand(builder, "/spawnpoint 9 9\n")
+	expectLine(t, lines, "Error: The cell cannot be walked on")
+	handleCommand(builder, "/spawnpoint\n")
+	expectLine(t, lines, "New players now join at (5, 5).")
+	if x, y := spawnCell(); x != 5 || y != 5 {
+		t.Fatalf("Expected the spawn point to move, got (%d, %d)", x, y)
+	}
+
+	// The edits share the history and audit trail of the admin API
+	if entries := mapHistory.list(10); len(entries) != 2 || entries[0].Author != "builder" {
+		t.Fatalf("Unexpected map history %+v", entries)
+	}
+	entries, err := auditTrail.query(auditFilter{Actor: "builder"})
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	outcomes := []string{}
+	for _, entry := range entries {
+		outcomes = append(outcomes, entry.Action+":"+entry.Outcome)
+	}
+	expected := "fillRect:success setCell:success setSpawnPoint:failure setSpawnPoint:success"
+	if strings.Join(outcomes, " ") != expected || entries[0].Method != "GAME" || len(entries[0].Cells) != 6 {
+		t.Fatalf("Expected audit entries %q, got %q %+v", expected, strings.Join(outcomes, " "), entries)
+	}
+
+	handleCommand(builder, "/fill 0 0 4294967296 4294967296 Water\n")
+	expectLine(t, lines, "Error: the width times height must be at most 10000")
+}
+
+func TestParseSessionToken(t *testing.T) {
+	sign := func(claims *travelClaims, secret string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return token
+	}
+	expires := jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}
+
+	claims, err := parseSessionToken(sign(&travelClaims{StandardClaims: expires, ServerName: "hub", Username: "bob", Roles: []string{RoleBuilder}}, serverjwtSecret))
+	if err != nil || claims.Username != "bob" || len(claims.Roles) != 1 {
+		t.Fatalf("Expected a valid token, got %+v %v", claims, err)
+	}
+	if _, err := parseSessionToken(sign(&travelClaims{StandardClaims: expires, Username: "bob", Roles: []string{RoleBuilder}}, "not the secret")); err == nil {
+		t.Fatalf("Expected a token signed with another secret to be refused")
+	}
+	if _, err := parseSessionToken(sign(&travelClaims{Username: "bob"}, serverjwtSecret)); err == nil {
+		t.Fatalf("Expected a token without an expiry to be refused")
+	}
+}
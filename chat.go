@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// How many cells away in each direction a /shout can be heard
+	shoutRadius = 5
+	// Width and height in cells of the square zones used by /zone
+	zoneSize = 10
+)
+
+// chatScope describes a proximity chat mode and its own rate limit.
+type chatScope struct {
+	name      string
+	maxTokens int
+	fillRate  time.Duration
+}
+
+var chatScopes = map[string]chatScope{
+	"local": {name: "local", maxTokens: 5, fillRate: time.Second},
+	"shout": {name: "shout", maxTokens: 2, fillRate: 5 * time.Second},
+	"zone":  {name: "zone", maxTokens: 3, fillRate: 3 * time.Second},
+}
+
+// chatLimiter returns the client's rate limiter for a chat scope, creating it on first use.
+// The configured limit of the scope, which a reload may change, takes precedence over its default.
+func (cli *client) chatLimiter(scope chatScope) *rateLimiter {
+	maxTokens, fillRate := scope.maxTokens, scope.fillRate
+	if limit, ok := currentConfig().ChatRateLimits[scope.name]; ok {
+		maxTokens, fillRate = limit.Limit, time.Duration(limit.Period)
+	}
+
+	if cli.chatRateLimiters == nil {
+		cli.chatRateLimiters = make(map[string]*rateLimiter)
+	}
+	rl, ok := cli.chatRateLimiters[scope.name]
+	if !ok {
+		rl = newRateLimiter(maxTokens, fillRate)
+		cli.chatRateLimiters[scope.name] = rl
+	} else {
+		rl.setLimit(maxTokens, fillRate)
+	}
+	return rl
+}
+
+// scopeBounds returns the inclusive rectangle of cells a message in the given scope reaches.
+func scopeBounds(scope string, x, y int) (int, int, int, int) {
+	switch scope {
+	case "shout":
+		return x - shoutRadius, y - shoutRadius, x + shoutRadius, y + shoutRadius
+	case "zone":
+		zx, zy := (x/zoneSize)*zoneSize, (y/zoneSize)*zoneSize
+		return zx, zy, zx + zoneSize - 1, zy + zoneSize - 1
+	}
+	return x, y, x, y
+}
+
+// clientsInRect collects the clients occupying the cells of an inclusive rectangle.
+func clientsInRect(minX, minY, maxX, maxY int) []*client {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	found := []*client{}
+	for y := minY; y <= maxY; y++ {
+		if y < 0 || y >= len(grid) {
+			continue
+		}
+		for x := minX; x <= maxX; x++ {
+			if x < 0 || x >= len(grid[y]) {
+				continue
+			}
+			grid[y][x].Clients.Range(func(_, v interface{}) bool {
+				found = append(found, v.(*client))
+				return true
+			})
+		}
+	}
+	return found
+}
+
+// scopedChat sends a message to every client within reach of the sender for the given scope.
+func scopedChat(cli *client, scopeName, message string) {
+	scope, ok := chatScopes[scopeName]
+	if !ok {
+		cli.conn.Write([]byte(fmt.Sprintf("Unknown chat scope: %s\n", scopeName)))
+		return
+	}
+
+	if isMuted(cli) {
+		cli.conn.Write([]byte("You are muted and cannot send messages.\n"))
+		return
+	}
+
+	if !cli.chatLimiter(scope).isAllowed() {
+		metricRateLimited.inc(scope.name)
+		sendJSON(cli.conn, map[string]interface{}{
+			"type": "error",
+			"msg":  fmt.Sprintf("You are using /%s too fast. Please slow down.", scope.name),
+		})
+		return
+	}
+
+	message, ok = filterChatMessage(cli, message)
+	if !ok {
+		return
+	}
+
+	response := struct {
+		Action   string `json:"action"`
+		Username string `json:"username"`
+		Message  string `json:"message"`
+		X        int    `json:"x"`
+		Y        int    `json:"y"`
+	}{
+		Action:   scope.name,
+		Username: cli.username,
+		Message:  message,
+		X:        cli.x,
+		Y:        cli.y,
+	}
+
+	events.publish("chat."+scope.name, chatEvent{Username: cli.username, Message: message, X: cli.x, Y: cli.y})
+
+	defer observeBroadcast(scope.name, time.Now())
+	minX, minY, maxX, maxY := scopeBounds(scope.name, cli.x, cli.y)
+	for _, other := range clientsInRect(minX, minY, maxX, maxY) {
+		if other.username != cli.username {
+			sendJSON(other.conn, response)
+		}
+	}
+}
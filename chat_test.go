@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// newPipeClient registers an in-memory client at the given cell and returns
+// a channel that receives every line the server writes to it.
+func newPipeClient(t *testing.T, username string, x, y int) (*client, chan string) {
+	serverSide, clientSide := net.Pipe()
+	cli := &client{
+		conn:               serverSide,
+		username:           username,
+		x:                  x,
+		y:                  y,
+		commandRateLimiter: newRateLimiter(5, time.Second),
+		mutedUsernames:     make(map[string]bool),
+	}
+	clients.Store(username, cli)
+	addToGrid(cli)
+
+	lines := make(chan string, 64)
+	go func() {
+		reader := bufio.NewReader(clientSide)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	t.Cleanup(func() {
+		removeFromGrid(cli)
+		clients.Delete(username)
+		serverSide.Close()
+		clientSide.Close()
+	})
+	return cli, lines
+}
+
+// expectAction waits for the next message carrying the given action.
+func expectAction(t *testing.T, lines chan string, action string) map[string]interface{} {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("Connection closed while waiting for %q", action)
+			}
+			var msg map[string]interface{}
+			if json.Unmarshal([]byte(line), &msg) == nil && msg["action"] == action {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %q", action)
+		}
+	}
+}
+
+// expectSilence fails if any message arrives within a short window.
+func expectSilence(t *testing.T, lines chan string) {
+	select {
+	case line := <-lines:
+		t.Fatalf("Unexpected message: %s", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestScopedChat(t *testing.T) {
+	initGrid()
+
+	speaker, _ := newPipeClient(t, "speaker", 2, 2)
+	_, sameCell := newPipeClient(t, "sameCell", 2, 2)
+	_, nearby := newPipeClient(t, "nearby", 5, 4)
+	_, sameZone := newPipeClient(t, "sameZone", 9, 9)
+	_, farAway := newPipeClient(t, "farAway", 20, 20)
+
+	scopedChat(speaker, "local", "hi there")
+	if msg := expectAction(t, sameCell, "local"); msg["message"] != "hi there" || msg["username"] != "speaker" {
+		t.Fatalf("Unexpected local message: %+v", msg)
+	}
+	expectSilence(t, nearby)
+
+	scopedChat(speaker, "shout", "over here")
+	expectAction(t, sameCell, "shout")
+	expectAction(t, nearby, "shout")
+	expectSilence(t, sameZone)
+
+	scopedChat(speaker, "zone", "zone wide")
+	expectAction(t, sameCell, "zone")
+	expectAction(t, nearby, "zone")
+	expectAction(t, sameZone, "zone")
+	expectSilence(t, farAway)
+}
+
+func TestScopedChatRateLimit(t *testing.T) {
+	initGrid()
+
+	speaker, speakerLines := newPipeClient(t, "speaker", 0, 0)
+	_, listener := newPipeClient(t, "listener", 0, 0)
+
+	for i := 0; i < chatScopes["shout"].maxTokens; i++ {
+		scopedChat(speaker, "shout", "again")
+		expectAction(t, listener, "shout")
+	}
+
+	scopedChat(speaker, "shout", "one too many")
+	expectSilence(t, listener)
+	<-speakerLines
+
+	// Other scopes have their own budget
+	scopedChat(speaker, "local", "still allowed")
+	expectAction(t, listener, "local")
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// How long to wait for a peer server's API before giving up on it
+const peerRequestTimeout = 3 * time.Second
+
+// peers holds the other servers of the cluster by name.
+var peers sync.Map
+
+// presence maps usernames of players online on other servers to that server's name.
+var presence sync.Map
+
+var peerHTTPClient = &http.Client{Timeout: peerRequestTimeout}
+
+// peerServer is a server of the cluster. Peers are never changed in place: an
+// update stores a new copy, so they can be read without a lock.
+type peerServer struct {
+	Name     string    `json:"name"`
+	APIURL   string    `json:"api_url"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+}
+
+type presenceUpdate struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Online   bool   `json:"online"`
+}
+
+type presenceInfo struct {
+	Username string `json:"username"`
+	Online   bool   `json:"online"`
+	Server   string `json:"server,omitempty"`
+}
+
+type whisperReceipt struct {
+	Delivered bool   `json:"delivered"`
+	To        string `json:"to"`
+	Server    string `json:"server,omitempty"`
+	Status    string `json:"status"`
+}
+
+// loadPeers parses a comma separated list of name=api_url pairs, as found in PEER_SERVERS.
+func loadPeers(value string) {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			serverLog.warn("ignoring invalid peer server entry", "entry", entry)
+			continue
+		}
+		registerPeer(parts[0], parts[1])
+	}
+}
+
+func registerPeer(name, apiURL string) *peerServer {
+	peer := &peerServer{
+		Name:     name,
+		APIURL:   strings.TrimRight(apiURL, "/"),
+		LastSeen: time.Now(),
+	}
+	peers.Store(name, peer)
+	return peer
+}
+
+// peerToken signs a short lived API token identifying this server to its peers.
+func peerToken() (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":   serverName,
+		"roles": []string{RoleServer},
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	})
+	return token.SignedString([]byte(apijwtSecret))
+}
+
+// postToPeer sends a JSON payload to one of the peer's API endpoints.
+func postToPeer(peer *peerServer, path string, payload interface{}) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", peer.APIURL+path, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := peerToken()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("RPG_AUTH", token)
+
+	return peerHTTPClient.Do(req)
+}
+
+// announcePresence tells every peer that a local user came online or went offline.
+func announcePresence(username string, online bool) {
+	update := presenceUpdate{
+		Server:   serverName,
+		Username: username,
+		Online:   online,
+	}
+
+	peers.Range(func(_, v interface{}) bool {
+		peer := v.(*peerServer)
+		go func() {
+			resp, err := postToPeer(peer, "/api/presence", update)
+			if err != nil {
+				serverLog.warn("failed to send presence", "peer", peer.Name, "err", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return true
+	})
+}
+
+// forwardWhisper delivers a whisper to a user on another server. The server
+// known from the presence index is tried first, then every other peer.
+func forwardWhisper(from, to, message string) whisperReceipt {
+	payload := sendMessagePayload{
+		FromUsername: from,
+		ToUsername:   to,
+		FromServer:   serverName,
+		Message:      message,
+	}
+
+	candidates := []*peerServer{}
+	if name, ok := presence.Load(to); ok {
+		if v, ok := peers.Load(name); ok {
+			candidates = append(candidates, v.(*peerServer))
+		}
+	}
+	peers.Range(func(_, v interface{}) bool {
+		peer := v.(*peerServer)
+		if len(candidates) == 0 || candidates[0].Name != peer.Name {
+			candidates = append(candidates, peer)
+		}
+		return true
+	})
+
+	for _, peer := range candidates {
+		resp, err := postToPeer(peer, "/api/sendMessageToUser", payload)
+		if err != nil {
+			serverLog.warn("failed to forward whisper", "peer", peer.Name, "err", err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			presence.Store(to, peer.Name)
+			return whisperReceipt{Delivered: true, To: to, Server: peer.Name, Status: "delivered"}
+		}
+
+		// The presence entry was stale
+		if name, ok := presence.Load(to); ok && name == peer.Name {
+			presence.Delete(to)
+		}
+	}
+
+	return whisperReceipt{Delivered: false, To: to, Status: "offline"}
+}
+
+// deliverLocalWhisper sends a whisper to a user connected to this server.
+// Whispers forwarded by a peer look the same as whispers sent here.
+func deliverLocalWhisper(payload sendMessagePayload) bool {
+	toClient, ok := clients.Load(payload.ToUsername)
+	if !ok {
+		return false
+	}
+
+	// Messages sent through the API come from this server
+	fromServer := payload.FromServer
+	if fromServer == "" {
+		fromServer = serverName
+	}
+	sendJSON(toClient.(*client).conn, whisperMessage(payload.FromUsername, fromServer, payload.Message))
+	return true
+}
+
+// whisperMessage is the message a player receives for a whisper from a player
+// on the given server.
+func whisperMessage(from, fromServer, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "whisper",
+		"from":    from,
+		"server":  fromServer,
+		"message": message,
+	}
+}
+
+// presenceLookupHandler reports where a user is online.
+func presenceLookupHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+
+	errs := fieldErrors{}
+	errs.required("username", username)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	info := presenceInfo{Username: username}
+	if _, ok := clients.Load(username); ok {
+		info.Online = true
+		info.Server = serverName
+	} else if name, ok := presence.Load(username); ok {
+		info.Online = true
+		info.Server = name.(string)
+	}
+	writeAPIData(w, http.StatusOK, info)
+}
+
+// presenceUpdateHandler records a peer's user coming online or going offline.
+func presenceUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var update presenceUpdate
+	if !decodeAPIRequest(w, r, &update) {
+		return
+	}
+
+	errs := fieldErrors{}
+	errs.required("server", update.Server)
+	errs.required("username", update.Username)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	if v, ok := peers.Load(update.Server); ok {
+		seen := *v.(*peerServer)
+		seen.LastSeen = time.Now()
+		peers.Store(seen.Name, &seen)
+	}
+
+	if update.Online {
+		presence.Store(update.Username, update.Server)
+	} else if name, ok := presence.Load(update.Username); ok && name == update.Server {
+		presence.Delete(update.Username)
+	}
+
+	writeAPIData(w, http.StatusOK, update)
+}
+
+func registerServerHandler(w http.ResponseWriter, r *http.Request) {
+	var req peerServer
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	errs.required("name", req.Name)
+	errs.required("api_url", req.APIURL)
+	if req.APIURL != "" && !strings.HasPrefix(req.APIURL, "http://") && !strings.HasPrefix(req.APIURL, "https://") {
+		errs.add("api_url", "must be an http or https URL")
+	}
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	if req.Name == serverName {
+		writeAPIError(w, http.StatusConflict, ErrConflict, "A server cannot register itself")
+		return
+	}
+
+	peer := registerPeer(req.Name, req.APIURL)
+
+	writeAPIData(w, http.StatusOK, peer)
+}
+
+func listServersHandler(w http.ResponseWriter, r *http.Request) {
+	list := []*peerServer{}
+	peers.Range(func(_, v interface{}) bool {
+		list = append(list, v.(*peerServer))
+		return true
+	})
+
+	writeAPIData(w, http.StatusOK, list)
+}
+
+// registerWithPeers announces this server's API address to every known peer.
+func registerWithPeers() {
+	apiURL := currentConfig().ServerAPIURL
+	if apiURL == "" {
+		return
+	}
+
+	self := peerServer{Name: serverName, APIURL: apiURL}
+	peers.Range(func(_, v interface{}) bool {
+		peer := v.(*peerServer)
+		go func() {
+			resp, err := postToPeer(peer, "/api/registerServer", self)
+			if err != nil {
+				serverLog.warn("failed to register with peer", "peer", peer.Name, "err", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return true
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// newFakePeer starts an API server that only knows the given usernames.
+func newFakePeer(t *testing.T, name string, usernames ...string) *httptest.Server {
+	online := make(map[string]bool)
+	for _, u := range usernames {
+		online[u] = true
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := jwt.Parse(r.Header.Get("RPG_AUTH"), func(token *jwt.Token) (interface{}, error) {
+			return []byte(apijwtSecret), nil
+		})
+		if err != nil || !token.Valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var payload sendMessagePayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		if r.URL.Path != "/api/sendMessageToUser" || !online[payload.ToUsername] || payload.FromServer != serverName {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	registerPeer(name, server.URL)
+	t.Cleanup(func() {
+		peers.Delete(name)
+		server.Close()
+	})
+	return server
+}
+
+func TestForwardWhisperToPeer(t *testing.T) {
+	newFakePeer(t, "shardA")
+	newFakePeer(t, "shardB", "farPlayer")
+	defer presence.Delete("farPlayer")
+
+	receipt := forwardWhisper("localPlayer", "farPlayer", "hello from afar")
+	if !receipt.Delivered || receipt.Server != "shardB" {
+		t.Fatalf("Expected delivery through shardB, got %+v", receipt)
+	}
+
+	if name, ok := presence.Load("farPlayer"); !ok || name != "shardB" {
+		t.Fatalf("Expected the presence index to remember shardB, got %v", name)
+	}
+
+	receipt = forwardWhisper("localPlayer", "nobody", "is anyone there?")
+	if receipt.Delivered || receipt.Status != "offline" {
+		t.Fatalf("Expected an offline receipt, got %+v", receipt)
+	}
+}
+
+// expectReceipt waits for the next whisper receipt sent to a player.
+func expectReceipt(t *testing.T, lines chan string) map[string]interface{} {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			var msg map[string]interface{}
+			if json.Unmarshal([]byte(line), &msg) == nil && msg["type"] == "whisper_receipt" {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for a whisper receipt")
+		}
+	}
+}
+
+func TestWhisperAcrossServers(t *testing.T) {
+	initGrid()
+	newFakePeer(t, "shardB", "farPlayer")
+	defer presence.Delete("farPlayer")
+	sender, senderLines := newPipeClient(t, "sender", 0, 0)
+	_, nearLines := newPipeClient(t, "nearPlayer", 0, 0)
+
+	whisper(sender, "farPlayer", "hello from afar")
+	if receipt := expectReceipt(t, senderLines); receipt["delivered"] != true || receipt["server"] != "shardB" {
+		t.Fatalf("Expected delivery through shardB, got %+v", receipt)
+	}
+
+	// Whispers from peers arrive like local ones
+	whisper(sender, "nearPlayer", "hi")
+	local := map[string]interface{}{}
+	json.Unmarshal([]byte(<-nearLines), &local)
+	deliverLocalWhisper(sendMessagePayload{FromUsername: "farPlayer", ToUsername: "nearPlayer", FromServer: "shardB", Message: "hi back"})
+	forwarded := map[string]interface{}{}
+	json.Unmarshal([]byte(<-nearLines), &forwarded)
+	if local["type"] != "whisper" || forwarded["type"] != "whisper" || forwarded["from"] != "farPlayer" || forwarded["server"] != "shardB" || local["server"] != serverName {
+		t.Fatalf("Expected one whisper shape, got %+v and %+v", local, forwarded)
+	}
+
+	// So do messages sent through the API
+	deliverLocalWhisper(sendMessagePayload{FromUsername: "admin", ToUsername: "nearPlayer", Message: "server restart"})
+	fromAPI := map[string]interface{}{}
+	json.Unmarshal([]byte(<-nearLines), &fromAPI)
+	if fromAPI["type"] != "whisper" || fromAPI["from"] != "admin" || fromAPI["server"] != serverName || fromAPI["message"] != "server restart" {
+		t.Fatalf("Expected an API message to arrive as a whisper, got %+v", fromAPI)
+	}
+}
+
+func TestPresenceHandler(t *testing.T) {
+	defer presence.Delete("wanderer")
+
+	update := `{"server": "shardC", "username": "wanderer", "online": true}`
+	req := httptest.NewRequest("POST", "/api/presence", strings.NewReader(update))
+	req.Header.Set("RPG_AUTH", createTestJWT())
+	w := httptest.NewRecorder()
+	presenceUpdateHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/presence?username=wanderer", nil)
+	req.Header.Set("RPG_AUTH", createTestJWT())
+	w = httptest.NewRecorder()
+	presenceLookupHandler(w, req)
+
+	var info presenceInfo
+	if err := json.NewDecoder(w.Body).Decode(&apiResponse{Data: &info}); err != nil {
+		t.Fatalf("Failed to parse presence response: %v", err)
+	}
+	if !info.Online || info.Server != "shardC" {
+		t.Fatalf("Unexpected presence response: %+v", info)
+	}
+
+	// Going offline on a different server must not clear the entry
+	update = `{"server": "shardD", "username": "wanderer", "online": false}`
+	req = httptest.NewRequest("POST", "/api/presence", strings.NewReader(update))
+	req.Header.Set("RPG_AUTH", createTestJWT())
+	presenceUpdateHandler(httptest.NewRecorder(), req)
+
+	if name, ok := presence.Load("wanderer"); !ok || name != "shardC" {
+		t.Fatalf("Presence entry was cleared by the wrong server")
+	}
+}
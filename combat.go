@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Component of an entity holding its combat stats
+const statsComponent = "stats"
+
+// Players within this many cells of a fight are sent its events
+const combatRadius = 10
+
+// Stats of players who never fought
+var defaultPlayerStats = combatStats{HP: 100, MaxHP: 100, Attack: 10, Defense: 5}
+
+var combat = newCombatEngine()
+
+var (
+	errNoTarget      = errors.New("There is nothing to attack next to you")
+	errNotAttackable = errors.New("It cannot be attacked")
+	errCoolingDown   = errors.New("You are not ready to attack again")
+)
+
+// combatStats are the hit points and strength of a player or entity.
+type combatStats struct {
+	HP      int `json:"hp"`
+	MaxHP   int `json:"max_hp"`
+	Attack  int `json:"attack"`
+	Defense int `json:"defense"`
+}
+
+// combatant is a player or an entity taking part in a fight.
+type combatant struct {
+	cli *client
+	ent *entity
+}
+
+// combatEvent is the event of an attack, a death or a respawn.
+type combatEvent struct {
+	Attacker *EntityInfo  `json:"attacker,omitempty"`
+	Target   EntityInfo   `json:"target"`
+	Damage   int          `json:"damage,omitempty"`
+	Stats    *combatStats `json:"stats,omitempty"`
+}
+
+// pendingRespawn is an NPC waiting to come back.
+type pendingRespawn struct {
+	ent   *entity
+	x, y  int
+	ticks int
+}
+
+// combatEngine resolves attacks and counts down cooldowns and respawns on
+// every tick of the game.
+type combatEngine struct {
+	mu sync.Mutex
+	// Ticks before a player or entity can attack again, by entity ID
+	cooldowns map[string]int
+	respawns  []*pendingRespawn
+	// Players NPCs strike back at, by NPC ID
+	retaliation map[string]string
+}
+
+func newCombatEngine() *combatEngine {
+	return &combatEngine{
+		cooldowns:   make(map[string]int),
+		retaliation: make(map[string]string),
+	}
+}
+
+func (s *combatStats) validate(errs fieldErrors, field string) {
+	if s.MaxHP < 1 {
+		errs.add(field+".max_hp", "must be positive")
+	}
+	if s.HP < 0 || s.HP > s.MaxHP {
+		errs.add(field+".hp", "must be between 0 and max_hp")
+	}
+	if s.Attack < 0 || s.Defense < 0 {
+		errs.add(field, "attack and defense must not be negative")
+	}
+}
+
+// ticksOf converts a duration to a number of game ticks, at least one.
+func ticksOf(d configDuration) int {
+	interval := currentConfig().NPCTickInterval
+	ticks := int((d + interval - 1) / interval)
+	if ticks < 1 {
+		return 1
+	}
+	return ticks
+}
+
+// entityStats returns the stats of an entity. Stats given as plain JSON, such as
+// by the admin API, are converted on first use.
+func entityStats(e *entity) (combatStats, bool) {
+	c, ok := e.component(statsComponent)
+	if !ok {
+		return combatStats{}, false
+	}
+	switch stats := c.(type) {
+	case combatStats:
+		return stats, true
+	case map[string]interface{}:
+		var converted combatStats
+		encoded, _ := json.Marshal(stats)
+		if err := json.Unmarshal(encoded, &converted); err != nil || converted.MaxHP < 1 {
+			return combatStats{}, false
+		}
+		if converted.HP == 0 {
+			converted.HP = converted.MaxHP
+		}
+		e.setComponent(statsComponent, converted)
+		return converted, true
+	}
+	return combatStats{}, false
+}
+
+// playerStats returns the stats of a player.
+func playerStats(username string) combatStats {
+	if stats := playerData.get(username).Stats; stats != nil {
+		return *stats
+	}
+	return defaultPlayerStats
+}
+
+func (c combatant) info() EntityInfo {
+	if c.cli != nil {
+		gridMutex.RLock()
+		defer gridMutex.RUnlock()
+		return playerEntityInfo(c.cli)
+	}
+	info := c.ent.info()
+	info.Components = nil
+	return info
+}
+
+func (c combatant) stats() (combatStats, bool) {
+	if c.cli != nil {
+		return playerStats(c.cli.username), true
+	}
+	return entityStats(c.ent)
+}
+
+func (c combatant) setStats(stats combatStats) error {
+	if c.cli != nil {
+		return playerData.update([]string{c.cli.username}, func(records map[string]*playerRecord) error {
+			records[c.cli.username].Stats = &stats
+			return nil
+		})
+	}
+	c.ent.setComponent(statsComponent, stats)
+	return nil
+}
+
+// adjacent reports whether two cells are the same or next to each other, diagonals included.
+func adjacent(a, b EntityInfo) bool {
+	return abs(a.X-b.X) <= 1 && abs(a.Y-b.Y) <= 1
+}
+
+// findTarget finds what a player attacks: the entity next to them with the
+// given ID or name, or the first that can be attacked when name is empty.
+func findTarget(cli *client, name string) (*entity, error) {
+	gridMutex.RLock()
+	x, y := cli.x, cli.y
+	gridMutex.RUnlock()
+
+	found := entitiesInRect(x-1, y-1, x+1, y+1)
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	for _, e := range found {
+		if name == "" {
+			if _, ok := entityStats(e); ok {
+				return e, nil
+			}
+		} else if e.ID == name || strings.EqualFold(e.Name, name) {
+			return e, nil
+		}
+	}
+	return nil, errNoTarget
+}
+
+// broadcastCombat sends a combat message to the players near a cell.
+func broadcastCombat(x, y int, message interface{}) {
+	defer observeBroadcast("combat", time.Now())
+
+	for _, cli := range clientsInRect(x-combatRadius, y-combatRadius, x+combatRadius, y+combatRadius) {
+		sendJSON(cli.conn, message)
+	}
+}
+
+// attack resolves an attack: the target loses the attacker's attack less its
+// defense in hit points, at least one, and dies when it has none left.
+func (ce *combatEngine) attack(attacker, target combatant) (combatEvent, error) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+
+	return ce.attackLocked(attacker, target)
+}
+
+// attackLocked resolves an attack. Callers must hold ce.mu.
+func (ce *combatEngine) attackLocked(attacker, target combatant) (combatEvent, error) {
+	from, to := attacker.info(), target.info()
+	if ce.cooldowns[from.ID] > 0 {
+		return combatEvent{}, errCoolingDown
+	}
+	if !adjacent(from, to) {
+		return combatEvent{}, errNoTarget
+	}
+	// An entity removed since the target was picked is no longer there to hit
+	if target.ent != nil {
+		if v, ok := entities.Load(target.ent.ID); !ok || v.(*entity) != target.ent {
+			return combatEvent{}, errNoTarget
+		}
+	}
+	attackerStats, ok := attacker.stats()
+	if !ok {
+		return combatEvent{}, errNotAttackable
+	}
+	targetStats, ok := target.stats()
+	if !ok || targetStats.HP <= 0 {
+		return combatEvent{}, errNotAttackable
+	}
+
+	damage := attackerStats.Attack - targetStats.Defense
+	if damage < 1 {
+		damage = 1
+	}
+	targetStats.HP -= damage
+	if targetStats.HP < 0 {
+		targetStats.HP = 0
+	}
+	if err := target.setStats(targetStats); err != nil {
+		return combatEvent{}, err
+	}
+	ce.cooldowns[from.ID] = ticksOf(currentConfig().AttackCooldown)
+	if target.ent != nil && attacker.cli != nil {
+		ce.retaliation[to.ID] = attacker.cli.username
+	}
+
+	event := combatEvent{Attacker: &from, Target: to, Damage: damage, Stats: &targetStats}
+	broadcastCombat(to.X, to.Y, map[string]interface{}{
+		"action":   "attack",
+		"attacker": from,
+		"target":   to,
+		"damage":   damage,
+		"hp":       targetStats.HP,
+		"max_hp":   targetStats.MaxHP,
+	})
+	events.publish(EventCombatAttack, event)
+
+	if targetStats.HP == 0 {
+		ce.killLocked(from, target, targetStats)
+	}
+	return event, nil
+}
+
+// killLocked handles a death. Players come back at the spawn point straight
+// away with full hit points, NPCs where they started after the respawn delay,
+// and other entities are gone. Callers must hold ce.mu.
+func (ce *combatEngine) killLocked(killer EntityInfo, target combatant, stats combatStats) {
+	dead := target.info()
+	serverLog.info("killed", "id", dead.ID, "killer", killer.ID)
+	broadcastCombat(dead.X, dead.Y, map[string]interface{}{
+		"action": "death",
+		"target": dead,
+		"killer": killer,
+	})
+	events.publish(EventCombatDeath, combatEvent{Attacker: &killer, Target: dead})
+
+	delete(ce.cooldowns, dead.ID)
+	delete(ce.retaliation, dead.ID)
+
+	stats.HP = stats.MaxHP
+	if target.cli != nil {
+		for npc, username := range ce.retaliation {
+			if username == target.cli.username {
+				delete(ce.retaliation, npc)
+			}
+		}
+		if err := target.setStats(stats); err != nil {
+			target.cli.log.error("failed to restore hit points", "err", err)
+		}
+		x, y := spawnCell()
+		if err := teleportClient(target.cli, x, y, true); err != nil {
+			target.cli.log.warn("failed to respawn", "err", err)
+		}
+		ce.respawned(target)
+		return
+	}
+
+	x, y := dead.X, dead.Y
+	if home, ok := npcs.home(target.ent.ID); ok {
+		x, y = home.X, home.Y
+	}
+	// Someone else already removed it, and a respawn would bring back a ghost
+	if _, err := removeEntity(target.ent.ID); err != nil || target.ent.Kind != EntityNPC {
+		return
+	}
+	target.setStats(stats)
+	ce.respawns = append(ce.respawns, &pendingRespawn{ent: target.ent, x: x, y: y, ticks: ticksOf(currentConfig().RespawnDelay)})
+}
+
+func (ce *combatEngine) respawned(c combatant) {
+	info := c.info()
+	stats, _ := c.stats()
+	broadcastCombat(info.X, info.Y, map[string]interface{}{
+		"action": "respawn",
+		"target": info,
+		"hp":     stats.HP,
+		"max_hp": stats.MaxHP,
+	})
+	events.publish(EventCombatRespawn, combatEvent{Target: info, Stats: &stats})
+}
+
+// forget drops the cooldowns and pending respawns of entities taken away for good.
+func (ce *combatEngine) forget(ids []string) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+
+	gone := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		gone[id] = true
+		delete(ce.cooldowns, id)
+		delete(ce.retaliation, id)
+	}
+	waiting := ce.respawns[:0]
+	for _, r := range ce.respawns {
+		if !gone[r.ent.ID] {
+			waiting = append(waiting, r)
+		}
+	}
+	ce.respawns = waiting
+}
+
+// tick counts down the cooldowns and respawns, and lets NPCs strike back at
+// the players who attacked them.
+func (ce *combatEngine) tick() {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+
+	for id := range ce.cooldowns {
+		ce.cooldowns[id]--
+		if ce.cooldowns[id] <= 0 {
+			delete(ce.cooldowns, id)
+		}
+	}
+
+	waiting := ce.respawns[:0]
+	for _, r := range ce.respawns {
+		r.ticks--
+		if r.ticks > 0 {
+			waiting = append(waiting, r)
+			continue
+		}
+		if err := spawnEntity(r.ent, r.x, r.y); err != nil {
+			serverLog.warn("failed to respawn", "id", r.ent.ID, "err", err)
+			continue
+		}
+		ce.respawned(combatant{ent: r.ent})
+	}
+	ce.respawns = waiting
+
+	for id, username := range ce.retaliation {
+		v, ok := entities.Load(id)
+		p, online := clients.Load(username)
+		if !ok || !online {
+			delete(ce.retaliation, id)
+			continue
+		}
+		npc := combatant{ent: v.(*entity)}
+		if stats, ok := npc.stats(); !ok || stats.Attack == 0 {
+			continue
+		}
+		// Fails while the NPC cools down or the player is out of reach
+		_, err := ce.attackLocked(npc, combatant{cli: p.(*client)})
+		if err != nil && err != errCoolingDown && err != errNoTarget && err != errNotAttackable {
+			serverLog.error("failed to strike back", "id", id, "target", username, "err", err)
+		}
+	}
+}
+
+// attackCommand runs /attack.
+func attackCommand(cli *client, args []string) {
+	if len(args) > 1 {
+		cli.conn.Write([]byte("Usage: /attack [target]\n"))
+		return
+	}
+	name := ""
+	if len(args) == 1 {
+		name = args[0]
+	}
+
+	var reply string
+	target, err := findTarget(cli, name)
+	if err == nil {
+		var event combatEvent
+		event, err = combat.attack(combatant{cli: cli}, combatant{ent: target})
+		if err == nil {
+			reply = fmt.Sprintf("You hit %s for %d damage.\n", target.Name, event.Damage)
+			if event.Stats.HP == 0 {
+				reply += fmt.Sprintf("You defeated %s.\n", target.Name)
+			}
+		}
+	}
+	if err != nil {
+		reply = fmt.Sprintf("Error: %v\n", err)
+	}
+	cli.conn.Write([]byte(reply))
+}
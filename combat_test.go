@@ -0,0 +1,131 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCombat(t *testing.T) {
+	initGrid()
+	clearEntities(t)
+	isolateItems(t)
+	previousCombat, previousSpawn := combat, spawn
+	combat = newCombatEngine()
+	spawn = newSpawnStore(filepath.Join(t.TempDir(), "spawn.json"))
+	defer func() { combat, spawn = previousCombat, previousSpawn }()
+
+	hero, heroLines := newPipeClient(t, "hero", 5, 5)
+	hero.commandRateLimiter = newRateLimiter(100, time.Second)
+	_, watcher := newPipeClient(t, "watcher", 5, 12)
+	_, farAway := newPipeClient(t, "farAway", 20, 20)
+
+	rat := newEntity(EntityNPC, "rat")
+	rat.setComponent(statsComponent, combatStats{HP: 12, MaxHP: 12, Attack: 20, Defense: 2})
+	if err := spawnEntity(rat, 6, 5); err != nil {
+		t.Fatalf("Failed to spawn rat: %v", err)
+	}
+
+	handleCommand(hero, "/attack rat\n")
+	expectLine(t, heroLines, "You hit rat for 8 damage.")
+	if msg := expectAction(t, watcher, "attack"); msg["hp"] != float64(4) || msg["target"].(map[string]interface{})["id"] != rat.ID {
+		t.Fatalf("Expected players in range to see the attack, got %+v", msg)
+	}
+	handleCommand(hero, "/attack rat\n")
+	expectLine(t, heroLines, "Error: You are not ready to attack again")
+
+	// Cooldowns run out with the ticks, while the rat strikes back
+	combat.tick()
+	if stats := playerStats("hero"); stats.HP != 85 {
+		t.Fatalf("Expected the rat to hit back, got %+v", stats)
+	}
+	combat.tick()
+	handleCommand(hero, "/attack\n")
+	expectLine(t, heroLines, "You defeated rat.")
+	expectAction(t, watcher, "death")
+	if _, ok := entities.Load(rat.ID); ok {
+		t.Fatalf("Expected the rat to be taken off the map")
+	}
+
+	// Killed NPCs come back after the respawn delay
+	for i := 0; i < ticksOf(currentConfig().RespawnDelay); i++ {
+		combat.tick()
+	}
+	if msg := expectAction(t, watcher, "respawn"); msg["hp"] != float64(12) {
+		t.Fatalf("Expected the rat to come back with full health, got %+v", msg)
+	}
+	if x, y := rat.position(); x != 6 || y != 5 {
+		t.Fatalf("Expected the rat back where it died, got (%d, %d)", x, y)
+	}
+
+	// Players who die come back at the spawn point
+	playerData.update([]string{"hero"}, func(records map[string]*playerRecord) error {
+		records["hero"].Stats = &combatStats{HP: 1, MaxHP: 100, Attack: 10, Defense: 5}
+		return nil
+	})
+	handleCommand(hero, "/attack rat\n")
+	combat.tick()
+	expectAction(t, watcher, "death")
+	if hero.x != 0 || hero.y != 0 || playerStats("hero").HP != 100 {
+		t.Fatalf("Expected the hero to respawn with full health, got (%d, %d) %+v", hero.x, hero.y, playerStats("hero"))
+	}
+
+	// Hits that cannot be saved do not count
+	if err := teleportClient(hero, 5, 5, true); err != nil {
+		t.Fatalf("Failed to move the hero back: %v", err)
+	}
+	combat = newCombatEngine()
+	playerData.filename = filepath.Join(t.TempDir(), "missing", "players.json")
+	if _, err := combat.attack(combatant{ent: rat}, combatant{cli: hero}); err == nil || err == errNoTarget || err == errCoolingDown {
+		t.Fatalf("Expected an attack that cannot be saved to fail, got %v", err)
+	}
+	if stats := playerStats("hero"); stats.HP != 100 {
+		t.Fatalf("Expected the hero's hit points to be unchanged, got %+v", stats)
+	}
+
+	for {
+		select {
+		case line := <-farAway:
+			if strings.Contains(line, `"action":"attack"`) {
+				t.Fatalf("Expected players out of range not to see the fight, got %s", line)
+			}
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+}
+
+func TestCombatIgnoresRemovedEntities(t *testing.T) {
+	initGrid()
+	clearEntities(t)
+	isolateItems(t)
+	previousCombat, previousSpawn := combat, spawn
+	combat = newCombatEngine()
+	spawn = newSpawnStore(filepath.Join(t.TempDir(), "spawn.json"))
+	defer func() { combat, spawn = previousCombat, previousSpawn }()
+
+	hero, _ := newPipeClient(t, "hero", 5, 5)
+	rat := newEntity(EntityNPC, "rat")
+	rat.setComponent(statsComponent, combatStats{HP: 1, MaxHP: 12, Attack: 1, Defense: 0})
+	if err := spawnEntity(rat, 6, 5); err != nil {
+		t.Fatalf("Failed to spawn rat: %v", err)
+	}
+	if _, err := removeEntity(rat.ID); err != nil {
+		t.Fatalf("Failed to remove rat: %v", err)
+	}
+
+	if _, err := combat.attack(combatant{cli: hero}, combatant{ent: rat}); err != errNoTarget {
+		t.Fatalf("Expected a removed rat not to be hit, got %v", err)
+	}
+
+	// A death racing a removal does not bring the entity back
+	combat.mu.Lock()
+	combat.killLocked(playerEntityInfo(hero), combatant{ent: rat}, combatStats{MaxHP: 12})
+	respawns := len(combat.respawns)
+	combat.mu.Unlock()
+	if respawns != 0 {
+		t.Fatalf("Expected no respawn for a rat that was already removed, got %d", respawns)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Config file read when neither -config nor CONFIG_FILE name one
+const defaultConfigFilename = "config.json"
+
+// Secrets used when none are configured. They are public, so a warning is logged.
+const (
+	defaultAPISecret    = "your_jwt_secret2"
+	defaultServerSecret = "your_jwt_secret1"
+)
+
+// config is the configuration the server is running with. It is replaced
+// as a whole on reload, so read it through currentConfig.
+var (
+	configMu sync.RWMutex
+	config   = defaultConfig()
+)
+
+// Config holds every setting of the server. Values are layered: defaults,
+// then the JSON config file, then environment variables (including .env),
+// then command line flags.
+type Config struct {
+	ServerName   string `json:"server_name"`
+	GameAddr     string `json:"game_addr"`
+	APIAddr      string `json:"api_addr"`
+	ServerAPIURL string `json:"server_api_url"`
+	// Comma separated name=api_url pairs of the other servers of the cluster
+	PeerServers string `json:"peer_servers"`
+
+	// Unix socket of the operator console, disabled when empty
+	ConsoleSocket string `json:"console_socket"`
+	// Run the operator console on stdin as well
+	Console bool `json:"console"`
+
+	APISecret    string `json:"api_secret"`
+	ServerSecret string `json:"server_secret"`
+
+	MapFile    string `json:"map_file"`
+	GridWidth  int    `json:"grid_width"`
+	GridHeight int    `json:"grid_height"`
+
+	SleepDelay        configDuration `json:"sleep_delay"`
+	CommandRateLimit  int            `json:"command_rate_limit"`
+	CommandRatePeriod configDuration `json:"command_rate_period"`
+	// Limits of /local, /shout and /zone, by scope
+	ChatRateLimits map[string]rateLimitSetting `json:"chat_rate_limits"`
+
+	ChatWordList        string         `json:"chat_word_list"`
+	ChatMaxLength       int            `json:"chat_max_length"`
+	ChatBlockLinks      bool           `json:"chat_block_links"`
+	ChatSpamRepeatLimit int            `json:"chat_spam_repeat_limit"`
+	ChatSpamWindow      configDuration `json:"chat_spam_window"`
+
+	// Message of the day sent to players when they join
+	MOTD string `json:"motd"`
+	// Cell types players and pathfinding may move onto
+	WalkableCells []CellType `json:"walkable_cells"`
+
+	// File the NPCs are loaded from
+	NPCFile         string         `json:"npc_file"`
+	NPCTickInterval configDuration `json:"npc_tick_interval"`
+
+	// File the item definitions are loaded from
+	ItemFile       string `json:"item_file"`
+	InventorySlots int    `json:"inventory_slots"`
+
+	// Time between attacks and before killed NPCs come back
+	AttackCooldown configDuration `json:"attack_cooldown"`
+	RespawnDelay   configDuration `json:"respawn_delay"`
+
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+}
+
+// rateLimitSetting allows Limit actions in a burst, regaining one every Period.
+type rateLimitSetting struct {
+	Limit  int            `json:"limit"`
+	Period configDuration `json:"period"`
+}
+
+// configDuration is a time.Duration written as a string such as "3s" in config files.
+type configDuration time.Duration
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *configDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"3s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(parsed)
+	return nil
+}
+
+func defaultConfig() Config {
+	chatRateLimits := make(map[string]rateLimitSetting)
+	for name, scope := range chatScopes {
+		chatRateLimits[name] = rateLimitSetting{Limit: scope.maxTokens, Period: configDuration(scope.fillRate)}
+	}
+
+	cfg := Config{
+		ServerName:        "TestServer1",
+		GameAddr:          ":6000",
+		APIAddr:           ":5000",
+		APISecret:         defaultAPISecret,
+		ServerSecret:      defaultServerSecret,
+		MapFile:           "map.json",
+		GridWidth:         25,
+		GridHeight:        25,
+		SleepDelay:        configDuration(3 * time.Second),
+		CommandRateLimit:  5,
+		CommandRatePeriod: configDuration(time.Second),
+		ChatRateLimits:    chatRateLimits,
+		LogLevel:          LevelInfo.String(),
+		LogFormat:         LogFormatLogfmt,
+		WalkableCells:     []CellType{Empty},
+		NPCFile:           "npcs.json",
+		NPCTickInterval:   configDuration(500 * time.Millisecond),
+		ItemFile:          "items.json",
+		InventorySlots:    20,
+		AttackCooldown:    configDuration(time.Second),
+		RespawnDelay:      configDuration(10 * time.Second),
+	}
+
+	filterConfig := defaultChatFilterConfig()
+	cfg.ChatWordList = chatWordListFilename
+	cfg.ChatMaxLength = filterConfig.MaxLength
+	cfg.ChatBlockLinks = filterConfig.BlockLinks
+	cfg.ChatSpamRepeatLimit = filterConfig.SpamRepeatLimit
+	cfg.ChatSpamWindow = configDuration(filterConfig.SpamWindow)
+	return cfg
+}
+
+// configSetting binds one setting to its environment variable and flag.
+type configSetting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(cfg *Config, value string) error
+	// Boolean flags may be given without a value
+	isBool bool
+}
+
+// flagValue holds the text of a flag until it is layered over the other sources.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (f *flagValue) String() string     { return f.value }
+func (f *flagValue) Set(v string) error { f.value = v; return nil }
+func (f *flagValue) IsBoolFlag() bool   { return f.isBool }
+
+func setString(field func(cfg *Config) *string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}
+}
+
+func setInt(field func(cfg *Config) *int) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(cfg) = n
+		return nil
+	}
+}
+
+func setBool(field func(cfg *Config) *bool) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*field(cfg) = b
+		return nil
+	}
+}
+
+func setCellTypes(field func(cfg *Config) *[]CellType) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		types := []CellType{}
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				types = append(types, CellType(name))
+			}
+		}
+		*field(cfg) = types
+		return nil
+	}
+}
+
+func setDuration(field func(cfg *Config) *configDuration) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = configDuration(d)
+		return nil
+	}
+}
+
+var configSettings = []configSetting{
+	{env: "SERVER_NAME", flag: "server-name", usage: "name of this server in the cluster", set: setString(func(c *Config) *string { return &c.ServerName })},
+	{env: "GAME_ADDR", flag: "game-addr", usage: "address of the game listener", set: setString(func(c *Config) *string { return &c.GameAddr })},
+	{env: "API_ADDR", flag: "api-addr", usage: "address of the admin API", set: setString(func(c *Config) *string { return &c.APIAddr })},
+	{env: "SERVER_API_URL", flag: "server-api-url", usage: "URL peers use to reach this server's API", set: setString(func(c *Config) *string { return &c.ServerAPIURL })},
+	{env: "PEER_SERVERS", flag: "peer-servers", usage: "comma separated name=api_url pairs of peer servers", set: setString(func(c *Config) *string { return &c.PeerServers })},
+	{env: "CONSOLE_SOCKET", flag: "console-socket", usage: "unix socket of the operator console", set: setString(func(c *Config) *string { return &c.ConsoleSocket })},
+	{env: "CONSOLE", flag: "console", usage: "run the operator console on stdin", set: setBool(func(c *Config) *bool { return &c.Console }), isBool: true},
+	{env: "API_SECRET", set: setString(func(c *Config) *string { return &c.APISecret })},
+	{env: "SERVER_SECRET", set: setString(func(c *Config) *string { return &c.ServerSecret })},
+	{env: "MAP_FILE", flag: "map-file", usage: "file the map is loaded from and saved to", set: setString(func(c *Config) *string { return &c.MapFile })},
+	{env: "GRID_WIDTH", flag: "grid-width", usage: "width of a newly created map", set: setInt(func(c *Config) *int { return &c.GridWidth })},
+	{env: "GRID_HEIGHT", flag: "grid-height", usage: "height of a newly created map", set: setInt(func(c *Config) *int { return &c.GridHeight })},
+	{env: "SLEEP_DELAY", flag: "sleep-delay", usage: "delay between steps of /moveTo", set: setDuration(func(c *Config) *configDuration { return &c.SleepDelay })},
+	{env: "COMMAND_RATE_LIMIT", flag: "command-rate-limit", usage: "commands a client may send in a burst", set: setInt(func(c *Config) *int { return &c.CommandRateLimit })},
+	{env: "COMMAND_RATE_PERIOD", flag: "command-rate-period", usage: "time for a client to regain one command", set: setDuration(func(c *Config) *configDuration { return &c.CommandRatePeriod })},
+	{env: "CHAT_WORD_LIST", flag: "chat-word-list", usage: "file of words masked in chat", set: setString(func(c *Config) *string { return &c.ChatWordList })},
+	{env: "CHAT_MAX_LENGTH", flag: "chat-max-length", usage: "longest chat message allowed, 0 for no limit", set: setInt(func(c *Config) *int { return &c.ChatMaxLength })},
+	{env: "CHAT_BLOCK_LINKS", flag: "chat-block-links", usage: "reject chat messages containing links", set: setBool(func(c *Config) *bool { return &c.ChatBlockLinks }), isBool: true},
+	{env: "CHAT_SPAM_REPEAT_LIMIT", flag: "chat-spam-repeat-limit", usage: "times a message may be repeated within the spam window, 0 to allow any", set: setInt(func(c *Config) *int { return &c.ChatSpamRepeatLimit })},
+	{env: "CHAT_SPAM_WINDOW", flag: "chat-spam-window", usage: "window in which repeated messages are counted", set: setDuration(func(c *Config) *configDuration { return &c.ChatSpamWindow })},
+	{env: "MOTD", flag: "motd", usage: "message of the day sent to joining players", set: setString(func(c *Config) *string { return &c.MOTD })},
+	{env: "WALKABLE_CELLS", flag: "walkable-cells", usage: "comma separated cell types players may move onto", set: setCellTypes(func(c *Config) *[]CellType { return &c.WalkableCells })},
+	{env: "NPC_FILE", flag: "npc-file", usage: "file the NPCs are loaded from", set: setString(func(c *Config) *string { return &c.NPCFile })},
+	{env: "NPC_TICK_INTERVAL", flag: "npc-tick-interval", usage: "time between NPC moves", set: setDuration(func(c *Config) *configDuration { return &c.NPCTickInterval })},
+	{env: "ITEM_FILE", flag: "item-file", usage: "file the item definitions are loaded from", set: setString(func(c *Config) *string { return &c.ItemFile })},
+	{env: "INVENTORY_SLOTS", flag: "inventory-slots", usage: "number of item stacks a player can carry", set: setInt(func(c *Config) *int { return &c.InventorySlots })},
+	{env: "ATTACK_COOLDOWN", flag: "attack-cooldown", usage: "time between attacks of a player or NPC", set: setDuration(func(c *Config) *configDuration { return &c.AttackCooldown })},
+	{env: "RESPAWN_DELAY", flag: "respawn-delay", usage: "time before killed NPCs come back", set: setDuration(func(c *Config) *configDuration { return &c.RespawnDelay })},
+	{env: "LOG_LEVEL", flag: "log-level", usage: "debug, info, warn or error", set: setString(func(c *Config) *string { return &c.LogLevel })},
+	{env: "LOG_FORMAT", flag: "log-format", usage: "logfmt or json", set: setString(func(c *Config) *string { return &c.LogFormat })},
+}
+
+// loadConfig builds the configuration from the defaults, the config file,
+// the environment and the command line arguments, then validates it.
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := flags.String("config", "", "JSON config file, "+defaultConfigFilename+" by default")
+	flagValues := map[string]*flagValue{}
+	for _, setting := range configSettings {
+		if setting.flag != "" {
+			flagValues[setting.flag] = &flagValue{isBool: setting.isBool}
+			flags.Var(flagValues[setting.flag], setting.flag, setting.usage+" ($"+setting.env+")")
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	// A missing .env file is fine, the environment may be set directly. The file is
+	// read rather than loaded into the environment so a reload sees its changes.
+	dotenv, err := godotenv.Read()
+	if err != nil && !os.IsNotExist(err) {
+		return cfg, fmt.Errorf(".env: %v", err)
+	}
+	lookupEnv := func(key string) string {
+		if value, ok := os.LookupEnv(key); ok {
+			return value
+		}
+		return dotenv[key]
+	}
+
+	filename, required := *configFile, true
+	if filename == "" {
+		filename = lookupEnv("CONFIG_FILE")
+	}
+	if filename == "" {
+		filename, required = defaultConfigFilename, false
+	}
+	if err := readConfigFile(&cfg, filename, required); err != nil {
+		return cfg, err
+	}
+
+	for _, setting := range configSettings {
+		if value := lookupEnv(setting.env); value != "" {
+			if err := setting.set(&cfg, value); err != nil {
+				return cfg, fmt.Errorf("%s: %v", setting.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		for _, setting := range configSettings {
+			if setting.flag == f.Name && flagErr == nil {
+				if err := setting.set(&cfg, flagValues[f.Name].value); err != nil {
+					flagErr = fmt.Errorf("-%s: %v", f.Name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, flagErr
+	}
+
+	return cfg, cfg.validate()
+}
+
+func readConfigFile(cfg *Config, filename string, required bool) error {
+	byteValue, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(byteValue)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
+
+// validate reports every invalid setting at once.
+func (c Config) validate() error {
+	problems := []string{}
+	if strings.TrimSpace(c.ServerName) == "" {
+		problems = append(problems, "server_name must not be empty")
+	}
+	if c.GameAddr == "" || c.APIAddr == "" {
+		problems = append(problems, "game_addr and api_addr must not be empty")
+	}
+	if c.GameAddr == c.APIAddr {
+		problems = append(problems, "game_addr and api_addr must differ")
+	}
+	if c.APISecret == "" || c.ServerSecret == "" {
+		problems = append(problems, "api_secret and server_secret must not be empty")
+	}
+	if c.MapFile == "" {
+		problems = append(problems, "map_file must not be empty")
+	}
+	if c.GridWidth < 1 || c.GridHeight < 1 {
+		problems = append(problems, "grid_width and grid_height must be positive")
+	}
+	if c.SleepDelay < 0 {
+		problems = append(problems, "sleep_delay must not be negative")
+	}
+	if c.CommandRateLimit < 1 || c.CommandRatePeriod <= 0 {
+		problems = append(problems, "command_rate_limit and command_rate_period must be positive")
+	}
+	for name, limit := range c.ChatRateLimits {
+		if _, ok := chatScopes[name]; !ok {
+			problems = append(problems, fmt.Sprintf("chat_rate_limits has unknown scope %q", name))
+		} else if limit.Limit < 1 || limit.Period <= 0 {
+			problems = append(problems, fmt.Sprintf("chat_rate_limits.%s must have a positive limit and period", name))
+		}
+	}
+	if c.ChatMaxLength < 0 || c.ChatSpamRepeatLimit < 0 || c.ChatSpamWindow < 0 {
+		problems = append(problems, "chat_max_length, chat_spam_repeat_limit and chat_spam_window must not be negative")
+	}
+	for _, cellType := range c.WalkableCells {
+		if !isCellType(cellType) {
+			problems = append(problems, fmt.Sprintf("walkable_cells has unknown cell type %q, expected one of %s", cellType, strings.Join(cellTypeNames(), ", ")))
+		}
+	}
+	if c.NPCTickInterval <= 0 {
+		problems = append(problems, "npc_tick_interval must be positive")
+	}
+	if c.InventorySlots < 1 {
+		problems = append(problems, "inventory_slots must be positive")
+	}
+	if c.AttackCooldown < 0 || c.RespawnDelay < 0 {
+		problems = append(problems, "attack_cooldown and respawn_delay must not be negative")
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.LogFormat != LogFormatLogfmt && c.LogFormat != LogFormatJSON {
+		problems = append(problems, "log_format must be logfmt or json")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// redacted returns a copy that is safe to log.
+func (c Config) redacted() Config {
+	c.APISecret = "[REDACTED]"
+	c.ServerSecret = "[REDACTED]"
+	return c
+}
+
+// chatFilterConfig returns the chat filter settings, masking the given words.
+func (c Config) chatFilterConfig(words []string) chatFilterConfig {
+	return chatFilterConfig{
+		MaxLength:       c.ChatMaxLength,
+		BlockLinks:      c.ChatBlockLinks,
+		Words:           words,
+		SpamRepeatLimit: c.ChatSpamRepeatLimit,
+		SpamWindow:      time.Duration(c.ChatSpamWindow),
+	}
+}
+
+func currentConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	return config
+}
+
+// applyConfig makes cfg the running configuration at startup, before any
+// connection is served. It also sets the copies of settings kept in plain
+// globals, which are read without a lock and so are never changed afterwards.
+func applyConfig(cfg Config) {
+	serverName = cfg.ServerName
+	apijwtSecret = cfg.APISecret
+	serverjwtSecret = cfg.ServerSecret
+	mapFilename = cfg.MapFile
+	defaultSleepDelay = time.Duration(cfg.SleepDelay)
+
+	if cfg.APISecret == defaultAPISecret {
+		serverLog.warn("using the default API secret, set API_SECRET")
+	}
+	if cfg.ServerSecret == defaultServerSecret {
+		serverLog.warn("using the default server secret, set SERVER_SECRET")
+	}
+	applyReloadedConfig(cfg)
+}
+
+// applyReloadedConfig makes cfg the running configuration while the server
+// runs. Only settings read through currentConfig take effect; the others need
+// a restart.
+func applyReloadedConfig(cfg Config) {
+	configMu.Lock()
+	config = cfg
+	configMu.Unlock()
+
+	configureLogging(cfg.LogLevel, cfg.LogFormat)
+
+	redactedJSON, _ := json.Marshal(cfg.redacted())
+	serverLog.info("configuration loaded", "settings", string(redactedJSON))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, contents string) string {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return filename
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	filename := writeTestConfig(t, `{"server_name": "FromFile", "grid_width": 40, "grid_height": 30, "sleep_delay": "500ms", "api_addr": ":5100"}`)
+	t.Setenv("CONFIG_FILE", filename)
+	t.Setenv("SERVER_NAME", "FromEnv")
+	t.Setenv("GRID_WIDTH", "50")
+
+	cfg, err := loadConfig([]string{"-grid-width", "60"})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.ServerName != "FromEnv" {
+		t.Errorf("Expected the environment to override the file, got %q", cfg.ServerName)
+	}
+	if cfg.GridWidth != 60 {
+		t.Errorf("Expected the flag to override the environment, got %d", cfg.GridWidth)
+	}
+	if cfg.GridHeight != 30 || cfg.APIAddr != ":5100" || time.Duration(cfg.SleepDelay) != 500*time.Millisecond {
+		t.Errorf("Expected the file settings to apply, got %+v", cfg)
+	}
+	if cfg.GameAddr != ":6000" || cfg.CommandRateLimit != 5 {
+		t.Errorf("Expected defaults for unset settings, got %+v", cfg)
+	}
+}
+
+func TestLoadConfigRejectsInvalidSettings(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeTestConfig(t, `{"grid_width": 0, "log_format": "xml", "game_addr": ":5000"}`))
+
+	_, err := loadConfig(nil)
+	if err == nil {
+		t.Fatalf("Expected an invalid configuration to be rejected")
+	}
+	for _, problem := range []string{"grid_width", "log_format", "must differ"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q to be reported in %v", problem, err)
+		}
+	}
+
+	t.Setenv("CONFIG_FILE", writeTestConfig(t, `{"grid_widht": 10}`))
+	if _, err := loadConfig(nil); err == nil || !strings.Contains(err.Error(), "grid_widht") {
+		t.Fatalf("Expected an unknown setting to be rejected, got %v", err)
+	}
+
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("SLEEP_DELAY", "soon")
+	if _, err := loadConfig(nil); err == nil || !strings.Contains(err.Error(), "SLEEP_DELAY") {
+		t.Fatalf("Expected a malformed duration to be rejected, got %v", err)
+	}
+}
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.APISecret = "api-secret-value"
+	cfg.ServerSecret = "server-secret-value"
+
+	out, err := json.Marshal(cfg.redacted())
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+	if strings.Contains(string(out), "secret-value") || !strings.Contains(string(out), `"sleep_delay":"3s"`) {
+		t.Fatalf("Unexpected redacted config: %s", out)
+	}
+	if cfg.APISecret != "api-secret-value" {
+		t.Fatalf("Redacting must not change the original config")
+	}
+}
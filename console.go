@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	consolePrompt = "> "
+	// Commands remembered by each console session
+	consoleHistoryLimit = 100
+	// Actor recorded in the audit log for console commands
+	consoleActor = "console"
+)
+
+// consoleCommand is a command of the operator console. Commands call the same
+// functions as the matching admin API handlers.
+type consoleCommand struct {
+	name    string
+	usage   string
+	summary string
+	minArgs int
+	// Action recorded in the audit log, empty for read-only commands
+	audit string
+	// The first argument names the player the command acts on
+	targetsUser bool
+	// complete returns the candidates for the argument at the index
+	complete func(arg int) []string
+	run      func(s *consoleSession, args []string) error
+}
+
+// consoleSession reads commands from one operator, from stdin or a socket connection.
+type consoleSession struct {
+	in  *bufio.Reader
+	out io.Writer
+	// Interactive sessions get echo, line editing, tab completion and history keys.
+	// Otherwise the terminal on the other side does its own line editing.
+	interactive bool
+	// Where the operator is connected from, for the audit log
+	source  string
+	history []string
+	done    bool
+}
+
+func consoleCommands() []*consoleCommand {
+	return []*consoleCommand{
+		{name: "help", usage: "help [command]", summary: "List the commands or show how to use one", complete: completeCommandNames, run: consoleHelp},
+		{name: "who", usage: "who", summary: "List the players online", run: consoleWho},
+		{name: "kick", usage: "kick <username> [reason]", summary: "Disconnect a player", minArgs: 1, audit: "kickUser", targetsUser: true, complete: completeUsernames, run: consoleKick},
+		{name: "mute", usage: "mute <username> [duration] [reason]", summary: "Mute a player, until unmuted when no duration such as 10m is given", minArgs: 1, audit: "muteUser", targetsUser: true, complete: completeUsernames, run: consoleMute},
+		{name: "unmute", usage: "unmute <username>", summary: "Lift the mutes of a player", minArgs: 1, audit: "unmuteUser", targetsUser: true, complete: completeUsernames, run: consoleUnmute},
+		{name: "announce", usage: "announce <message>", summary: "Send an announcement to every player", minArgs: 1, audit: "sendAnnouncement", run: consoleAnnounce},
+		{name: "save", usage: "save", summary: "Save the map to the map file", audit: "saveMap", run: consoleSave},
+		{name: "load", usage: "load", summary: "Load the map from the map file", audit: "loadMap", run: consoleLoad},
+		{name: "tp", usage: "tp <username> <x> <y> [force]", summary: "Move a player to a cell, onto any terrain with force", minArgs: 3, audit: "moveUser", targetsUser: true, complete: completeTeleport, run: consoleTeleport},
+		{name: "setcell", usage: "setcell <x> <y> <type>", summary: "Change the type of a cell", minArgs: 3, audit: "setCell", complete: completeCellTypes, run: consoleSetCell},
+		{name: "reload", usage: "reload", summary: "Reload the settings that can change without a restart", audit: "reloadConfig", run: consoleReload},
+		{name: "history", usage: "history", summary: "List the commands of this session, !n or !! runs one again", run: consoleHistory},
+		{name: "quit", usage: "quit", summary: "Close the console", run: consoleQuit},
+	}
+}
+
+func findConsoleCommand(name string) *consoleCommand {
+	for _, cmd := range consoleCommands() {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func completeCommandNames(arg int) []string {
+	if arg != 0 {
+		return nil
+	}
+	names := []string{}
+	for _, cmd := range consoleCommands() {
+		names = append(names, cmd.name)
+	}
+	return names
+}
+
+func completeUsernames(arg int) []string {
+	if arg != 0 {
+		return nil
+	}
+	usernames := []string{}
+	clients.Range(func(k, _ interface{}) bool {
+		usernames = append(usernames, k.(string))
+		return true
+	})
+	sort.Strings(usernames)
+	return usernames
+}
+
+func completeTeleport(arg int) []string {
+	switch arg {
+	case 0:
+		return completeUsernames(arg)
+	case 3:
+		return []string{"force"}
+	}
+	return nil
+}
+
+func completeCellTypes(arg int) []string {
+	if arg != 2 {
+		return nil
+	}
+	return cellTypeNames()
+}
+
+func newConsoleSession(in io.Reader, out io.Writer, interactive bool, source string) *consoleSession {
+	return &consoleSession{
+		in:          bufio.NewReader(in),
+		out:         out,
+		interactive: interactive,
+		source:      source,
+	}
+}
+
+// printf writes to the operator. Interactive terminals are in raw mode, so lines end in \r\n.
+func (s *consoleSession) printf(format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	if s.interactive {
+		text = strings.Replace(text, "\n", "\r\n", -1)
+	}
+	io.WriteString(s.out, text)
+}
+
+// run reads and executes commands until the operator quits or disconnects.
+func (s *consoleSession) run() {
+	s.printf("%s operator console, type help for the commands.\n", serverName)
+	for !s.done {
+		if !s.interactive {
+			s.printf(consolePrompt)
+		}
+		line, err := s.readLine()
+		if err != nil {
+			return
+		}
+		s.execute(line)
+	}
+}
+
+// readLine reads one command, editing it in place on interactive sessions.
+func (s *consoleSession) readLine() (string, error) {
+	if !s.interactive {
+		line, err := s.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	s.printf(consolePrompt)
+	line := []rune{}
+	// Position in the history while browsing it with the arrow keys
+	browse := len(s.history)
+	for {
+		r, _, err := s.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			s.printf("\n")
+			return string(line), nil
+		case 0x7f, '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				s.printf("\b \b")
+			}
+		case '\t':
+			line = []rune(s.complete(string(line)))
+		case 0x03:
+			// Ctrl-C abandons the line
+			s.printf("^C\n%s", consolePrompt)
+			line = line[:0]
+		case 0x04:
+			// Ctrl-D on an empty line closes the console
+			if len(line) == 0 {
+				s.printf("\n")
+				return "", io.EOF
+			}
+		case 0x1b:
+			// Arrow keys arrive as ESC [ A and ESC [ B
+			if next, _ := s.in.Peek(2); len(next) == 2 && next[0] == '[' {
+				s.in.Discard(2)
+				switch next[1] {
+				case 'A':
+					if browse > 0 {
+						browse--
+						line = []rune(s.history[browse])
+					}
+				case 'B':
+					if browse < len(s.history) {
+						browse++
+						line = line[:0]
+						if browse < len(s.history) {
+							line = []rune(s.history[browse])
+						}
+					}
+				}
+				s.printf("\r\x1b[K%s%s", consolePrompt, string(line))
+			}
+		default:
+			if r >= ' ' {
+				line = append(line, r)
+				s.printf("%c", r)
+			}
+		}
+	}
+}
+
+// complete completes the last word of the line, listing the candidates when
+// there is more than one, and returns the completed line.
+func (s *consoleSession) complete(line string) string {
+	words := strings.Fields(line)
+	if len(words) == 0 || strings.HasSuffix(line, " ") {
+		words = append(words, "")
+	}
+	word := words[len(words)-1]
+
+	var candidates []string
+	if len(words) == 1 {
+		candidates = completeCommandNames(0)
+	} else if cmd := findConsoleCommand(words[0]); cmd != nil && cmd.complete != nil {
+		candidates = cmd.complete(len(words) - 2)
+	}
+
+	matches := []string{}
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		return line
+	}
+
+	completed := matches[0]
+	if len(matches) == 1 {
+		completed += " "
+	} else {
+		for _, match := range matches[1:] {
+			for !strings.HasPrefix(match, completed) {
+				completed = completed[:len(completed)-1]
+			}
+		}
+	}
+
+	newLine := strings.Join(append(words[:len(words)-1], completed), " ")
+	switch {
+	case len(matches) > 1:
+		s.printf("\n%s\n%s%s", strings.Join(matches, "  "), consolePrompt, newLine)
+	case strings.HasPrefix(newLine, line):
+		s.printf("%s", newLine[len(line):])
+	default:
+		s.printf("\r\x1b[K%s%s", consolePrompt, newLine)
+	}
+	return newLine
+}
+
+// expandHistory replaces !! with the last command and !n with the nth one.
+func (s *consoleSession) expandHistory(line string) (string, bool) {
+	if !strings.HasPrefix(line, "!") {
+		return line, true
+	}
+	if line == "!!" {
+		if len(s.history) == 0 {
+			return "", false
+		}
+		return s.history[len(s.history)-1], true
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > len(s.history) {
+		return "", false
+	}
+	return s.history[n-1], true
+}
+
+func (s *consoleSession) remember(line string) {
+	s.history = append(s.history, line)
+	if len(s.history) > consoleHistoryLimit {
+		s.history = s.history[len(s.history)-consoleHistoryLimit:]
+	}
+}
+
+// execute runs one command line and records it in the audit log when it changes anything.
+func (s *consoleSession) execute(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	line, ok := s.expandHistory(line)
+	if !ok {
+		s.printf("No such command in the history.\n")
+		return
+	}
+	s.remember(line)
+
+	args := strings.Fields(line)
+	cmd := findConsoleCommand(args[0])
+	if cmd == nil {
+		s.printf("Unknown command %q, type help for the commands.\n", args[0])
+		return
+	}
+	args = args[1:]
+	if len(args) < cmd.minArgs {
+		s.printf("Usage: %s\n", cmd.usage)
+		return
+	}
+
+	err := cmd.run(s, args)
+	if err != nil {
+		s.printf("Error: %v\n", err)
+	}
+
+	if cmd.audit != "" {
+		entry := &auditEntry{
+			Time:       time.Now().UTC(),
+			Actor:      consoleActor,
+			Action:     cmd.audit,
+			Method:     "CONSOLE",
+			RemoteAddr: s.source,
+			Payload:    line,
+			Outcome:    "success",
+		}
+		if err != nil {
+			entry.Outcome = "failure"
+		}
+		if cmd.targetsUser {
+			entry.Users = []string{args[0]}
+		}
+		recordAudit(entry)
+	}
+}
+
+func consoleHelp(s *consoleSession, args []string) error {
+	if len(args) > 0 {
+		cmd := findConsoleCommand(args[0])
+		if cmd == nil {
+			return fmt.Errorf("unknown command %q", args[0])
+		}
+		s.printf("Usage: %s\n%s\n", cmd.usage, cmd.summary)
+		return nil
+	}
+
+	for _, cmd := range consoleCommands() {
+		s.printf("  %-36s %s\n", cmd.usage, cmd.summary)
+	}
+	return nil
+}
+
+func consoleWho(s *consoleSession, args []string) error {
+	players := []PlayerInfo{}
+	clients.Range(func(_, v interface{}) bool {
+		players = append(players, playerInfo(v.(*client)))
+		return true
+	})
+	sort.Slice(players, func(i, j int) bool { return players[i].Username < players[j].Username })
+
+	for _, player := range players {
+		details := ""
+		if player.Channel != "" {
+			details += " channel=" + player.Channel
+		}
+		if player.Muted {
+			details += " muted"
+		}
+		s.printf("  %s (%d, %d)%s\n", player.Username, player.X, player.Y, details)
+	}
+	s.printf("%d online\n", len(players))
+	return nil
+}
+
+func consoleKick(s *consoleSession, args []string) error {
+	if err := kickUser(args[0], strings.Join(args[1:], " "), consoleActor); err != nil {
+		return err
+	}
+	s.printf("Kicked %s.\n", args[0])
+	return nil
+}
+
+func consoleMute(s *consoleSession, args []string) error {
+	var duration time.Duration
+	reason := args[1:]
+	if len(reason) > 0 {
+		if d, err := time.ParseDuration(reason[0]); err == nil {
+			if d < 0 {
+				return fmt.Errorf("the duration must not be negative")
+			}
+			duration, reason = d, reason[1:]
+		}
+	}
+
+	sanction, err := muteUser(args[0], strings.Join(reason, " "), consoleActor, duration)
+	if err != nil {
+		return err
+	}
+	if duration > 0 {
+		s.printf("Muted %s until %s (sanction %d).\n", args[0], sanction.ExpiresAt.Format(time.RFC3339), sanction.ID)
+	} else {
+		s.printf("Muted %s until unmuted (sanction %d).\n", args[0], sanction.ID)
+	}
+	return nil
+}
+
+func consoleUnmute(s *consoleSession, args []string) error {
+	lifted, err := unmuteUser(args[0])
+	if err != nil {
+		return err
+	}
+	if len(lifted) == 0 {
+		return fmt.Errorf("%s is not muted", args[0])
+	}
+	s.printf("Unmuted %s.\n", args[0])
+	return nil
+}
+
+func consoleAnnounce(s *consoleSession, args []string) error {
+	sendAnnouncement(strings.Join(args, " "))
+	s.printf("Announcement sent.\n")
+	return nil
+}
+
+func consoleSave(s *consoleSession, args []string) error {
+	if err := saveCurrentMap(); err != nil {
+		return err
+	}
+	s.printf("Map saved to %s.\n", mapFilename)
+	return nil
+}
+
+func consoleLoad(s *consoleSession, args []string) error {
+	if err := reloadMap(consoleActor); err != nil {
+		return err
+	}
+	s.printf("Map loaded from %s and sent to the players.\n", mapFilename)
+	return nil
+}
+
+func consoleTeleport(s *consoleSession, args []string) error {
+	x, errX := strconv.Atoi(args[1])
+	y, errY := strconv.Atoi(args[2])
+	if errX != nil || errY != nil {
+		return fmt.Errorf("the coordinates must be integers")
+	}
+
+	force := len(args) > 3 && args[3] == "force"
+
+	v, ok := clients.Load(args[0])
+	if !ok {
+		return errUserOffline
+	}
+	cli := v.(*client)
+
+	if err := teleportClient(cli, x, y, force); err != nil {
+		return err
+	}
+	s.printf("Moved %s to (%d, %d).\n", cli.username, x, y)
+	return nil
+}
+
+func consoleSetCell(s *consoleSession, args []string) error {
+	x, errX := strconv.Atoi(args[0])
+	y, errY := strconv.Atoi(args[1])
+	if errX != nil || errY != nil {
+		return fmt.Errorf("the coordinates must be integers")
+	}
+
+	if err := setCellType(x, y, CellType(args[2]), consoleActor); err != nil {
+		return err
+	}
+	s.printf("Cell (%d, %d) is now %s.\n", x, y, args[2])
+	return nil
+}
+
+func consoleReload(s *consoleSession, args []string) error {
+	report, err := reloadConfig()
+	if err != nil {
+		return err
+	}
+	s.printf("Changed: %s\n", strings.Join(report.Changed, ", "))
+	if len(report.RequiresRestart) > 0 {
+		s.printf("Needs a restart: %s\n", strings.Join(report.RequiresRestart, ", "))
+	}
+	return nil
+}
+
+func consoleHistory(s *consoleSession, args []string) error {
+	for i, line := range s.history {
+		s.printf("%4d  %s\n", i+1, line)
+	}
+	return nil
+}
+
+func consoleQuit(s *consoleSession, args []string) error {
+	s.done = true
+	return nil
+}
+
+// startConsoleSocket serves the operator console on a unix socket that only
+// the user running the server can connect to.
+func startConsoleSocket(path string) error {
+	// A socket left behind by a previous run would make the listen fail
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	// The socket is made in a directory only this user can enter and moved into
+	// place once it is private, so nobody can connect while it is being set up
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".console-")
+	if err != nil {
+		return fmt.Errorf("failed to create console socket directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "console.sock")
+
+	ln, err := net.Listen("unix", private)
+	if err != nil {
+		return fmt.Errorf("failed to listen on console socket: %v", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(private, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+	if err := os.Rename(private, path); err != nil {
+		ln.Close()
+		return err
+	}
+	serverLog.info("starting operator console", "socket", path)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				serverLog.error("console socket closed", "err", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serverLog.info("operator console session started", "socket", path)
+				newConsoleSession(conn, conn, true, "unix:"+path).run()
+				serverLog.info("operator console session ended", "socket", path)
+			}()
+		}
+	}()
+	return nil
+}
+
+// runStdinConsole serves the operator console on the terminal the server runs in.
+func runStdinConsole() {
+	restore, err := setCbreakMode(os.Stdin.Fd())
+	interactive := err == nil
+	if interactive {
+		// Give the terminal back its line editing when the server is interrupted
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupts
+			restore()
+			os.Exit(1)
+		}()
+		defer restore()
+	}
+
+	newConsoleSession(os.Stdin, os.Stdout, interactive, "stdin").run()
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// setCbreakMode is only implemented on Linux. Elsewhere the console reads whole
+// lines edited by the terminal, without tab completion.
+func setCbreakMode(fd uintptr) (func(), error) {
+	return nil, errors.New("terminal line editing is not supported on this platform")
+}
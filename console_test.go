@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsoleCommands(t *testing.T) {
+	initGrid()
+	previous := auditTrail
+	auditTrail = newAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	defer func() { auditTrail = previous }()
+
+	_, lines := newPipeClient(t, "alice", 0, 0)
+
+	input := "who\nannounce server restarting soon\nkick nobody\nsetcell 1 2 Water\nsetcell 1 2 Lava\nbogus\nquit\nwho\n"
+	var out bytes.Buffer
+	newConsoleSession(strings.NewReader(input), &out, false, "test").run()
+
+	for _, expected := range []string{"alice (0, 0)", "1 online", "Announcement sent.", "Error: User is not online", "Cell (1, 2) is now Water.", `unknown cell type "Lava"`, `Unknown command "bogus"`} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Missing %q in console output:\n%s", expected, out.String())
+		}
+	}
+	if strings.Count(out.String(), "1 online") != 1 {
+		t.Errorf("Expected the console to stop reading after quit:\n%s", out.String())
+	}
+
+	if msg := expectAction(t, lines, "announcement"); msg["message"] != "server restarting soon" {
+		t.Fatalf("Unexpected announcement %+v", msg)
+	}
+	if grid[2][1].Type != Water {
+		t.Fatalf("Expected the cell to change, got %s", grid[2][1].Type)
+	}
+
+	entries, err := auditTrail.query(auditFilter{Actor: consoleActor})
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	outcomes := []string{}
+	for _, entry := range entries {
+		outcomes = append(outcomes, entry.Action+":"+entry.Outcome)
+	}
+	expected := "sendAnnouncement:success kickUser:failure setCell:success setCell:failure"
+	if strings.Join(outcomes, " ") != expected {
+		t.Fatalf("Expected audit entries %q, got %q", expected, strings.Join(outcomes, " "))
+	}
+	if entries[1].Users[0] != "nobody" || entries[1].Payload != "kick nobody" || entries[1].RemoteAddr != "test" {
+		t.Fatalf("Unexpected audit entry %+v", entries[1])
+	}
+}
+
+func TestConsoleCompletion(t *testing.T) {
+	initGrid()
+	newPipeClient(t, "alice", 0, 0)
+	newPipeClient(t, "albert", 0, 0)
+
+	s := newConsoleSession(strings.NewReader(""), &bytes.Buffer{}, true, "test")
+	cases := map[string]string{
+		"he":              "help ",
+		"s":               "s",
+		"se":              "setcell ",
+		"kick a":          "kick al",
+		"kick ali":        "kick alice ",
+		"setcell 1 2 Wa":  "setcell 1 2 Water ",
+		"setcell 1 Wa":    "setcell 1 Wa",
+		"announce hello ": "announce hello ",
+	}
+	for line, expected := range cases {
+		if completed := s.complete(line); completed != expected {
+			t.Errorf("Expected %q to complete to %q, got %q", line, expected, completed)
+		}
+	}
+}
+
+func TestConsoleLineEditingAndHistory(t *testing.T) {
+	// Tab completes "hi" to "history ", backspace fixes a typo, the up arrow and !1 repeat commands
+	input := "hi\t\rwhx\x7fo\r\x1b[A\r!1\r\x04"
+	var out bytes.Buffer
+	s := newConsoleSession(strings.NewReader(input), &out, true, "test")
+	s.run()
+
+	expected := []string{"history", "who", "who", "history"}
+	if strings.Join(s.history, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected history %v, got %v", expected, s.history)
+	}
+	if !strings.Contains(out.String(), "   1  history\r\n   2  who\r\n   3  who\r\n") {
+		t.Fatalf("Expected the history listing in the output:\n%q", out.String())
+	}
+}
+
+func TestConsoleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.sock")
+	if err := startConsoleSocket(path); err != nil {
+		t.Fatalf("Failed to start console socket: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat console socket: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("Expected the console socket to be private, got mode %v", mode)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("Expected only the socket next to it, got %d entries", len(entries))
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to connect to console: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte("help tp\r")); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Did not receive the help text: %v", err)
+		}
+		if strings.Contains(line, "Usage: tp <username> <x> <y>") {
+			break
+		}
+	}
+}
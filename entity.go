@@ -0,0 +1,422 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of things that occupy cells. Players are connected clients; the other
+// kinds are entities owned by the server.
+const (
+	EntityPlayer = "player"
+	EntityNPC    = "npc"
+	EntityItem   = "item"
+	EntityObject = "object"
+)
+
+// Kinds of entities that can be spawned
+var entityKinds = []string{EntityNPC, EntityItem, EntityObject}
+
+var errEntityNotFound = errors.New("No entity has this ID")
+
+// Entities on the map, by ID
+var entities sync.Map
+
+// IDs of spawned entities
+var nextEntityID uint64
+
+// entity is something other than a player that occupies a cell, such as an NPC,
+// an item lying on the ground or an object players can interact with. What an
+// entity does is given by its components, keyed by name.
+type entity struct {
+	ID   string
+	Kind string
+	Name string
+
+	// Position on the map, guarded by gridMutex
+	x, y int
+
+	mu         sync.Mutex
+	components map[string]interface{}
+}
+
+// EntityInfo describes a player or entity and where it is.
+type EntityInfo struct {
+	ID         string                 `json:"id"`
+	Kind       string                 `json:"kind"`
+	Name       string                 `json:"name"`
+	X          int                    `json:"x"`
+	Y          int                    `json:"y"`
+	Components map[string]interface{} `json:"components,omitempty"`
+}
+
+type spawnEntityRequest struct {
+	Kind       string                 `json:"kind"`
+	Name       string                 `json:"name"`
+	X          int                    `json:"x"`
+	Y          int                    `json:"y"`
+	Components map[string]interface{} `json:"components,omitempty"`
+}
+
+type removeEntityRequest struct {
+	ID string `json:"id"`
+}
+
+type moveEntityRequest struct {
+	ID    string `json:"id"`
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+	Force bool   `json:"force,omitempty"`
+}
+
+func newEntity(kind, name string) *entity {
+	return &entity{
+		ID:         fmt.Sprintf("%s-%d", kind, atomic.AddUint64(&nextEntityID, 1)),
+		Kind:       kind,
+		Name:       name,
+		components: make(map[string]interface{}),
+	}
+}
+
+func isEntityKind(kind string) bool {
+	for _, known := range entityKinds {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *entity) component(name string) (interface{}, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c, ok := e.components[name]
+	return c, ok
+}
+
+func (e *entity) setComponent(name string, c interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.components[name] = c
+}
+
+func (e *entity) removeComponent(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.components, name)
+}
+
+func (e *entity) position() (int, int) {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	return e.x, e.y
+}
+
+// infoLocked describes the entity. Callers must hold gridMutex.
+func (e *entity) infoLocked() EntityInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	info := EntityInfo{ID: e.ID, Kind: e.Kind, Name: e.Name, X: e.x, Y: e.y}
+	if len(e.components) > 0 {
+		info.Components = make(map[string]interface{}, len(e.components))
+		for name, c := range e.components {
+			info.Components[name] = c
+		}
+	}
+	return info
+}
+
+func (e *entity) info() EntityInfo {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	return e.infoLocked()
+}
+
+// playerEntityID is the ID a player has among entities.
+func playerEntityID(username string) string {
+	return EntityPlayer + ":" + username
+}
+
+func playerEntityInfo(cli *client) EntityInfo {
+	return EntityInfo{ID: playerEntityID(cli.username), Kind: EntityPlayer, Name: cli.username, X: cli.x, Y: cli.y}
+}
+
+// cellEntitiesLocked describes the entities on a cell. Callers must hold gridMutex.
+func cellEntitiesLocked(cell *Cell) []EntityInfo {
+	infos := []EntityInfo{}
+	cell.Entities.Range(func(_, v interface{}) bool {
+		infos = append(infos, v.(*entity).infoLocked())
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// entitiesInRect returns the entities inside a rectangle, the entity counterpart of clientsInRect.
+func entitiesInRect(minX, minY, maxX, maxY int) []*entity {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	found := []*entity{}
+	for y := minY; y <= maxY; y++ {
+		if y < 0 || y >= len(grid) {
+			continue
+		}
+		for x := minX; x <= maxX; x++ {
+			if x < 0 || x >= len(grid[y]) {
+				continue
+			}
+			grid[y][x].Entities.Range(func(_, v interface{}) bool {
+				found = append(found, v.(*entity))
+				return true
+			})
+		}
+	}
+	return found
+}
+
+// spawnEntity places an entity on the map and tells everyone.
+func spawnEntity(e *entity, x, y int) error {
+	gridMutex.Lock()
+	if !insideMapLocked(x, y) {
+		gridMutex.Unlock()
+		return errOutsideMap
+	}
+	e.x, e.y = x, y
+	grid[y][x].Entities.Store(e.ID, e)
+	entities.Store(e.ID, e)
+	info := e.infoLocked()
+	gridMutex.Unlock()
+
+	serverLog.debug("entity spawned", "id", e.ID, "kind", e.Kind, "x", x, "y", y)
+	broadcastEntity("entity_spawned", info)
+	events.publish(EventEntitySpawned, info)
+	return nil
+}
+
+// removeEntity takes an entity off the map and tells everyone.
+func removeEntity(id string) (*entity, error) {
+	// Taken under the lock so only one of concurrent removals succeeds
+	gridMutex.Lock()
+	v, ok := entities.LoadAndDelete(id)
+	if !ok {
+		gridMutex.Unlock()
+		return nil, errEntityNotFound
+	}
+	e := v.(*entity)
+	if insideMapLocked(e.x, e.y) {
+		grid[e.y][e.x].Entities.Delete(id)
+	}
+	info := e.infoLocked()
+	gridMutex.Unlock()
+
+	serverLog.debug("entity removed", "id", e.ID, "kind", e.Kind)
+	broadcastEntity("entity_removed", info)
+	events.publish(EventEntityRemoved, info)
+	return e, nil
+}
+
+// moveEntity moves an entity to a cell and tells everyone with the message
+// player moves use. Force skips the terrain check.
+func moveEntity(e *entity, x, y int, force bool) error {
+	gridMutex.Lock()
+	if !insideMapLocked(x, y) {
+		gridMutex.Unlock()
+		return errOutsideMap
+	}
+	if !force && !isWalkable(grid[y][x].Type) {
+		gridMutex.Unlock()
+		return errNotWalkable
+	}
+	if insideMapLocked(e.x, e.y) {
+		grid[e.y][e.x].Entities.Delete(e.ID)
+	}
+	e.x, e.y = x, y
+	grid[y][x].Entities.Store(e.ID, e)
+	info := e.infoLocked()
+	gridMutex.Unlock()
+
+	broadcastEntityMoved(info, "")
+	events.publish(EventEntityMoved, info)
+	return nil
+}
+
+// broadcastEntityMoved sends the new position of a player or entity to every
+// player but the one named by except.
+func broadcastEntityMoved(info EntityInfo, except string) {
+	defer observeBroadcast("user_moved", time.Now())
+
+	message := map[string]interface{}{
+		"action":   "user_moved",
+		"username": info.Name,
+		"id":       info.ID,
+		"kind":     info.Kind,
+		"x":        info.X,
+		"y":        info.Y,
+	}
+	clients.Range(func(_, v interface{}) bool {
+		client := v.(*client)
+		if client.username != except {
+			sendJSON(client.conn, message)
+		}
+		return true
+	})
+}
+
+// broadcastEntity sends an entity to every player under the given action.
+func broadcastEntity(action string, info EntityInfo) {
+	defer observeBroadcast(action, time.Now())
+
+	message := struct {
+		Action string     `json:"action"`
+		Entity EntityInfo `json:"entity"`
+	}{
+		Action: action,
+		Entity: info,
+	}
+	clients.Range(func(_, v interface{}) bool {
+		sendJSON(v.(*client).conn, message)
+		return true
+	})
+}
+
+// listEntities describes the players and entities of a kind, or of every kind
+// when kind is empty, ordered by ID.
+func listEntities(kind string) []EntityInfo {
+	infos := []EntityInfo{}
+	if kind == "" || kind == EntityPlayer {
+		clients.Range(func(_, v interface{}) bool {
+			infos = append(infos, playerEntityInfo(v.(*client)))
+			return true
+		})
+	}
+
+	gridMutex.RLock()
+	entities.Range(func(_, v interface{}) bool {
+		e := v.(*entity)
+		if kind == "" || e.Kind == kind {
+			infos = append(infos, e.infoLocked())
+		}
+		return true
+	})
+	gridMutex.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+func writeEntityError(w http.ResponseWriter, err error) {
+	switch err {
+	case errEntityNotFound:
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, err.Error())
+	default:
+		writeTeleportError(w, err)
+	}
+}
+
+func listEntitiesHandler(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+
+	errs := fieldErrors{}
+	if kind != "" && kind != EntityPlayer && !isEntityKind(kind) {
+		errs.add("kind", "must be one of %s, %s", EntityPlayer, strings.Join(entityKinds, ", "))
+	}
+	offset, limit := parsePagination(r, errs)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	infos := listEntities(kind)
+	start, end := pageBounds(len(infos), offset, limit)
+	writeAPIData(w, http.StatusOK, page{Total: len(infos), Offset: offset, Limit: limit, Items: infos[start:end]})
+}
+
+func spawnEntityHandler(w http.ResponseWriter, r *http.Request) {
+	var req spawnEntityRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	if !isEntityKind(req.Kind) {
+		errs.add("kind", "must be one of %s", strings.Join(entityKinds, ", "))
+	}
+	errs.required("name", req.Name)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	auditCells(r, req.X, req.Y)
+
+	e := newEntity(req.Kind, req.Name)
+	for name, c := range req.Components {
+		e.setComponent(name, c)
+	}
+	if err := spawnEntity(e, req.X, req.Y); err != nil {
+		writeEntityError(w, err)
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, e.info())
+}
+
+func removeEntityHandler(w http.ResponseWriter, r *http.Request) {
+	var req removeEntityRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	errs.required("id", req.ID)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	e, err := removeEntity(req.ID)
+	if err != nil {
+		writeEntityError(w, err)
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, e.info())
+}
+
+func moveEntityHandler(w http.ResponseWriter, r *http.Request) {
+	var req moveEntityRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	errs.required("id", req.ID)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	auditCells(r, req.X, req.Y)
+
+	v, ok := entities.Load(req.ID)
+	if !ok {
+		writeEntityError(w, errEntityNotFound)
+		return
+	}
+	e := v.(*entity)
+	if err := moveEntity(e, req.X, req.Y, req.Force); err != nil {
+		writeEntityError(w, err)
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, e.info())
+}
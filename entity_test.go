@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// clearEntities removes the entities left by a test.
+func clearEntities(t *testing.T) {
+	t.Cleanup(func() {
+		entities.Range(func(id, _ interface{}) bool {
+			entities.Delete(id)
+			return true
+		})
+	})
+}
+
+func TestEntityLifecycle(t *testing.T) {
+	initGrid()
+	clearEntities(t)
+	grid[3][4].Type = Mountain
+	_, lines := newPipeClient(t, "watcher", 0, 0)
+
+	var info EntityInfo
+	resp := postJSON(t, spawnEntityHandler, "/api/spawnEntity", `{"kind": "npc", "name": "guard", "x": 2, "y": 3, "components": {"greeting": "Halt!"}}`, &info)
+	if !resp.OK || info.Kind != EntityNPC || info.X != 2 || info.Components["greeting"] != "Halt!" {
+		t.Fatalf("Unexpected spawn %+v %+v", resp, info)
+	}
+	if msg := expectAction(t, lines, "entity_spawned"); msg["entity"].(map[string]interface{})["id"] != info.ID {
+		t.Fatalf("Unexpected spawn message %+v", msg)
+	}
+	if _, ok := grid[3][2].Entities.Load(info.ID); !ok {
+		t.Fatalf("Expected the entity to occupy its cell")
+	}
+
+	// Entities move with the message players' moves use
+	if resp := postJSON(t, moveEntityHandler, "/api/moveEntity", `{"id": "`+info.ID+`", "x": 4, "y": 3}`, nil); resp.Error == nil || resp.Error.Code != ErrConflict {
+		t.Fatalf("Expected a mountain to be refused, got %+v", resp)
+	}
+	if resp := postJSON(t, moveEntityHandler, "/api/moveEntity", `{"id": "`+info.ID+`", "x": 3, "y": 3}`, nil); !resp.OK {
+		t.Fatalf("Failed to move entity: %+v", resp)
+	}
+	if msg := expectAction(t, lines, "user_moved"); msg["id"] != info.ID || msg["kind"] != EntityNPC || msg["username"] != "guard" || msg["x"] != float64(3) {
+		t.Fatalf("Unexpected move message %+v", msg)
+	}
+	if _, ok := grid[3][2].Entities.Load(info.ID); ok {
+		t.Fatalf("Expected the entity to leave its old cell")
+	}
+
+	var listed page
+	var items []EntityInfo
+	listed.Items = &items
+	if code := getJSON(t, listEntitiesHandler, "/api/entities", &listed); code != http.StatusOK || listed.Total != 2 || items[0].ID != info.ID || items[1].ID != playerEntityID("watcher") {
+		t.Fatalf("Expected the NPC and the player to be listed, got %d %+v", code, items)
+	}
+	if code := getJSON(t, listEntitiesHandler, "/api/entities?kind=dragon", nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected an unknown kind to be refused, got %d", code)
+	}
+
+	if resp := postJSON(t, removeEntityHandler, "/api/removeEntity", `{"id": "`+info.ID+`"}`, nil); !resp.OK {
+		t.Fatalf("Failed to remove entity: %+v", resp)
+	}
+	expectAction(t, lines, "entity_removed")
+	if resp := postJSON(t, removeEntityHandler, "/api/removeEntity", `{"id": "`+info.ID+`"}`, nil); resp.Error == nil || resp.Error.Code != ErrNotFound {
+		t.Fatalf("Expected a removed entity to be gone, got %+v", resp)
+	}
+}
+
+func TestEntitiesOnMap(t *testing.T) {
+	initGrid()
+	t.Cleanup(initGrid)
+	clearEntities(t)
+	isolateMapHistory(t)
+
+	chest := newEntity(EntityObject, "chest")
+	if err := spawnEntity(chest, 24, 24); err != nil {
+		t.Fatalf("Failed to spawn entity: %v", err)
+	}
+	viewer, lines := newPipeClient(t, "viewer", 0, 0)
+
+	// Entities are sent with the map
+	announceMap(viewer)
+	var snapshot struct {
+		Map [][]CellInfo `json:"map"`
+	}
+	msg := expectAction(t, lines, "map")
+	encoded, _ := json.Marshal(msg)
+	json.Unmarshal(encoded, &snapshot)
+	if cell := snapshot.Map[24][24]; len(cell.Entities) != 1 || cell.Entities[0].Name != "chest" {
+		t.Fatalf("Expected the chest in the map, got %+v", cell)
+	}
+
+	// Entities on cut cells are moved onto the map with the players
+	if _, err := resizeMap(20, 20, "top-left", Empty, "test"); err != nil {
+		t.Fatalf("Failed to resize: %v", err)
+	}
+	if x, y := chest.position(); x != 19 || y != 19 {
+		t.Fatalf("Expected the chest to be moved onto the map, got (%d, %d)", x, y)
+	}
+	if found := entitiesInRect(19, 19, 19, 19); len(found) != 1 || found[0] != chest {
+		t.Fatalf("Expected the chest to occupy its new cell, got %+v", found)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// World event types published on the event bus
+const (
+	EventPlayerJoined      = "player.joined"
+	EventPlayerLeft        = "player.left"
+	EventPlayerTransferred = "player.transferred"
+	EventPlayerMoved       = "player.moved"
+	EventPlayerKicked      = "player.kicked"
+	EventChatSay           = "chat.say"
+	EventChatLocal         = "chat.local"
+	EventChatShout         = "chat.shout"
+	EventChatZone          = "chat.zone"
+	EventChatChannel       = "chat.channel"
+	EventAdminAction       = "admin.action"
+	EventMapEdited         = "map.edited"
+	EventMapResized        = "map.resized"
+	EventMapUndone         = "map.undone"
+	EventMapRedone         = "map.redone"
+	EventEntitySpawned     = "entity.spawned"
+	EventEntityRemoved     = "entity.removed"
+	EventEntityMoved       = "entity.moved"
+	EventInventoryChanged  = "inventory.changed"
+	EventTradeCompleted    = "trade.completed"
+	EventTradeCancelled    = "trade.cancelled"
+	EventCombatAttack      = "combat.attack"
+	EventCombatDeath       = "combat.death"
+	EventCombatRespawn     = "combat.respawn"
+)
+
+const (
+	// Number of recent events kept so SSE clients can resume with Last-Event-ID
+	eventReplayLimit = 256
+	// Events buffered per subscriber before new ones are dropped for it
+	eventSubscriberBuffer = 256
+	// How often an idle SSE stream sends a comment to keep proxies from closing it
+	eventHeartbeatInterval = 15 * time.Second
+)
+
+var events = newEventBus()
+
+// worldEvent is something that happened in the world, as seen by external services.
+type worldEvent struct {
+	ID     uint64      `json:"id"`
+	Type   string      `json:"type"`
+	Time   time.Time   `json:"time"`
+	Server string      `json:"server"`
+	Data   interface{} `json:"data"`
+}
+
+type playerEvent struct {
+	Username string `json:"username"`
+	X        int    `json:"x"`
+	Y        int    `json:"y"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type chatEvent struct {
+	Username string `json:"username"`
+	Message  string `json:"message"`
+	Channel  string `json:"channel,omitempty"`
+	X        int    `json:"x"`
+	Y        int    `json:"y"`
+}
+
+// eventSubscription receives the events of the types it asked for, or all
+// events when it did not ask for any.
+type eventSubscription struct {
+	events  chan worldEvent
+	types   map[string]bool
+	dropped int
+}
+
+// eventBus fans world events out to its subscribers. Publishing never blocks:
+// a subscriber that falls behind misses events instead of stalling the game.
+type eventBus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	subscribers map[*eventSubscription]bool
+	recent      []worldEvent
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		nextID:      1,
+		subscribers: make(map[*eventSubscription]bool),
+	}
+}
+
+func (s *eventSubscription) wants(eventType string) bool {
+	return len(s.types) == 0 || s.types[eventType]
+}
+
+// publish stamps an event and hands it to every interested subscriber.
+func (b *eventBus) publish(eventType string, data interface{}) worldEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event := worldEvent{
+		ID:     b.nextID,
+		Type:   eventType,
+		Time:   time.Now().UTC(),
+		Server: serverName,
+		Data:   data,
+	}
+	b.nextID++
+
+	b.recent = append(b.recent, event)
+	if len(b.recent) > eventReplayLimit {
+		b.recent = b.recent[len(b.recent)-eventReplayLimit:]
+	}
+
+	for sub := range b.subscribers {
+		if !sub.wants(eventType) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped++
+		}
+	}
+	return event
+}
+
+// subscribe registers a subscriber for the given event types. Events newer
+// than afterID that are still in the replay buffer are queued first.
+func (b *eventBus) subscribe(types []string, afterID uint64) *eventSubscription {
+	sub := &eventSubscription{
+		events: make(chan worldEvent, eventSubscriberBuffer),
+		types:  make(map[string]bool),
+	}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if afterID > 0 {
+		for _, event := range b.recent {
+			if event.ID > afterID && sub.wants(event.Type) && len(sub.events) < cap(sub.events) {
+				sub.events <- event
+			}
+		}
+	}
+	b.subscribers[sub] = true
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *eventSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers[sub] {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// publishPlayerEvent publishes an event about a connected player.
+func publishPlayerEvent(eventType string, cli *client, reason string) {
+	events.publish(eventType, playerEvent{Username: cli.username, X: cli.x, Y: cli.y, Reason: reason})
+}
+
+// parseEventTypes splits a comma separated list of event types.
+func parseEventTypes(value string) []string {
+	types := []string{}
+	for _, t := range strings.Split(value, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// eventStreamHandler streams world events as server-sent events until the
+// client disconnects.
+func eventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, "Streaming is not supported")
+		return
+	}
+
+	var afterID uint64
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	if lastID != "" {
+		var err error
+		if afterID, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			writeFieldErrors(w, fieldErrors{"last_event_id": "must be an event ID"})
+			return
+		}
+	}
+
+	sub := events.subscribe(parseEventTypes(r.URL.Query().Get("types")), afterID)
+	defer events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event := <-sub.events:
+			jsonData, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, jsonData)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func expectEvent(t *testing.T, sub *eventSubscription, eventType string) worldEvent {
+	select {
+	case event := <-sub.events:
+		if event.Type != eventType {
+			t.Fatalf("Expected a %s event, got %+v", eventType, event)
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for a %s event", eventType)
+	}
+	return worldEvent{}
+}
+
+func TestEventBusFiltersAndReplays(t *testing.T) {
+	bus := newEventBus()
+	chat := bus.subscribe([]string{EventChatSay}, 0)
+	defer bus.unsubscribe(chat)
+
+	first := bus.publish(EventPlayerJoined, playerEvent{Username: "alice"})
+	bus.publish(EventChatSay, chatEvent{Username: "alice", Message: "hi"})
+
+	event := expectEvent(t, chat, EventChatSay)
+	if event.ID != first.ID+1 || event.Data.(chatEvent).Message != "hi" {
+		t.Fatalf("Unexpected chat event: %+v", event)
+	}
+	if len(chat.events) != 0 {
+		t.Fatalf("The join event should have been filtered out")
+	}
+
+	// A late subscriber resumes after the last event it saw
+	late := bus.subscribe(nil, first.ID)
+	defer bus.unsubscribe(late)
+	expectEvent(t, late, EventChatSay)
+}
+
+func TestGameActionsPublishEvents(t *testing.T) {
+	initGrid()
+	sub := events.subscribe([]string{EventPlayerMoved, EventChatSay, EventPlayerKicked}, 0)
+	defer events.unsubscribe(sub)
+
+	alice, _ := newPipeClient(t, "alice", 0, 0)
+	newPipeClient(t, "bob", 3, 3)
+
+	moveClient(alice, 1, 0)
+	if event := expectEvent(t, sub, EventPlayerMoved); event.Data.(playerEvent).X != 1 {
+		t.Fatalf("Unexpected move event: %+v", event)
+	}
+
+	broadcastSay(alice, "hello world")
+	expectEvent(t, sub, EventChatSay)
+
+	kickClient(alice, "testing")
+	if event := expectEvent(t, sub, EventPlayerKicked); event.Data.(playerEvent).Reason != "testing" {
+		t.Fatalf("Unexpected kick event: %+v", event)
+	}
+}
+
+func TestEventStreamHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(eventStreamHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?types=" + EventChatShout)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	// The subscription exists once the headers are flushed
+	events.publish(EventChatSay, chatEvent{Username: "alice", Message: "not streamed"})
+	published := events.publish(EventChatShout, chatEvent{Username: "alice", Message: "HELLO"})
+
+	reader := bufio.NewReader(resp.Body)
+	lines := []string{}
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event stream: %v", err)
+		}
+		lines = append(lines, strings.TrimRight(line, "\n"))
+	}
+
+	if lines[0] != "id: "+strconv.FormatUint(published.ID, 10) || lines[1] != "event: "+EventChatShout {
+		t.Fatalf("Unexpected event header: %q", lines)
+	}
+	var event worldEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &event); err != nil || event.ID != published.ID {
+		t.Fatalf("Unexpected event data %q (%v)", lines[2], err)
+	}
+}
+
+func TestWebhookDeliveryIsSignedAndRetried(t *testing.T) {
+	defer func(delay time.Duration) { webhookRetryDelay = delay }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	var mu sync.Mutex
+	attempts := 0
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		first := attempts == 1
+		mu.Unlock()
+
+		// Fail the first attempt so the delivery is retried
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	store := newWebhookStore(filepath.Join(t.TempDir(), "webhooks.json"))
+	hook, err := store.add(server.URL, "s3cret", []string{EventPlayerJoined})
+	if err != nil {
+		t.Fatalf("Failed to add webhook: %v", err)
+	}
+
+	bus := newEventBus()
+	sub := bus.subscribe(nil, 0)
+	go store.consume(sub)
+	defer bus.unsubscribe(sub)
+
+	bus.publish(EventChatSay, chatEvent{Username: "alice", Message: "ignored"})
+	bus.publish(EventPlayerJoined, playerEvent{Username: "alice"})
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		if r.Header.Get("X-Event-Type") != EventPlayerJoined {
+			t.Fatalf("Unexpected event type header %q", r.Header.Get("X-Event-Type"))
+		}
+		if r.Header.Get("X-Signature-256") != "sha256="+signWebhookBody("s3cret", body) {
+			t.Fatalf("Signature %q does not match the body", r.Header.Get("X-Signature-256"))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for the webhook delivery")
+	}
+
+	mu.Lock()
+	if attempts != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", attempts)
+	}
+	mu.Unlock()
+
+	// The secret is persisted but never listed
+	reloaded := newWebhookStore(store.filename)
+	if err := reloaded.load(); err != nil || len(reloaded.list()) != 1 || reloaded.hooks[hook.ID].Secret != "s3cret" {
+		t.Fatalf("Webhook was not persisted: %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const chatWordListFilename = "wordlist.txt"
+
+var (
+	errMessageEmpty    = errors.New("Message is empty")
+	errLinksBlocked    = errors.New("Links are not allowed in chat")
+	errRepeatedMessage = errors.New("Please do not repeat the same message")
+)
+
+var linkPattern = regexp.MustCompile(`(?i)(\b[a-z][a-z0-9+.-]*://\S+|\bwww\.\S+|\b[a-z0-9-]+(\.[a-z0-9-]+)*\.(com|net|org|io|gg|ru|info|biz|xyz|me|co|tv|ly)\b)`)
+
+// chatFilter inspects or rewrites a chat message before it is delivered.
+// Returning an error rejects the message and the error is shown to the sender.
+type chatFilter interface {
+	Filter(cli *client, message string) (string, error)
+}
+
+// chatFilterFunc adapts an ordinary function to the chatFilter interface.
+type chatFilterFunc func(cli *client, message string) (string, error)
+
+func (f chatFilterFunc) Filter(cli *client, message string) (string, error) {
+	return f(cli, message)
+}
+
+type chatFilterConfig struct {
+	MaxLength       int
+	BlockLinks      bool
+	Words           []string
+	SpamRepeatLimit int
+	SpamWindow      time.Duration
+}
+
+// chatFilterPipeline runs the built-in filters, then every filter registered
+// with Use, in order.
+type chatFilterPipeline struct {
+	mu      sync.RWMutex
+	builtin []chatFilter
+	filters []chatFilter
+}
+
+var chatFilters = newChatFilterPipeline(defaultChatFilterConfig())
+
+func defaultChatFilterConfig() chatFilterConfig {
+	return chatFilterConfig{
+		MaxLength:       256,
+		BlockLinks:      true,
+		SpamRepeatLimit: 3,
+		SpamWindow:      30 * time.Second,
+	}
+}
+
+// newChatFilterPipeline builds the built-in filters from the configuration.
+func newChatFilterPipeline(cfg chatFilterConfig) *chatFilterPipeline {
+	return &chatFilterPipeline{builtin: builtinChatFilters(cfg)}
+}
+
+func builtinChatFilters(cfg chatFilterConfig) []chatFilter {
+	filters := []chatFilter{chatFilterFunc(stripControlCharacters)}
+	if cfg.MaxLength > 0 {
+		filters = append(filters, maxLengthFilter(cfg.MaxLength))
+	}
+	if cfg.BlockLinks {
+		filters = append(filters, chatFilterFunc(blockLinks))
+	}
+	if len(cfg.Words) > 0 {
+		filters = append(filters, newWordMaskFilter(cfg.Words))
+	}
+	if cfg.SpamRepeatLimit > 0 {
+		filters = append(filters, newSpamFilter(cfg.SpamRepeatLimit, cfg.SpamWindow))
+	}
+	return filters
+}
+
+// Use appends a filter to the end of the pipeline.
+func (p *chatFilterPipeline) Use(f chatFilter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.filters = append(p.filters, f)
+}
+
+// configure rebuilds the built-in filters, such as from a reloaded
+// configuration. Filters registered with Use are kept.
+func (p *chatFilterPipeline) configure(cfg chatFilterConfig) {
+	builtin := builtinChatFilters(cfg)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.builtin = builtin
+}
+
+// Run passes the message through every filter and returns the final text.
+func (p *chatFilterPipeline) Run(cli *client, message string) (string, error) {
+	p.mu.RLock()
+	filters := append(append([]chatFilter(nil), p.builtin...), p.filters...)
+	p.mu.RUnlock()
+
+	var err error
+	for _, f := range filters {
+		message, err = f.Filter(cli, message)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if message == "" {
+		return "", errMessageEmpty
+	}
+	return message, nil
+}
+
+// filterChatMessage runs the chat filters and tells the sender when their message was rejected.
+func filterChatMessage(cli *client, message string) (string, bool) {
+	filtered, err := chatFilters.Run(cli, message)
+	if err != nil {
+		sendJSON(cli.conn, map[string]interface{}{
+			"type": "error",
+			"msg":  err.Error(),
+		})
+		return "", false
+	}
+	return filtered, true
+}
+
+// stripControlCharacters turns newlines and tabs into spaces and drops every
+// other control or invisible formatting character, so a message can never
+// break the line based protocol.
+func stripControlCharacters(_ *client, message string) (string, error) {
+	if !utf8.ValidString(message) {
+		message = strings.ToValidUTF8(message, "")
+	}
+
+	var b strings.Builder
+	for _, r := range message {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			b.WriteRune(' ')
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			continue
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+func maxLengthFilter(maxLength int) chatFilter {
+	return chatFilterFunc(func(_ *client, message string) (string, error) {
+		if utf8.RuneCountInString(message) > maxLength {
+			return "", fmt.Errorf("Message is too long (maximum %d characters)", maxLength)
+		}
+		return message, nil
+	})
+}
+
+func blockLinks(_ *client, message string) (string, error) {
+	if linkPattern.MatchString(message) {
+		return "", errLinksBlocked
+	}
+	return message, nil
+}
+
+// newWordMaskFilter replaces whole-word, case-insensitive matches of the listed words with asterisks.
+func newWordMaskFilter(words []string) chatFilter {
+	quoted := []string{}
+	for _, w := range words {
+		w = strings.TrimSpace(w)
+		if w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return chatFilterFunc(func(_ *client, message string) (string, error) { return message, nil })
+	}
+
+	pattern := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	return chatFilterFunc(func(_ *client, message string) (string, error) {
+		return pattern.ReplaceAllStringFunc(message, func(match string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(match))
+		}), nil
+	})
+}
+
+type spamFilter struct {
+	mu          sync.Mutex
+	repeatLimit int
+	window      time.Duration
+	recent      map[string][]spamEntry
+	// When users who went quiet were last dropped from recent
+	swept time.Time
+}
+
+type spamEntry struct {
+	message string
+	sentAt  time.Time
+}
+
+// newSpamFilter rejects a message once the sender has already sent it repeatLimit times within the window.
+func newSpamFilter(repeatLimit int, window time.Duration) *spamFilter {
+	return &spamFilter{
+		repeatLimit: repeatLimit,
+		window:      window,
+		recent:      make(map[string][]spamEntry),
+	}
+}
+
+func (f *spamFilter) Filter(cli *client, message string) (string, error) {
+	if cli == nil {
+		return message, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	normalized := strings.ToLower(message)
+	if now.Sub(f.swept) > f.window {
+		f.sweep(now)
+	}
+
+	kept := []spamEntry{}
+	repeats := 0
+	for _, e := range f.recent[cli.username] {
+		if now.Sub(e.sentAt) > f.window {
+			continue
+		}
+		kept = append(kept, e)
+		if e.message == normalized {
+			repeats++
+		}
+	}
+
+	if repeats >= f.repeatLimit {
+		f.recent[cli.username] = kept
+		return "", errRepeatedMessage
+	}
+
+	f.recent[cli.username] = append(kept, spamEntry{message: normalized, sentAt: now})
+	return message, nil
+}
+
+// sweep forgets the users who sent nothing within the window. Callers must hold f.mu.
+func (f *spamFilter) sweep(now time.Time) {
+	for username, sent := range f.recent {
+		if len(sent) == 0 || now.Sub(sent[len(sent)-1].sentAt) > f.window {
+			delete(f.recent, username)
+		}
+	}
+	f.swept = now
+}
+
+// loadWordList reads one word or phrase per line, ignoring blank lines and # comments.
+// A missing file yields an empty list.
+func loadWordList(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	words := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	return words, scanner.Err()
+}
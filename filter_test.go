@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatFilterPipeline(t *testing.T) {
+	cfg := defaultChatFilterConfig()
+	cfg.MaxLength = 20
+	cfg.Words = []string{"darn", "heck"}
+	pipeline := newChatFilterPipeline(cfg)
+	cli := &client{username: "filtered"}
+
+	cases := []struct {
+		input    string
+		expected string
+		rejected bool
+	}{
+		{input: "hello\nworld\r\n", expected: "hello world"},
+		{input: "bell\x07\x1b[31m", expected: "bell[31m"},
+		{input: "Darn it, HECK", expected: "**** it, ****"},
+		{input: "darned", expected: "darned"},
+		{input: strings.Repeat("a", 21), rejected: true},
+		{input: "visit www.example.org", rejected: true},
+		{input: "see https://x.y/z", rejected: true},
+		{input: "free gold at scam.com", rejected: true},
+		{input: " \x00\n", rejected: true},
+	}
+
+	for _, c := range cases {
+		got, err := pipeline.Run(cli, c.input)
+		if c.rejected {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected, got %q", c.input, got)
+			}
+			continue
+		}
+		if err != nil || got != c.expected {
+			t.Errorf("Filter(%q) = %q, %v; want %q", c.input, got, err, c.expected)
+		}
+	}
+}
+
+func TestChatFilterSpamDetection(t *testing.T) {
+	filter := newSpamFilter(2, 50*time.Millisecond)
+	cli := &client{username: "spammer"}
+
+	for i := 0; i < 2; i++ {
+		if _, err := filter.Filter(cli, "BUY NOW"); err != nil {
+			t.Fatalf("Message %d should have been allowed: %v", i+1, err)
+		}
+	}
+	if _, err := filter.Filter(cli, "buy now"); err != errRepeatedMessage {
+		t.Fatalf("Expected the third repeat to be rejected, got %v", err)
+	}
+	if _, err := filter.Filter(&client{username: "bystander"}, "buy now"); err != nil {
+		t.Fatalf("Other users should not be affected: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := filter.Filter(cli, "buy now"); err != nil {
+		t.Fatalf("Expected the message to be allowed after the window: %v", err)
+	}
+	if _, ok := filter.recent["bystander"]; ok || len(filter.recent) != 1 {
+		t.Fatalf("Expected users who went quiet to be forgotten, got %v", filter.recent)
+	}
+}
+
+func TestChatFilterCustomHook(t *testing.T) {
+	pipeline := newChatFilterPipeline(chatFilterConfig{})
+	errShouting := errors.New("No shouting")
+	pipeline.Use(chatFilterFunc(func(_ *client, message string) (string, error) {
+		if message == strings.ToUpper(message) {
+			return "", errShouting
+		}
+		return message, nil
+	}))
+
+	if _, err := pipeline.Run(nil, "HELLO"); err != errShouting {
+		t.Fatalf("Expected the custom filter to reject shouting, got %v", err)
+	}
+	if got, err := pipeline.Run(nil, "hello"); err != nil || got != "hello" {
+		t.Fatalf("Unexpected result: %q, %v", got, err)
+	}
+
+	// Reconfiguring the built-in filters keeps the custom ones
+	pipeline.configure(chatFilterConfig{MaxLength: 3})
+	if _, err := pipeline.Run(nil, "HI"); err != errShouting {
+		t.Fatalf("Expected the custom filter to survive a reload, got %v", err)
+	}
+	if _, err := pipeline.Run(nil, "hello"); err == nil || err == errShouting {
+		t.Fatalf("Expected the new length limit to apply, got %v", err)
+	}
+}
+
+func TestLongLineEndsConnection(t *testing.T) {
+	initGrid()
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(serverSide)
+		close(done)
+	}()
+	go io.Copy(ioutil.Discard, clientSide)
+
+	go func() {
+		clientSide.Write([]byte("rambler\n"))
+		clientSide.Write([]byte(strings.Repeat("a", maxLineLength+1) + "\n"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a line over the limit to end the connection")
+	}
+	if _, ok := clients.Load("rambler"); ok {
+		t.Fatalf("Expected the player to be gone")
+	}
+}
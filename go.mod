@@ -3,7 +3,8 @@ module github.com/Bioblaze/godot_mmo_server
 go 1.17
 
 require (
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
-	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/joho/godotenv v1.5.1
 )
+
+require github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
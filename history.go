@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of messages kept per channel
+	channelHistoryLimit = 100
+	// Number of messages returned per /history page
+	historyPageSize = 10
+	// History key used for /say messages, which are not tied to a channel
+	globalHistoryName = "global"
+)
+
+var globalHistory = newChatHistory(channelHistoryLimit)
+
+type chatEntry struct {
+	Username string    `json:"username"`
+	Message  string    `json:"message"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+// chatHistory is a bounded buffer of the most recent messages in a channel.
+type chatHistory struct {
+	mu      sync.Mutex
+	limit   int
+	entries []chatEntry
+}
+
+func newChatHistory(limit int) *chatHistory {
+	return &chatHistory{limit: limit}
+}
+
+// add records a message, dropping the oldest one once the buffer is full.
+func (h *chatHistory) add(username, message string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries = append(h.entries, chatEntry{
+		Username: username,
+		Message:  strings.TrimRight(message, "\r\n"),
+		SentAt:   time.Now(),
+	})
+	if len(h.entries) > h.limit {
+		h.entries = append([]chatEntry{}, h.entries[len(h.entries)-h.limit:]...)
+	}
+}
+
+// recent returns a copy of the last n messages, oldest first.
+func (h *chatHistory) recent(n int) []chatEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if n > len(h.entries) {
+		n = len(h.entries)
+	}
+	return append([]chatEntry{}, h.entries[len(h.entries)-n:]...)
+}
+
+// page returns one page of messages, oldest first, where page 1 holds the most
+// recent messages. It also returns the total number of pages.
+func (h *chatHistory) page(page, size int) ([]chatEntry, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pages := (len(h.entries) + size - 1) / size
+	if page < 1 || page > pages {
+		return []chatEntry{}, pages
+	}
+
+	end := len(h.entries) - (page-1)*size
+	start := end - size
+	if start < 0 {
+		start = 0
+	}
+	return append([]chatEntry{}, h.entries[start:end]...), pages
+}
+
+// historyFor looks up the history buffer for a channel name.
+func historyFor(name string) (*chatHistory, bool) {
+	if name == globalHistoryName {
+		return globalHistory, true
+	}
+	ch, ok := channels.Load(name)
+	if !ok {
+		return nil, false
+	}
+	return ch.(*channel).history, true
+}
+
+// replayHistory sends the buffered messages of a channel to a client that just joined it.
+func replayHistory(cli *client, ch *channel) {
+	sendJSON(cli.conn, map[string]interface{}{
+		"action":   "channel_history",
+		"channel":  ch.name,
+		"messages": ch.history.recent(historyPageSize),
+	})
+}
+
+// showHistory handles /history [channel] [page].
+func showHistory(cli *client, args []string) {
+	name := globalHistoryName
+	if cli.channel != nil {
+		name = cli.channel.name
+	}
+	page := 1
+
+	for _, arg := range args[1:] {
+		if n, err := strconv.Atoi(arg); err == nil {
+			page = n
+		} else if arg != "" {
+			name = strings.TrimPrefix(arg, "#")
+		}
+	}
+
+	history, ok := historyFor(name)
+	if !ok {
+		cli.conn.Write([]byte("Channel not found.\n"))
+		return
+	}
+
+	if name != globalHistoryName && (cli.channel == nil || cli.channel.name != name) {
+		cli.conn.Write([]byte("You can only view the history of the channel you are in.\n"))
+		return
+	}
+
+	messages, pages := history.page(page, historyPageSize)
+	sendJSON(cli.conn, map[string]interface{}{
+		"action":   "history",
+		"channel":  name,
+		"page":     page,
+		"pages":    pages,
+		"messages": messages,
+	})
+}
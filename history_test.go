@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChatHistoryBoundedAndPaged(t *testing.T) {
+	history := newChatHistory(25)
+	for i := 1; i <= 30; i++ {
+		history.add("talker", fmt.Sprintf("message %d\n", i))
+	}
+
+	if recent := history.recent(100); len(recent) != 25 || recent[0].Message != "message 6" {
+		t.Fatalf("Expected the oldest messages to be dropped, got %+v", recent)
+	}
+
+	first, pages := history.page(1, 10)
+	if pages != 3 || len(first) != 10 || first[0].Message != "message 21" || first[9].Message != "message 30" {
+		t.Fatalf("Unexpected first page (%d pages): %+v", pages, first)
+	}
+
+	last, _ := history.page(3, 10)
+	if len(last) != 5 || last[0].Message != "message 6" {
+		t.Fatalf("Unexpected last page: %+v", last)
+	}
+
+	if beyond, _ := history.page(4, 10); len(beyond) != 0 {
+		t.Fatalf("Expected an empty page past the end, got %+v", beyond)
+	}
+}
+
+func TestJoinChannelReplaysHistory(t *testing.T) {
+	initGrid()
+
+	talker, _ := newPipeClient(t, "talker", 0, 0)
+	joiner, joinerLines := newPipeClient(t, "joiner", 0, 0)
+
+	ch := &channel{name: "guild", history: newChatHistory(channelHistoryLimit)}
+	channels.Store(ch.name, ch)
+	defer channels.Delete(ch.name)
+
+	talker.channel = ch
+	ch.clients.Store(talker.username, talker)
+	chatChannel(talker, "anyone around?\n")
+
+	joinChannel(joiner, "guild")
+	<-joinerLines
+
+	replay := expectAction(t, joinerLines, "channel_history")
+	messages := replay["messages"].([]interface{})
+	if len(messages) != 1 || messages[0].(map[string]interface{})["message"] != "anyone around?" {
+		t.Fatalf("Unexpected replay: %+v", replay)
+	}
+}
+
+func TestWhisperToOfflineUserIsDeliveredAtLogin(t *testing.T) {
+	previous := mailboxes
+	mailboxes = newMailboxStore(filepath.Join(t.TempDir(), "mailbox.jsonl"))
+	defer func() { mailboxes = previous }()
+
+	initGrid()
+	sender, senderLines := newPipeClient(t, "sender", 0, 0)
+
+	whisper(sender, "sleeper", "see you tomorrow")
+	if receipt := expectReceipt(t, senderLines); receipt["status"] != "offline" {
+		t.Fatalf("Expected an offline receipt, got %+v", receipt)
+	}
+
+	reloaded := newMailboxStore(mailboxes.filename)
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("Failed to load mailboxes: %v", err)
+	}
+	if len(reloaded.boxes["sleeper"]) != 1 {
+		t.Fatalf("Expected the whisper to be stored on disk, got %+v", reloaded.boxes)
+	}
+
+	sleeper, sleeperLines := newPipeClient(t, "sleeper", 0, 0)
+	go deliverMailbox(sleeper)
+
+	var delivered map[string]interface{}
+	if err := json.Unmarshal([]byte(<-sleeperLines), &delivered); err != nil {
+		t.Fatalf("Failed to parse delivered whisper: %v", err)
+	}
+	if delivered["from"] != "sender" || delivered["message"] != "see you tomorrow" || delivered["offline"] != true {
+		t.Fatalf("Unexpected delivered whisper: %+v", delivered)
+	}
+
+	if messages, _ := mailboxes.collect("sleeper"); len(messages) != 0 {
+		t.Fatalf("Expected the mailbox to be emptied after delivery, got %+v", messages)
+	}
+}
+
+func TestMailboxLimits(t *testing.T) {
+	store := newMailboxStore(filepath.Join(t.TempDir(), "mailbox.jsonl"))
+
+	// A sender can only keep so many offline players waiting
+	for i := 0; i < mailboxSenderLimit; i++ {
+		if err := store.deposit(fmt.Sprintf("sleeper%d", i), "pest", "wake up"); err != nil {
+			t.Fatalf("Failed to leave a message: %v", err)
+		}
+	}
+	if err := store.deposit("sleeper0", "pest", "still asleep?"); err != nil {
+		t.Fatalf("Expected more messages to a waiting player to be kept, got %v", err)
+	}
+	if err := store.deposit("another", "pest", "hello"); err != errTooManyMailboxes {
+		t.Fatalf("Expected the sender to be limited, got %v", err)
+	}
+	if err := store.deposit("another", "friend", "hello"); err != nil {
+		t.Fatalf("Expected other senders not to be limited, got %v", err)
+	}
+
+	// Each message is appended to the file
+	data, err := ioutil.ReadFile(store.filename)
+	if err != nil {
+		t.Fatalf("Failed to read mailbox file: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != mailboxSenderLimit+2 {
+		t.Fatalf("Expected one line per message, got %d", lines)
+	}
+
+	// Deliveries are replayed on load
+	if _, err := store.collect("sleeper0"); err != nil {
+		t.Fatalf("Failed to collect mail: %v", err)
+	}
+	reloaded := newMailboxStore(store.filename)
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("Failed to load mailboxes: %v", err)
+	}
+	if len(reloaded.boxes) != mailboxSenderLimit || reloaded.total != mailboxSenderLimit || len(reloaded.boxes["sleeper0"]) != 0 {
+		t.Fatalf("Expected the delivered mail to stay delivered, got %+v", reloaded.boxes)
+	}
+
+	// The file is rewritten once most of it is delivered mail
+	for i := 1; i < mailboxSenderLimit; i++ {
+		store.collect(fmt.Sprintf("sleeper%d", i))
+	}
+	if data, _ := ioutil.ReadFile(store.filename); strings.Count(string(data), "\n") != 1 {
+		t.Fatalf("Expected only the waiting message left in the file, got:\n%s", data)
+	}
+
+	// And nobody can fill the disk
+	store.total = mailboxTotalLimit
+	if err := store.deposit("another", "friend", "hello"); err != errMailStorageIsFull {
+		t.Fatalf("Expected the total to be limited, got %v", err)
+	}
+}
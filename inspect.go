@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// Page size used when a listing request does not ask for one
+	defaultPageLimit = 50
+	// Largest page size a listing request may ask for
+	maxPageLimit = 500
+	// Largest number of cells a single region request may cover
+	maxRegionCells = 10000
+)
+
+type PlayerInfo struct {
+	Username    string    `json:"username"`
+	X           int       `json:"x"`
+	Y           int       `json:"y"`
+	Channel     string    `json:"channel,omitempty"`
+	Muted       bool      `json:"muted"`
+	ConnectedAt time.Time `json:"connected_at"`
+	RemoteAddr  string    `json:"remote_addr"`
+}
+
+type ChannelInfo struct {
+	Name    string `json:"name"`
+	Title   string `json:"title"`
+	Members int    `json:"members"`
+}
+
+// page is the envelope returned by every paginated listing.
+type page struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Items  interface{} `json:"items"`
+}
+
+// parsePagination reads the offset and limit query parameters, noting invalid ones in errs.
+func parsePagination(r *http.Request, errs fieldErrors) (int, int) {
+	offset, limit := 0, defaultPageLimit
+	var err error
+
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			errs.add("offset", "must be a non-negative integer")
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxPageLimit {
+			errs.add("limit", "must be between 1 and %d", maxPageLimit)
+		}
+	}
+	return offset, limit
+}
+
+// pageBounds clamps an offset and limit to a slice of the given length.
+func pageBounds(total, offset, limit int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+func playerInfo(cli *client) PlayerInfo {
+	info := PlayerInfo{
+		Username:    cli.username,
+		X:           cli.x,
+		Y:           cli.y,
+		Muted:       isMuted(cli),
+		ConnectedAt: cli.connectedAt,
+	}
+	if cli.conn != nil {
+		info.RemoteAddr = cli.conn.RemoteAddr().String()
+	}
+	if cli.channel != nil {
+		info.Channel = cli.channel.name
+	}
+	return info
+}
+
+func listPlayersHandler(w http.ResponseWriter, r *http.Request) {
+	errs := fieldErrors{}
+	offset, limit := parsePagination(r, errs)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	players := []PlayerInfo{}
+	clients.Range(func(_, v interface{}) bool {
+		players = append(players, playerInfo(v.(*client)))
+		return true
+	})
+	sort.Slice(players, func(i, j int) bool { return players[i].Username < players[j].Username })
+
+	start, end := pageBounds(len(players), offset, limit)
+	writeAPIData(w, http.StatusOK, page{Total: len(players), Offset: offset, Limit: limit, Items: players[start:end]})
+}
+
+func getPlayerHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+
+	errs := fieldErrors{}
+	errs.required("username", username)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	v, ok := clients.Load(username)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, "User is not online")
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, playerInfo(v.(*client)))
+}
+
+func getRegionHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	errs := fieldErrors{}
+	bounds := map[string]int{"x": 0, "y": 0, "width": 1, "height": 1}
+	for name := range bounds {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs.add(name, "must be an integer")
+			continue
+		}
+		bounds[name] = n
+	}
+
+	for _, name := range []string{"width", "height"} {
+		if bounds[name] < 1 {
+			errs.add(name, "must be positive")
+		}
+	}
+	// Each side is bounded first, as the product of huge sides overflows
+	if len(errs) == 0 && (bounds["width"] > maxRegionCells || bounds["height"] > maxRegionCells/bounds["width"]) {
+		errs.add("width", "width times height must be at most %d", maxRegionCells)
+	}
+
+	offset, limit := parsePagination(r, errs)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	cells := regionCells(bounds["x"], bounds["y"], bounds["width"], bounds["height"])
+
+	start, end := pageBounds(len(cells), offset, limit)
+	writeAPIData(w, http.StatusOK, page{Total: len(cells), Offset: offset, Limit: limit, Items: cells[start:end]})
+}
+
+// regionCells describes the cells of a rectangle that lie inside the grid, row by row.
+func regionCells(x, y, width, height int) []CellInfo {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	cells := []CellInfo{}
+	for cy := y; cy < y+height; cy++ {
+		if cy < 0 || cy >= len(grid) {
+			continue
+		}
+		for cx := x; cx < x+width; cx++ {
+			if cx < 0 || cx >= len(grid[cy]) {
+				continue
+			}
+			info := CellInfo{
+				Type:    grid[cy][cx].Type,
+				Clients: []ClientInfo{},
+				X:       cx,
+				Y:       cy,
+			}
+			grid[cy][cx].Clients.Range(func(_, v interface{}) bool {
+				occupant := v.(*client)
+				info.Clients = append(info.Clients, ClientInfo{
+					Username: occupant.username,
+					X:        occupant.x,
+					Y:        occupant.y,
+				})
+				return true
+			})
+			if entities := cellEntitiesLocked(grid[cy][cx]); len(entities) > 0 {
+				info.Entities = entities
+			}
+			cells = append(cells, info)
+		}
+	}
+	return cells
+}
+
+func listChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	errs := fieldErrors{}
+	offset, limit := parsePagination(r, errs)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	list := []ChannelInfo{}
+	channels.Range(func(_, v interface{}) bool {
+		ch := v.(*channel)
+		info := ChannelInfo{Name: ch.name, Title: ch.title}
+		ch.clients.Range(func(_, _ interface{}) bool {
+			info.Members++
+			return true
+		})
+		list = append(list, info)
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	start, end := pageBounds(len(list), offset, limit)
+	writeAPIData(w, http.StatusOK, page{Total: len(list), Offset: offset, Limit: limit, Items: list[start:end]})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getJSON(t *testing.T, handler http.HandlerFunc, target string, into interface{}) int {
+	req := httptest.NewRequest("GET", target, nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&apiResponse{Data: into}); err != nil {
+			t.Fatalf("Failed to parse response of %s: %v", target, err)
+		}
+	}
+	return w.Code
+}
+
+func TestListPlayersPagination(t *testing.T) {
+	initGrid()
+	newPipeClient(t, "charlie", 0, 0)
+	newPipeClient(t, "alice", 1, 2)
+	newPipeClient(t, "bob", 3, 4)
+
+	var result struct {
+		Total int          `json:"total"`
+		Items []PlayerInfo `json:"items"`
+	}
+	if code := getJSON(t, listPlayersHandler, "/api/players?offset=1&limit=1", &result); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+	if result.Total != 3 || len(result.Items) != 1 || result.Items[0].Username != "bob" || result.Items[0].X != 3 {
+		t.Fatalf("Unexpected players page: %+v", result)
+	}
+
+	if code := getJSON(t, listPlayersHandler, "/api/players?limit=0", &result); code != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid limit to be rejected, got %d", code)
+	}
+}
+
+func TestGetPlayer(t *testing.T) {
+	initGrid()
+	newPipeClient(t, "alice", 1, 2)
+
+	var player PlayerInfo
+	if code := getJSON(t, getPlayerHandler, "/api/player?username=alice", &player); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+	if player.Username != "alice" || player.X != 1 || player.Y != 2 || player.RemoteAddr == "" {
+		t.Fatalf("Unexpected player: %+v", player)
+	}
+
+	if code := getJSON(t, getPlayerHandler, "/api/player?username=ghost", &player); code != http.StatusNotFound {
+		t.Fatalf("Expected status code %d, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestGetRegion(t *testing.T) {
+	initGrid()
+	grid[1][2].Type = Mountain
+	newPipeClient(t, "alice", 1, 1)
+
+	var result struct {
+		Total int        `json:"total"`
+		Items []CellInfo `json:"items"`
+	}
+	// The region hangs off the top-left edge, so only the four cells inside the grid are returned
+	if code := getJSON(t, getRegionHandler, "/api/region?x=-1&y=-1&width=3&height=3", &result); code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, code)
+	}
+	if result.Total != 4 {
+		t.Fatalf("Expected 4 cells, got %+v", result)
+	}
+
+	last := result.Items[3]
+	if last.X != 1 || last.Y != 1 || len(last.Clients) != 1 || last.Clients[0].Username != "alice" {
+		t.Fatalf("Unexpected occupied cell: %+v", last)
+	}
+
+	if code := getJSON(t, getRegionHandler, "/api/region?x=2&y=1", &result); code != http.StatusOK || result.Items[0].Type != Mountain {
+		t.Fatalf("Expected the single mountain cell, got %d %+v", code, result)
+	}
+	if code := getJSON(t, getRegionHandler, "/api/region?width=4294967296&height=4294967296", nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected a region whose size overflows to be refused, got %d", code)
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Component of an item entity holding what lies on the ground
+const itemComponent = "item"
+
+var items = newItemCatalog()
+
+var (
+	errUnknownItem     = errors.New("No item has this ID")
+	errInventoryFull   = errors.New("The inventory is full")
+	errNotEnoughItems  = errors.New("Not enough of the item")
+	errNothingToPickUp = errors.New("There is nothing to pick up here")
+	errNotNearby       = errors.New("The player is not nearby")
+)
+
+// Help of the item commands
+var itemHelp = []map[string]string{
+	{"command": "/inventory", "description": "List the items you carry."},
+	{"command": "/pickup [item]", "description": "Pick up the items, or the items of one kind, lying in your cell."},
+	{"command": "/drop [item] [count]", "description": "Drop items in your cell."},
+	{"command": "/give [username] [item] [count]", "description": "Give items to a player in or next to your cell."},
+}
+
+// itemDefinition is an item of the item file. Up to MaxStack of an item share
+// an inventory slot.
+type itemDefinition struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MaxStack    int    `json:"max_stack,omitempty"`
+}
+
+// itemCatalog holds the item definitions, by ID.
+type itemCatalog struct {
+	mu   sync.RWMutex
+	defs map[string]itemDefinition
+}
+
+// inventorySlot holds a stack of an item.
+type inventorySlot struct {
+	Item  string `json:"item"`
+	Count int    `json:"count"`
+}
+
+// inventory is the items a player carries, one stack per slot.
+type inventory []inventorySlot
+
+// groundItem is a stack of an item lying in a cell, the component of item entities.
+type groundItem struct {
+	Item  string `json:"item"`
+	Count int    `json:"count"`
+}
+
+// inventoryChange is the event of items entering or leaving an inventory.
+// Count is negative for items leaving it.
+type inventoryChange struct {
+	Username string `json:"username"`
+	Item     string `json:"item"`
+	Count    int    `json:"count"`
+	Reason   string `json:"reason"`
+	Actor    string `json:"actor"`
+}
+
+type inventoryInfo struct {
+	Username string    `json:"username"`
+	Capacity int       `json:"capacity"`
+	Items    inventory `json:"items"`
+}
+
+type itemGrantRequest struct {
+	Username string `json:"username"`
+	Item     string `json:"item"`
+	Count    int    `json:"count"`
+}
+
+func newItemCatalog() *itemCatalog {
+	return &itemCatalog{defs: make(map[string]itemDefinition)}
+}
+
+// load reads the item file. A missing file defines no items.
+func (ic *itemCatalog) load(filename string) error {
+	byteValue, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []itemDefinition
+	if err := json.Unmarshal(byteValue, &list); err != nil {
+		return err
+	}
+	defs := make(map[string]itemDefinition, len(list))
+	errs := fieldErrors{}
+	for i, def := range list {
+		field := fmt.Sprintf("[%d]", i)
+		errs.required(field+".id", def.ID)
+		errs.required(field+".name", def.Name)
+		if strings.ContainsAny(def.ID, " \t") {
+			errs.add(field+".id", "must not contain spaces")
+		}
+		if _, ok := defs[def.ID]; ok {
+			errs.add(field+".id", "is already used by another item")
+		}
+		if def.MaxStack < 0 {
+			errs.add(field+".max_stack", "must not be negative")
+		}
+		if def.MaxStack == 0 {
+			def.MaxStack = 1
+		}
+		defs[def.ID] = def
+	}
+	if len(errs) > 0 {
+		problems := []string{}
+		for field, problem := range errs {
+			problems = append(problems, field+" "+problem)
+		}
+		sort.Strings(problems)
+		return fmt.Errorf("invalid items: %s", strings.Join(problems, "; "))
+	}
+
+	ic.mu.Lock()
+	ic.defs = defs
+	ic.mu.Unlock()
+	return nil
+}
+
+func (ic *itemCatalog) get(id string) (itemDefinition, bool) {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+
+	def, ok := ic.defs[id]
+	return def, ok
+}
+
+// list returns the item definitions ordered by ID.
+func (ic *itemCatalog) list() []itemDefinition {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+
+	list := make([]itemDefinition, 0, len(ic.defs))
+	for _, def := range ic.defs {
+		list = append(list, def)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// itemName is the name of an item, or its ID when it is no longer defined.
+func itemName(id string) string {
+	if def, ok := items.get(id); ok {
+		return def.Name
+	}
+	return id
+}
+
+func (inv inventory) count(item string) int {
+	total := 0
+	for _, slot := range inv {
+		if slot.Item == item {
+			total += slot.Count
+		}
+	}
+	return total
+}
+
+// add returns the inventory with count more of an item, topping up stacks
+// before taking free slots, or errInventoryFull when they do not fit.
+func (inv inventory) add(def itemDefinition, count, capacity int) (inventory, error) {
+	next := append(inventory(nil), inv...)
+	for i := range next {
+		if count == 0 {
+			break
+		}
+		if next[i].Item == def.ID && next[i].Count < def.MaxStack {
+			n := min(count, def.MaxStack-next[i].Count)
+			next[i].Count += n
+			count -= n
+		}
+	}
+	for count > 0 {
+		if len(next) >= capacity {
+			return inv, errInventoryFull
+		}
+		n := min(count, def.MaxStack)
+		next = append(next, inventorySlot{Item: def.ID, Count: n})
+		count -= n
+	}
+	return next, nil
+}
+
+// remove returns the inventory with count less of an item, taken from the last
+// stacks first, or errNotEnoughItems when it does not hold that many.
+func (inv inventory) remove(item string, count int) (inventory, error) {
+	if inv.count(item) < count {
+		return inv, errNotEnoughItems
+	}
+	next := append(inventory(nil), inv...)
+	for i := len(next) - 1; i >= 0 && count > 0; i-- {
+		if next[i].Item == item {
+			n := min(count, next[i].Count)
+			next[i].Count -= n
+			count -= n
+		}
+	}
+
+	kept := next[:0]
+	for _, slot := range next {
+		if slot.Count > 0 {
+			kept = append(kept, slot)
+		}
+	}
+	return kept, nil
+}
+
+// nearby reports whether two players are in the same cell or next to each
+// other, diagonals included.
+func nearby(a, b *client) bool {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	return abs(a.x-b.x) <= 1 && abs(a.y-b.y) <= 1
+}
+
+// itemsChanged tells the players whose inventories changed and publishes the changes.
+func itemsChanged(changes ...inventoryChange) {
+	notified := make(map[string]bool)
+	for _, change := range changes {
+		serverLog.debug("inventory changed", "user", change.Username, "item", change.Item, "count", change.Count, "reason", change.Reason, "actor", change.Actor)
+		events.publish(EventInventoryChanged, change)
+		if !notified[change.Username] {
+			notified[change.Username] = true
+			sendInventory(change.Username)
+		}
+	}
+}
+
+// sendInventory sends a player their inventory, if they are online.
+func sendInventory(username string) {
+	v, ok := clients.Load(username)
+	if !ok {
+		return
+	}
+	info := inventoryInfoOf(username)
+	sendJSON(v.(*client).conn, map[string]interface{}{
+		"action":   "inventory",
+		"capacity": info.Capacity,
+		"items":    info.Items,
+	})
+}
+
+// changeItems adds count of an item to a player's inventory, or takes it away
+// when count is negative. Players do not have to be online.
+func changeItems(username, item string, count int, reason, actor string) error {
+	def, known := items.get(item)
+	if count > 0 && !known {
+		return errUnknownItem
+	}
+
+	err := playerData.update([]string{username}, func(records map[string]*playerRecord) error {
+		var next inventory
+		var err error
+		if count > 0 {
+			next, err = records[username].Inventory.add(def, count, currentConfig().InventorySlots)
+		} else {
+			next, err = records[username].Inventory.remove(item, -count)
+		}
+		records[username].Inventory = next
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	itemsChanged(inventoryChange{Username: username, Item: item, Count: count, Reason: reason, Actor: actor})
+	return nil
+}
+
+// pickupItems moves the items lying in a player's cell, or those of one item
+// when item is set, into their inventory. Stacks that do not fit stay on the ground.
+func pickupItems(cli *client, item string) ([]groundItem, error) {
+	gridMutex.RLock()
+	x, y := cli.x, cli.y
+	gridMutex.RUnlock()
+
+	found := false
+	picked := []groundItem{}
+	for _, e := range entitiesInRect(x, y, x, y) {
+		c, _ := e.component(itemComponent)
+		g, ok := c.(groundItem)
+		if !ok || (item != "" && g.Item != item) {
+			continue
+		}
+		found = true
+		def, ok := items.get(g.Item)
+		if !ok {
+			continue
+		}
+
+		if _, err := playerData.get(cli.username).Inventory.add(def, g.Count, currentConfig().InventorySlots); err != nil {
+			return picked, err
+		}
+		// Taken off the ground first, so only one of several players picking it up gets it
+		if _, err := removeEntity(e.ID); err != nil {
+			continue
+		}
+		if err := changeItems(cli.username, g.Item, g.Count, "pickup", cli.username); err != nil {
+			if spawnErr := spawnEntity(e, x, y); spawnErr != nil {
+				cli.log.error("failed to put back items", "item", g.Item, "count", g.Count, "err", spawnErr)
+			}
+			return picked, err
+		}
+		picked = append(picked, g)
+	}
+	if !found {
+		return nil, errNothingToPickUp
+	}
+	return picked, nil
+}
+
+// dropItems takes items out of a player's inventory and leaves them in their cell.
+func dropItems(cli *client, item string, count int) error {
+	if err := changeItems(cli.username, item, -count, "drop", cli.username); err != nil {
+		return err
+	}
+
+	gridMutex.RLock()
+	x, y := cli.x, cli.y
+	gridMutex.RUnlock()
+
+	e := newEntity(EntityItem, itemName(item))
+	e.setComponent(itemComponent, groundItem{Item: item, Count: count})
+	if err := spawnEntity(e, x, y); err != nil {
+		// The items go back rather than being lost
+		if restoreErr := changeItems(cli.username, item, count, "restore", cli.username); restoreErr != nil {
+			cli.log.error("failed to give back dropped items", "item", item, "count", count, "err", restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// giveItems moves items from one player's inventory to a nearby player's.
+func giveItems(from, to *client, item string, count int) error {
+	if !nearby(from, to) {
+		return errNotNearby
+	}
+	def, ok := items.get(item)
+	if !ok {
+		return errUnknownItem
+	}
+
+	err := playerData.update([]string{from.username, to.username}, func(records map[string]*playerRecord) error {
+		taken, err := records[from.username].Inventory.remove(item, count)
+		if err != nil {
+			return err
+		}
+		given, err := records[to.username].Inventory.add(def, count, currentConfig().InventorySlots)
+		if err != nil {
+			return fmt.Errorf("%s's inventory is full", to.username)
+		}
+		records[from.username].Inventory = taken
+		records[to.username].Inventory = given
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	itemsChanged(
+		inventoryChange{Username: from.username, Item: item, Count: -count, Reason: "give", Actor: from.username},
+		inventoryChange{Username: to.username, Item: item, Count: count, Reason: "give", Actor: from.username},
+	)
+	return nil
+}
+
+// itemUsage returns the usage line of an item command.
+func itemUsage(command string) string {
+	for _, h := range itemHelp {
+		if h["command"] == "/"+command || strings.HasPrefix(h["command"], "/"+command+" ") {
+			return fmt.Sprintf("Usage: %s\n", h["command"])
+		}
+	}
+	return ""
+}
+
+// itemCommand runs one of the inventory commands.
+func itemCommand(cli *client, command string, args []string) {
+	// Counts are optional and default to one
+	parseCount := func(args []string, i int) (int, bool) {
+		if len(args) <= i {
+			return 1, true
+		}
+		n, err := strconv.Atoi(args[i])
+		return n, err == nil && n > 0
+	}
+
+	var reply string
+	var err error
+	switch command {
+	case "inventory":
+		inv := playerData.get(cli.username).Inventory
+		if len(inv) == 0 {
+			reply = "Your inventory is empty.\n"
+			break
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "Inventory (%d/%d slots):\n", len(inv), currentConfig().InventorySlots)
+		for _, slot := range inv {
+			fmt.Fprintf(&b, " - %d x %s (%s)\n", slot.Count, itemName(slot.Item), slot.Item)
+		}
+		reply = b.String()
+
+	case "pickup":
+		item := ""
+		if len(args) > 0 {
+			item = args[0]
+		}
+		var picked []groundItem
+		picked, err = pickupItems(cli, item)
+		var b strings.Builder
+		for _, g := range picked {
+			fmt.Fprintf(&b, "Picked up %d %s.\n", g.Count, itemName(g.Item))
+		}
+		if err == errInventoryFull {
+			b.WriteString("Your inventory is full.\n")
+			err = nil
+		}
+		reply = b.String()
+
+	case "drop":
+		count, ok := parseCount(args, 1)
+		if len(args) < 1 || len(args) > 2 || !ok {
+			cli.conn.Write([]byte(itemUsage(command)))
+			return
+		}
+		err = dropItems(cli, args[0], count)
+		reply = fmt.Sprintf("Dropped %d %s.\n", count, itemName(args[0]))
+
+	case "give":
+		count, ok := parseCount(args, 2)
+		if len(args) < 2 || len(args) > 3 || !ok {
+			cli.conn.Write([]byte(itemUsage(command)))
+			return
+		}
+		v, online := clients.Load(args[0])
+		if !online || args[0] == cli.username {
+			reply = fmt.Sprintf("User '%s' not found.\n", args[0])
+			break
+		}
+		to := v.(*client)
+		err = giveItems(cli, to, args[1], count)
+		if err == nil {
+			reply = fmt.Sprintf("Gave %d %s to %s.\n", count, itemName(args[1]), to.username)
+			to.conn.Write([]byte(fmt.Sprintf("%s gave you %d %s.\n", cli.username, count, itemName(args[1]))))
+		}
+	}
+
+	if err != nil {
+		reply = fmt.Sprintf("Error: %v\n", err)
+	}
+	if reply != "" {
+		cli.conn.Write([]byte(reply))
+	}
+}
+
+func writeItemError(w http.ResponseWriter, err error) {
+	switch err {
+	case errUnknownItem:
+		writeFieldErrors(w, fieldErrors{"item": "is not a known item"})
+	case errInventoryFull, errNotEnoughItems:
+		writeAPIError(w, http.StatusConflict, ErrConflict, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+	}
+}
+
+func inventoryInfoOf(username string) inventoryInfo {
+	inv := playerData.get(username).Inventory
+	if inv == nil {
+		inv = inventory{}
+	}
+	return inventoryInfo{Username: username, Capacity: currentConfig().InventorySlots, Items: inv}
+}
+
+func listItemsHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIData(w, http.StatusOK, items.list())
+}
+
+func getInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+
+	errs := fieldErrors{}
+	errs.required("username", username)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, inventoryInfoOf(username))
+}
+
+func grantItemHandler(w http.ResponseWriter, r *http.Request) {
+	changeItemsHandler(w, r, 1, "grant")
+}
+
+func removeItemHandler(w http.ResponseWriter, r *http.Request) {
+	changeItemsHandler(w, r, -1, "remove")
+}
+
+// changeItemsHandler adds the requested items to an inventory, or takes them
+// away when sign is negative.
+func changeItemsHandler(w http.ResponseWriter, r *http.Request, sign int, reason string) {
+	var req itemGrantRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	errs.required("username", req.Username)
+	errs.required("item", req.Item)
+	if req.Count < 1 {
+		errs.add("count", "must be positive")
+	}
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	auditUsers(r, req.Username)
+
+	if err := changeItems(req.Username, req.Item, sign*req.Count, reason, apiSubject(r)); err != nil {
+		writeItemError(w, err)
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, inventoryInfoOf(req.Username))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// isolateItems gives a test its own item definitions and player store.
+func isolateItems(t *testing.T) {
+	previousItems, previousPlayers := items, playerData
+	t.Cleanup(func() { items, playerData = previousItems, previousPlayers })
+
+	dir := t.TempDir()
+	items = newItemCatalog()
+	filename := filepath.Join(dir, "items.json")
+	ioutil.WriteFile(filename, []byte(`[{"id": "apple", "name": "Apple", "max_stack": 10}, {"id": "sword", "name": "Sword"}]`), 0644)
+	if err := items.load(filename); err != nil {
+		t.Fatalf("Failed to load items: %v", err)
+	}
+	playerData = newPlayerStore(filepath.Join(dir, "players.json"))
+}
+
+func TestInventoryStacking(t *testing.T) {
+	apple := itemDefinition{ID: "apple", Name: "Apple", MaxStack: 10}
+	sword := itemDefinition{ID: "sword", Name: "Sword", MaxStack: 1}
+
+	inv, err := inventory{}.add(apple, 15, 2)
+	if err != nil || len(inv) != 2 || inv[0].Count != 10 || inv[1].Count != 5 {
+		t.Fatalf("Expected two stacks of apples, got %+v %v", inv, err)
+	}
+	if full, err := inv.add(sword, 1, 2); err != errInventoryFull || len(full) != 2 {
+		t.Fatalf("Expected a full inventory to be left unchanged, got %+v %v", full, err)
+	}
+	if topped, err := inv.add(apple, 5, 2); err != nil || topped[1].Count != 10 || inv[1].Count != 5 {
+		t.Fatalf("Expected the last stack to be topped up on a copy, got %+v %v", topped, err)
+	}
+
+	inv, err = inv.remove("apple", 7)
+	if err != nil || len(inv) != 1 || inv[0].Count != 8 {
+		t.Fatalf("Expected the last stack to be used up first, got %+v %v", inv, err)
+	}
+	if _, err := inv.remove("apple", 9); err != errNotEnoughItems {
+		t.Fatalf("Expected too many apples to be refused, got %v", err)
+	}
+}
+
+func TestItemCommands(t *testing.T) {
+	initGrid()
+	clearEntities(t)
+	isolateItems(t)
+
+	alice, aliceLines := newPipeClient(t, "alice", 5, 5)
+	alice.commandRateLimiter = newRateLimiter(100, time.Second)
+	bob, bobLines := newPipeClient(t, "bob", 6, 6)
+	bob.commandRateLimiter = newRateLimiter(100, time.Second)
+	newPipeClient(t, "carol", 20, 20)
+
+	var info inventoryInfo
+	if resp := postJSON(t, grantItemHandler, "/api/grantItem", `{"username": "alice", "item": "apple", "count": 3}`, &info); !resp.OK || info.Items.count("apple") != 3 {
+		t.Fatalf("Failed to grant items: %+v %+v", resp, info)
+	}
+	if msg := expectAction(t, aliceLines, "inventory"); len(msg["items"].([]interface{})) != 1 {
+		t.Fatalf("Expected alice to be sent her inventory, got %+v", msg)
+	}
+	if resp := postJSON(t, grantItemHandler, "/api/grantItem", `{"username": "alice", "item": "pear", "count": 1}`, nil); resp.Error == nil || resp.Error.Fields["item"] == "" {
+		t.Fatalf("Expected an unknown item to be refused, got %+v", resp)
+	}
+
+	// Dropped items lie in the cell until someone there picks them up
+	handleCommand(alice, "/drop apple 2\n")
+	expectLine(t, aliceLines, "Dropped 2 Apple.")
+	if found := entitiesInRect(5, 5, 5, 5); len(found) != 1 || found[0].Kind != EntityItem || found[0].Name != "Apple" {
+		t.Fatalf("Expected the apples on the ground, got %+v", found)
+	}
+	handleCommand(bob, "/pickup\n")
+	expectLine(t, bobLines, "Error: There is nothing to pick up here")
+	handleCommand(alice, "/pickup apple\n")
+	expectLine(t, aliceLines, "Picked up 2 Apple.")
+	if found := entitiesInRect(5, 5, 5, 5); len(found) != 0 {
+		t.Fatalf("Expected the apples to be picked up, got %+v", found)
+	}
+
+	// Items can only be given to players nearby
+	handleCommand(alice, "/give carol apple\n")
+	expectLine(t, aliceLines, "Error: The player is not nearby")
+	handleCommand(alice, "/give bob apple 3\n")
+	expectLine(t, aliceLines, "Gave 3 Apple to bob.")
+	expectLine(t, bobLines, "alice gave you 3 Apple.")
+	handleCommand(alice, "/inventory\n")
+	expectLine(t, aliceLines, "Your inventory is empty.")
+	handleCommand(bob, "/inventory\n")
+	expectLine(t, bobLines, " - 3 x Apple (apple)")
+
+	if resp := postJSON(t, removeItemHandler, "/api/removeItem", `{"username": "bob", "item": "apple", "count": 5}`, nil); resp.Error == nil || resp.Error.Code != ErrConflict {
+		t.Fatalf("Expected removing more than bob has to be refused, got %+v", resp)
+	}
+
+	// Inventories are kept in the player store
+	reloaded := newPlayerStore(playerData.filename)
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("Failed to load players: %v", err)
+	}
+	if n := reloaded.get("bob").Inventory.count("apple"); n != 3 {
+		t.Fatalf("Expected bob's apples to be saved, got %d", n)
+	}
+	var saved inventoryInfo
+	if code := getJSON(t, getInventoryHandler, "/api/inventory?username=bob", &saved); code != 200 || saved.Items.count("apple") != 3 {
+		t.Fatalf("Unexpected inventory %d %+v", code, saved)
+	}
+}
+
+func TestItemsSurviveFailures(t *testing.T) {
+	initGrid()
+	clearEntities(t)
+	isolateItems(t)
+	dana, _ := newPipeClient(t, "dana", 5, 5)
+	changeItems("dana", "apple", 3, "grant", "test")
+
+	// Items that cannot be dropped stay in the inventory
+	dana.x = gridWidth + 5
+	err := dropItems(dana, "apple", 2)
+	dana.x = 5
+	if err == nil || playerData.get("dana").Inventory.count("apple") != 3 {
+		t.Fatalf("Expected a failed drop to keep the items, got %v and %+v", err, playerData.get("dana").Inventory)
+	}
+
+	// Changes that cannot be saved are not kept
+	apple := newEntity(EntityItem, "Apple")
+	apple.setComponent(itemComponent, groundItem{Item: "apple", Count: 2})
+	if err := spawnEntity(apple, 5, 5); err != nil {
+		t.Fatalf("Failed to spawn apple: %v", err)
+	}
+	playerData.filename = filepath.Join(t.TempDir(), "missing", "players.json")
+	if err := changeItems("dana", "apple", 1, "grant", "test"); err == nil || playerData.get("dana").Inventory.count("apple") != 3 {
+		t.Fatalf("Expected an unsaved change to be rolled back, got %v", err)
+	}
+	if _, err := pickupItems(dana, ""); err == nil || playerData.get("dana").Inventory.count("apple") != 3 {
+		t.Fatalf("Expected an unsaved pickup to fail, got %v", err)
+	}
+	if _, ok := entities.Load(apple.ID); !ok {
+		t.Fatalf("Expected the apple to stay on the ground")
+	}
+}
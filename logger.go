@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type logLevel int32
+
+const (
+	LevelDebug logLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// Output formats of the server log
+const (
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+// Field names whose values never reach the log
+var logRedactedKeys = []string{"token", "secret", "password", "auth"}
+
+// Anything shaped like a JWT is redacted wherever it appears in a message or value
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+var (
+	logMu      sync.Mutex
+	logOutput  io.Writer = os.Stdout
+	logFormat            = LogFormatLogfmt
+	currentLog           = int32(LevelInfo)
+)
+
+// serverLog is the root logger. Connection goroutines log through a child
+// carrying their connection ID and username.
+var serverLog = &logger{}
+
+// logger writes levelled, structured lines. Fields are alternating keys and values.
+type logger struct {
+	fields []interface{}
+}
+
+type setLogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type logLevelInfo struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+func (l logLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for i, known := range logLevelNames {
+		if strings.EqualFold(name, known) {
+			return logLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+func getLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&currentLog))
+}
+
+func setLogLevel(level logLevel) {
+	atomic.StoreInt32(&currentLog, int32(level))
+}
+
+// with returns a child logger that adds the fields to every line.
+func (l *logger) with(keyvals ...interface{}) *logger {
+	if l == nil {
+		l = serverLog
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &logger{fields: fields}
+}
+
+func (l *logger) debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *logger) info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *logger) warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *logger) error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+func (l *logger) log(level logLevel, msg string, keyvals []interface{}) {
+	if level < getLogLevel() {
+		return
+	}
+	if l == nil {
+		l = serverLog
+	}
+
+	fields := []interface{}{"time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg}
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	if logFormat == LogFormatJSON {
+		fmt.Fprintln(logOutput, formatJSONLine(fields))
+	} else {
+		fmt.Fprintln(logOutput, formatLogfmtLine(fields))
+	}
+}
+
+// redactLogValue hides secrets by field name and JWTs by shape.
+func redactLogValue(key string, value interface{}) interface{} {
+	lower := strings.ToLower(key)
+	for _, name := range logRedactedKeys {
+		if strings.Contains(lower, name) {
+			return "[REDACTED]"
+		}
+	}
+
+	switch v := value.(type) {
+	case error:
+		return jwtPattern.ReplaceAllString(v.Error(), "[REDACTED]")
+	case string:
+		return jwtPattern.ReplaceAllString(v, "[REDACTED]")
+	case fmt.Stringer:
+		return jwtPattern.ReplaceAllString(v.String(), "[REDACTED]")
+	}
+	return value
+}
+
+func formatLogfmtLine(fields []interface{}) string {
+	parts := []string{}
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		value := fmt.Sprint(redactLogValue(key, fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = fmt.Sprintf("%q", value)
+		}
+		parts = append(parts, key+"="+value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatJSONLine(fields []interface{}) string {
+	parts := []string{}
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		keyJSON, _ := json.Marshal(key)
+		valueJSON, err := json.Marshal(redactLogValue(key, fields[i+1]))
+		if err != nil {
+			valueJSON, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		parts = append(parts, string(keyJSON)+":"+string(valueJSON))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// configureLogging applies the LOG_LEVEL and LOG_FORMAT settings.
+func configureLogging(level, format string) {
+	if level != "" {
+		parsed, err := parseLogLevel(level)
+		if err != nil {
+			serverLog.warn("ignoring log level", "err", err)
+		} else {
+			setLogLevel(parsed)
+		}
+	}
+
+	switch strings.ToLower(format) {
+	case "":
+	case LogFormatJSON, LogFormatLogfmt:
+		logMu.Lock()
+		logFormat = strings.ToLower(format)
+		logMu.Unlock()
+	default:
+		serverLog.warn("ignoring log format", "format", format)
+	}
+}
+
+func getLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	logMu.Lock()
+	format := logFormat
+	logMu.Unlock()
+
+	writeAPIData(w, http.StatusOK, logLevelInfo{Level: getLogLevel().String(), Format: format})
+}
+
+func setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var req setLogLevelRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		writeFieldErrors(w, fieldErrors{"level": fmt.Sprintf("must be one of %s", strings.Join(logLevelNames, ", "))})
+		return
+	}
+
+	previous := getLogLevel()
+	setLogLevel(level)
+	serverLog.info("log level changed", "from", previous, "to", level, "actor", apiSubject(r))
+
+	getLogLevelHandler(w, r)
+}
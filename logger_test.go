@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLog redirects the server log into a buffer for the rest of the test.
+func captureLog(t *testing.T, format string) *bytes.Buffer {
+	var buf bytes.Buffer
+	logMu.Lock()
+	previousOutput, previousFormat := logOutput, logFormat
+	logOutput, logFormat = &buf, format
+	logMu.Unlock()
+
+	previousLevel := getLogLevel()
+	t.Cleanup(func() {
+		logMu.Lock()
+		logOutput, logFormat = previousOutput, previousFormat
+		logMu.Unlock()
+		setLogLevel(previousLevel)
+	})
+	return &buf
+}
+
+func TestLoggerLevelsAndFields(t *testing.T) {
+	buf := captureLog(t, LogFormatLogfmt)
+	setLogLevel(LevelInfo)
+
+	connLog := serverLog.with("conn", 7, "user", "alice")
+	connLog.debug("hidden")
+	connLog.info("moved to", "x", 3, "cell", "Grass Land")
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Fatalf("Debug line was written at info level: %s", out)
+	}
+	for _, part := range []string{"level=info", `msg="moved to"`, "conn=7", "user=alice", "x=3", `cell="Grass Land"`} {
+		if !strings.Contains(out, part) {
+			t.Errorf("Missing %s in %q", part, out)
+		}
+	}
+}
+
+func TestLoggerRedactsSecrets(t *testing.T) {
+	buf := captureLog(t, LogFormatJSON)
+	setLogLevel(LevelDebug)
+
+	token := createTestJWT()
+	serverLog.info("login "+token, "token", "abc", "api_secret", "xyz", "input", "user "+token)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Expected a JSON log line, got %q: %v", buf.String(), err)
+	}
+	if strings.Contains(buf.String(), token) || strings.Contains(buf.String(), "xyz") {
+		t.Fatalf("Secrets leaked into the log: %s", buf.String())
+	}
+	if line["token"] != "[REDACTED]" || line["input"] != "user [REDACTED]" || line["level"] != "info" {
+		t.Fatalf("Unexpected log line: %v", line)
+	}
+}
+
+func TestSetLogLevelHandler(t *testing.T) {
+	captureLog(t, LogFormatLogfmt)
+	setLogLevel(LevelInfo)
+
+	req := httptest.NewRequest("POST", "/api/setLogLevel", strings.NewReader(`{"level": "DEBUG"}`))
+	w := httptest.NewRecorder()
+	setLogLevelHandler(w, req)
+
+	var info logLevelInfo
+	if err := json.NewDecoder(w.Body).Decode(&apiResponse{Data: &info}); err != nil || w.Code != http.StatusOK || info.Level != "debug" {
+		t.Fatalf("Unexpected response %d %+v (%v)", w.Code, info, err)
+	}
+	if getLogLevel() != LevelDebug {
+		t.Fatalf("Log level was not changed")
+	}
+
+	req = httptest.NewRequest("POST", "/api/setLogLevel", strings.NewReader(`{"level": "loud"}`))
+	w = httptest.NewRecorder()
+	setLogLevelHandler(w, req)
+	if w.Code != http.StatusBadRequest || getLogLevel() != LevelDebug {
+		t.Fatalf("Expected an unknown level to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	mailboxFilename = "mailbox.jsonl"
+	// Maximum number of undelivered whispers kept for a single user
+	mailboxLimit = 50
+	// Maximum number of offline users a single sender can have whispers waiting for
+	mailboxSenderLimit = 10
+	// Maximum number of undelivered whispers kept for everyone
+	mailboxTotalLimit = 10000
+)
+
+var mailboxes = newMailboxStore(mailboxFilename)
+
+var (
+	errMailboxFull       = errors.New("mailbox is full")
+	errTooManyMailboxes  = errors.New("too many offline players are already waiting on your messages")
+	errMailStorageIsFull = errors.New("no more messages can be stored")
+)
+
+type mailMessage struct {
+	From    string    `json:"from"`
+	Message string    `json:"message"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// mailRecord is a line of the mailbox file: either a message left for To, or
+// the messages of Collected being delivered.
+type mailRecord struct {
+	To        string       `json:"to,omitempty"`
+	Mail      *mailMessage `json:"mail,omitempty"`
+	Collected string       `json:"collected,omitempty"`
+}
+
+// mailboxStore keeps whispers sent to offline users until their next login.
+// Deposits and deliveries are appended to the file, which is rewritten with
+// only the waiting messages once most of it is delivered mail.
+type mailboxStore struct {
+	mu       sync.Mutex
+	filename string
+	boxes    map[string][]mailMessage
+	// Number of messages waiting in all the boxes
+	total int
+	// Number of lines in the file
+	records int
+}
+
+func newMailboxStore(filename string) *mailboxStore {
+	return &mailboxStore{
+		filename: filename,
+		boxes:    make(map[string][]mailMessage),
+	}
+}
+
+// load replays the mailbox file. A missing file is not an error.
+func (ms *mailboxStore) load() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	file, err := os.Open(ms.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record mailRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return err
+		}
+		ms.apply(record)
+		ms.records++
+	}
+	return scanner.Err()
+}
+
+// apply adds a record of the file to the boxes. Callers must hold ms.mu.
+func (ms *mailboxStore) apply(record mailRecord) {
+	if record.Mail != nil {
+		ms.boxes[record.To] = append(ms.boxes[record.To], *record.Mail)
+		ms.total++
+	}
+	if record.Collected != "" {
+		ms.total -= len(ms.boxes[record.Collected])
+		delete(ms.boxes, record.Collected)
+	}
+}
+
+// append writes records to the end of the file. Callers must hold ms.mu.
+func (ms *mailboxStore) append(records ...mailRecord) error {
+	var data []byte
+	for _, record := range records {
+		jsonData, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, jsonData...), '\n')
+	}
+
+	file, err := os.OpenFile(ms.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	ms.records += len(records)
+	return nil
+}
+
+// compact rewrites the file with only the waiting messages once delivered
+// mail makes up most of it. Callers must hold ms.mu.
+func (ms *mailboxStore) compact() error {
+	if ms.records <= 2*ms.total {
+		return nil
+	}
+
+	records := []mailRecord{}
+	for to, messages := range ms.boxes {
+		for i := range messages {
+			records = append(records, mailRecord{To: to, Mail: &messages[i]})
+		}
+	}
+	var data []byte
+	for _, record := range records {
+		jsonData, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, jsonData...), '\n')
+	}
+
+	// Written aside first so a failure leaves the old file whole
+	tmp := ms.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ms.filename); err != nil {
+		return err
+	}
+	ms.records = len(records)
+	return nil
+}
+
+// deposit stores a message for an offline user.
+func (ms *mailboxStore) deposit(to, from, message string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if len(ms.boxes[to]) >= mailboxLimit {
+		return errMailboxFull
+	}
+	if ms.total >= mailboxTotalLimit {
+		return errMailStorageIsFull
+	}
+	if !ms.waitingFrom(to, from) && ms.recipientsOf(from) >= mailboxSenderLimit {
+		return errTooManyMailboxes
+	}
+
+	record := mailRecord{To: to, Mail: &mailMessage{
+		From:    from,
+		Message: message,
+		SentAt:  time.Now(),
+	}}
+	if err := ms.append(record); err != nil {
+		return err
+	}
+	ms.apply(record)
+	return nil
+}
+
+// waitingFrom tells whether the user has a message from the sender waiting.
+// Callers must hold ms.mu.
+func (ms *mailboxStore) waitingFrom(to, from string) bool {
+	for _, m := range ms.boxes[to] {
+		if m.From == from {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientsOf counts the users with a message from the sender waiting.
+// Callers must hold ms.mu.
+func (ms *mailboxStore) recipientsOf(from string) int {
+	count := 0
+	for to := range ms.boxes {
+		if ms.waitingFrom(to, from) {
+			count++
+		}
+	}
+	return count
+}
+
+// collect removes and returns every message waiting for the user.
+func (ms *mailboxStore) collect(username string) ([]mailMessage, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	messages, ok := ms.boxes[username]
+	if !ok {
+		return nil, nil
+	}
+
+	// The messages are delivered even when that cannot be written down, at
+	// worst they are delivered again after a restart
+	err := ms.append(mailRecord{Collected: username})
+	ms.apply(mailRecord{Collected: username})
+	if err != nil {
+		return messages, err
+	}
+	return messages, ms.compact()
+}
+
+// deliverMailbox sends the whispers that arrived while the client was offline.
+func deliverMailbox(cli *client) {
+	messages, err := mailboxes.collect(cli.username)
+	if err != nil {
+		serverLog.error("failed to save mailbox", "err", err)
+	}
+
+	for _, m := range messages {
+		sendJSON(cli.conn, map[string]interface{}{
+			"type":    "whisper",
+			"from":    m.From,
+			"message": m.Message,
+			"sent_at": m.SentAt.UTC().Format(time.RFC3339),
+			"offline": true,
+		})
+	}
+}
@@ -6,20 +6,20 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	//"github.com/dgrijalva/jwt-go"
 	"github.com/golang-jwt/jwt"
-	"github.com/joho/godotenv"
 )
 
 const (
@@ -28,31 +28,48 @@ const (
 	Grass CellType = "Grass"
 	Water CellType = "Water"
 )
+// cellTypes lists every valid cell type
+var cellTypes = []CellType{Empty, Mountain, Grass, Water}
+
 var clients sync.Map
+var errUserOffline = errors.New("User is not online")
+// Connection IDs tie together the log lines of one client
+var nextConnID uint64
+// Longest line a client may send, in bytes, session tokens included
+const maxLineLength = 16 * 1024
 var channels sync.Map
-const serverjwtSecret = "your_jwt_secret1"
 var loadedUsers = make(map[string]LoadUserRequest)
-var defaultSleepDelay = 3 * time.Second
-const mapFilename = "map.json"
 var grid [][]*Cell
-var gridHeight = 25
-var gridWidth = 25
-const apijwtSecret = "your_jwt_secret2"
 var gridMutex sync.RWMutex
-var serverName = "TestServer1"
+// Copies of the configured settings, kept in step by applyConfig
+var serverjwtSecret = config.ServerSecret
+var apijwtSecret = config.APISecret
+var serverName = config.ServerName
+var mapFilename = config.MapFile
+var defaultSleepDelay = time.Duration(config.SleepDelay)
+
+// Size of the current map, kept in step with grid
+var gridHeight = config.GridHeight
+var gridWidth = config.GridWidth
 var stopChan chan struct{}
+var stopOnce sync.Once
+var serverListener net.Listener
 
 type client struct {
 	conn     net.Conn
 	username string
 	channel    *channel
-	muted    bool
 	x        int
 	y        int
 	commandRateLimiter *rateLimiter
 	sleepDelay time.Duration
 	mutedUsernames map[string]bool
 	kicked              bool
+	ip       string
+	chatRateLimiters map[string]*rateLimiter
+	connectedAt time.Time
+	log         *logger
+	roles       []string
 }
 
 type ClientInfo struct {
@@ -64,18 +81,48 @@ type ClientInfo struct {
 type addCellRequest struct {
 	X    int      `json:"x"`
 	Y    int      `json:"y"`
-	Type CellType `json:"type"`
+	Type CellType `json:"type,omitempty"`
 }
 
 type CellType string
 
+func isCellType(t CellType) bool {
+	for _, known := range cellTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// isWalkable reports whether players may move onto cells of the given type.
+func isWalkable(t CellType) bool {
+	for _, walkable := range currentConfig().WalkableCells {
+		if t == walkable {
+			return true
+		}
+	}
+	return false
+}
+
+func cellTypeNames() []string {
+	names := []string{}
+	for _, t := range cellTypes {
+		names = append(names, string(t))
+	}
+	return names
+}
+
 type travelClaims struct {
 	jwt.StandardClaims
 	ServerName string `json:"server_name"`
 	Username   string `json:"username"`
+	// Roles granted to the player in game, such as builder
+	Roles []string `json:"roles,omitempty"`
 }
 
 type rateLimiter struct {
+	mu               sync.Mutex
 	tokens           int
 	maxTokens        int
 	tokenFillRate    time.Duration
@@ -85,6 +132,8 @@ type rateLimiter struct {
 type Cell struct {
 	Type    CellType
 	Clients sync.Map
+	// NPCs, items and objects on the cell, by ID
+	Entities sync.Map `json:"-"`
 }
 
 type CellInfo struct {
@@ -92,6 +141,7 @@ type CellInfo struct {
 	Clients []ClientInfo `json:"clients"`
 	X		int			 `json:"x"`
 	Y		int			 `json:"y"`
+	Entities []EntityInfo `json:"entities,omitempty"`
 }
 
 type deleteCellRequest struct {
@@ -118,7 +168,7 @@ type LoadUserRequest struct {
 type sendMessagePayload struct {
 	FromUsername string `json:"from_username"`
 	ToUsername   string `json:"to_username"`
-	FromServer   string `json:"from_server"`
+	FromServer   string `json:"from_server,omitempty"`
 	Message      string `json:"message"`
 }
 
@@ -127,20 +177,42 @@ type kickUsersInCellRequest struct {
 	Y int `json:"y"`
 }
 
+// moveUserPayload moves a user to the cell at X, Y.
 type moveUserPayload struct {
 	Username string `json:"username"`
 	X        int    `json:"x"`
 	Y        int    `json:"y"`
 }
 
+type kickUserRequest struct {
+	Username string `json:"username"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type announcementRequest struct {
+	Message string `json:"message"`
+}
+
+type cellMessageRequest struct {
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Message string `json:"message"`
+}
+
+type kickedUsers struct {
+	Usernames []string `json:"usernames"`
+}
+
 type channel struct {
 	name    string
 	title   string
 	clients sync.Map
+	history *chatHistory
 }
 
 type cellInfo struct {
-	X, Y int
+	X int `json:"x"`
+	Y int `json:"y"`
 }
 
 type priorityQueueItem struct {
@@ -153,60 +225,128 @@ type priorityQueue []*priorityQueueItem
 
 
 func init() {
+	// Settings from the config file and the environment. Flags are applied in main,
+	// since test binaries have their own.
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		serverLog.error("failed to load configuration", "err", err)
+		os.Exit(1)
+	}
+	applyConfig(cfg)
+	loadPeers(cfg.PeerServers)
+
+	loadWorld()
+
+	// Load the active mutes and bans
+	if err := moderation.load(); err != nil {
+		serverLog.error("failed to load sanctions", "err", err)
+	}
+
+	// Build the chat filters with the configured word list
+	words, err := loadWordList(cfg.ChatWordList)
+	if err != nil {
+		serverLog.error("failed to load chat word list", "err", err)
+	}
+	chatFilters.configure(cfg.chatFilterConfig(words))
+
+	// Load whispers waiting for offline users
+	if err := mailboxes.load(); err != nil {
+		serverLog.error("failed to load mailboxes", "err", err)
+	}
+
+	// Start delivering world events to the configured webhooks
+	if err := webhooks.load(); err != nil {
+		serverLog.error("failed to load webhooks", "err", err)
+	}
+	go webhooks.consume(events.subscribe(nil, 0))
+
+	// Load where new players join the map
+	if err := spawn.load(); err != nil {
+		serverLog.error("failed to load spawn point", "err", err)
+	}
+
+	// Load the saved map stamps
+	if err := stamps.load(); err != nil {
+		serverLog.error("failed to load stamps", "err", err)
+	}
+
+	// Load the item definitions and what players carry
+	if err := items.load(cfg.ItemFile); err != nil {
+		serverLog.error("failed to load items", "err", err)
+	}
+	if err := playerData.load(); err != nil {
+		serverLog.error("failed to load players", "err", err)
+	}
+}
+
+// loadWorld loads the map file, or creates an empty map when there is none.
+func loadWorld() {
 	// Check if the map file exists
 	if _, err := os.Stat(mapFilename); os.IsNotExist(err) {
 		// If the file does not exist, generate a new map
-		fmt.Println("Creating a empty Map, since no map was found..")
+		serverLog.info("no map found, creating an empty map", "file", mapFilename)
 		initGrid()
 	} else {
 		// If the file exists, load the map from the file
 		loadedGrid, err := loadMap(mapFilename)
 		if err != nil {
-			fmt.Printf("Error loading map from file: %v\n", err)
+			serverLog.error("failed to load map", "file", mapFilename, "err", err)
 			return
 		}
 		grid = loadedGrid
+		updateGridSize()
 	}
-	
-	// Load the .env file
-	err := godotenv.Load()
-	if err != nil {
-		fmt.Println("Error loading .env file:", err)
-	}
-
-	// Get the SERVER_NAME variable
-	serverName := os.Getenv("SERVER_NAME")
-	if serverName == "" {
-		fmt.Println("SERVER_NAME not set, using default value")
-		serverName = "default_server"
-	}
-
-	// Get the API_SECRET variable
-	apijwtSecret := os.Getenv("API_SECRET")
-	if apijwtSecret == "" {
-		fmt.Println("API_SECRET not set, using default value")
-		apijwtSecret = "default_api_secret"
-	}
-
-	// Get the SERVER_SECRET variable
-	serverjwtSecret := os.Getenv("SERVER_SECRET")
-	if serverjwtSecret == "" {
-		fmt.Println("SERVER_SECRET not set, using default value")
-		serverjwtSecret = "default_server_secret"
-	}
-
-
 }
 
 func main() {
+	// Command line flags take precedence over the config file and the environment
+	if len(os.Args) > 1 {
+		cfg, err := loadConfig(os.Args[1:])
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		if err != nil {
+			serverLog.error("failed to load configuration", "err", err)
+			os.Exit(1)
+		}
+		previous := currentConfig()
+		applyConfig(cfg)
+		if cfg.MapFile != previous.MapFile || cfg.GridWidth != previous.GridWidth || cfg.GridHeight != previous.GridHeight {
+			loadWorld()
+		}
+		words, err := loadWordList(cfg.ChatWordList)
+		if err != nil {
+			serverLog.error("failed to load chat word list", "err", err)
+		}
+		chatFilters.configure(cfg.chatFilterConfig(words))
+		loadPeers(cfg.PeerServers)
+		configArgs = os.Args[1:]
+	}
+
     stopChan = make(chan struct{})
+	go watchReloadSignal()
 
 	go startAPI()
 
-	os := runtime.GOOS
-    switch os {
+	// Spawn the NPCs and start moving them
+	if _, err := npcs.load(currentConfig().NPCFile); err != nil {
+		serverLog.error("failed to load NPCs", "err", err)
+	}
+	go npcs.run(stopChan)
+
+	cfg := currentConfig()
+	if cfg.ConsoleSocket != "" {
+		if err := startConsoleSocket(cfg.ConsoleSocket); err != nil {
+			serverLog.error("failed to start operator console", "err", err)
+		}
+	}
+	if cfg.Console {
+		go runStdinConsole()
+	}
+
+    switch runtime.GOOS {
     case "windows":
-        fmt.Println("Windows not setting max open files limit.")
+        serverLog.info("not setting max open files limit on windows")
     default:
 		// Set the maximum number of open files allowed by the system
 		/*
@@ -221,7 +361,8 @@ func main() {
 	
 	err := startServer()
 	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		serverLog.error("failed to start server", "err", err)
+		os.Exit(1)
 	}
 
     // Wait for a stop signal
@@ -229,24 +370,27 @@ func main() {
 }
 
 func startServer() error {
-	ln, err := net.Listen("tcp", ":6000")
+	addr := currentConfig().GameAddr
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
-	fmt.Println("Starting MMO server on :6000")
+	serverLog.info("starting game server", "addr", addr)
 	defer ln.Close()
+	serverListener = ln
 
 	for {
 		select {
 		case <-stopChan:
-			break
+			return nil
 		default:
 			conn, err := ln.Accept()
 			if err != nil {
-				log.Printf("Failed to accept connection: %v\n", err)
+				serverLog.error("failed to accept connection", "err", err)
 				continue
 			}
-			go handleConnection(conn)
+			metricConnectionsAccepted.inc()
+			go handleConnection(meteredConn{conn})
 		}
 	}
 }
@@ -272,43 +416,70 @@ func setMaxOpenFiles(limit uint64) error {
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	reader := bufio.NewReader(conn)
+	ip := remoteIP(conn)
+	connLog := serverLog.with("conn", atomic.AddUint64(&nextConnID, 1), "remote", ip)
 
-	input, err := reader.ReadString('\n')
-	if err != nil {
-		fmt.Println("Error reading input:", err)
+	// Lines longer than maxLineLength end the connection instead of being buffered
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineLength)
+
+	if !scanner.Scan() {
+		connLog.warn("connection closed before login", "err", scanner.Err())
+		metricConnectionsRejected.inc("no_login")
 		return
 	}
 
-	input = input[:len(input)-1] // Remove the newline character
-
-	fmt.Println(input)
+	input := scanner.Text()
 
-	// Try to decode the input as a session token
+	// Try to decode the input as a session token. Only signed tokens can grant roles.
+	var roles []string
 	serverName, username, err := decodeSessionToken(input)
-	if err != nil {
+	if claims, tokenErr := parseSessionToken(input); tokenErr == nil {
+		serverName, username, roles = claims.ServerName, claims.Username, claims.Roles
+	} else if err != nil {
 		// If decoding fails, treat the input as a regular username
 		username = input
 	}
+	connLog = connLog.with("user", username)
+
+	// Refuse banned users and addresses before they are registered
+	if ban, banned := moderation.find(SanctionBan, username, ip); banned {
+		connLog.info("rejected banned connection", "sanction", ban.ID)
+		metricConnectionsRejected.inc("banned")
+		sendJSON(conn, describeSanction(ban))
+		return
+	}
 
+	cfg := currentConfig()
 	cli := &client{
 		conn:     conn,
 		username: username,
-		commandRateLimiter: newRateLimiter(5, time.Second),
+		commandRateLimiter: newRateLimiter(cfg.CommandRateLimit, time.Duration(cfg.CommandRatePeriod)),
 		sleepDelay: defaultSleepDelay,
 		mutedUsernames: make(map[string]bool),
+		ip:       ip,
+		connectedAt: time.Now(),
+		log:      connLog,
+		roles:    roles,
 	}
 	clients.Store(cli.username, cli)
 	if loadedUser, ok := loadedUsers[username]; ok {
 		addToGridDirectly(cli, loadedUser.X, loadedUser.Y)
 		delete(loadedUsers, username)
 	} else {
-		fmt.Println("Not a Loaded User, adding directly to Grid")
-		addToGridDirectly(cli, 0, 0)
+		x, y := spawnCell()
+		connLog.debug("not a loaded user, adding at the spawn point", "x", x, "y", y)
+		addToGridDirectly(cli, x, y)
 	}
 
-	fmt.Println("Announcing the Map to the Client")
+	connLog.info("player connected", "transfer_from", serverName)
 	announceMap(cli)
+	if cfg.MOTD != "" {
+		sendJSON(cli.conn, map[string]interface{}{
+			"type": "motd",
+			"msg":  cfg.MOTD,
+		})
+	}
 
 	if serverName != "" {
 		announceEventJSON(cli, cli.username, "transferred", fmt.Sprintf("transferred from %s and joined the chat!", serverName))
@@ -316,20 +487,31 @@ func handleConnection(conn net.Conn) {
 		announceEventJSON(cli, cli.username, "joined", "joined the chat!")
 	}
 
+	announcePresence(cli.username, true)
+	deliverMailbox(cli)
+	sendInventory(cli.username)
+
 	defer func() {
 		clients.Delete(cli.username)
+		gridMutex.Lock()
+		if insideMapLocked(cli.x, cli.y) {
+			removeFromGrid(cli)
+		}
+		gridMutex.Unlock()
+		trades.cancel(cli.username, fmt.Sprintf("%s disconnected", cli.username))
+		announcePresence(cli.username, false)
+		if cli.channel != nil {
+			cli.channel.clients.Delete(cli.username)
+		}
 		if !cli.kicked {
 			announceEventJSON(cli, cli.username, "left", "left the chat!")
 		} else {
-			fmt.Println("User was kicked from the Server")
+			connLog.info("kicked player disconnected")
 		}
 	}()
 
-	for {
-		msg, err := reader.ReadString('\n')
-		if err != nil {
-			break
-		}
+	for scanner.Scan() {
+		msg := scanner.Text() + "\n"
 
 		// Check if the message starts with the command prefix
 		if len(msg) > 0 && msg[0] == '/' {
@@ -338,6 +520,9 @@ func handleConnection(conn net.Conn) {
 			echo(cli, msg)
 		}
 	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		connLog.warn("disconnected for sending a line that is too long", "limit", maxLineLength)
+	}
 }
 
 func announce(cli *client, action string) {
@@ -353,11 +538,17 @@ func announce(cli *client, action string) {
 }
 
 func echo(cli *client, msg string) {
-	if cli.muted {
+	if isMuted(cli) {
 		cli.conn.Write([]byte("You are muted and cannot send messages.\n"))
 		return
 	}
 
+	msg, ok := filterChatMessage(cli, msg)
+	if !ok {
+		return
+	}
+	msg += "\n"
+
 	if cli.channel != nil {
 		chatChannel(cli, msg)
 	} else {
@@ -378,6 +569,7 @@ func broadcast(cli *client) {
 
 func handleCommand(cli *client, msg string) {
 	if !cli.commandRateLimiter.isAllowed() {
+		metricRateLimited.inc("command")
 		cli.conn.Write([]byte("You are sending commands too fast. Please slow down.\n"))
 		return
 	}
@@ -386,15 +578,26 @@ func handleCommand(cli *client, msg string) {
 
 	args := strings.Split(msg, " ")
 	command := args[0]
+	// Unknown commands share a label so clients cannot create unbounded series
+	commandLabel := command
 
 	switch command {
 	case "say":
 		if len(args) < 2 {
 			cli.conn.Write([]byte("Usage: /say [message]\n"))
+		} else if isMuted(cli) {
+			cli.conn.Write([]byte("You are muted and cannot send messages.\n"))
 		} else {
 			message := strings.Join(args[1:], " ")
 			broadcastSay(cli, message)
 		}
+	case "local", "shout", "zone":
+		if len(args) < 2 {
+			cli.conn.Write([]byte(fmt.Sprintf("Usage: /%s [message]\n", command)))
+		} else {
+			message := strings.Join(args[1:], " ")
+			scopedChat(cli, command, message)
+		}
 		/*
 	case "msg":
 		if len(args) < 3 {
@@ -418,22 +621,6 @@ func handleCommand(cli *client, msg string) {
 		} else {
 			unmute(cli, args)
 		}
-	case "create":
-		if len(args) < 2 {
-			cli.conn.Write([]byte("Usage: /create [channel_name]\n"))
-		} else {
-			channelName := args[1]
-			createChannel(cli, channelName)
-		}
-	case "join":
-		if len(args) < 2 {
-			cli.conn.Write([]byte("Usage: /join [channel_name]\n"))
-		} else {
-			channelName := args[1]
-			joinChannel(cli, channelName)
-		}
-	case "part":
-		partChannel(cli)
 	case "setChannelTitle":
 		if len(args) < 2 {
 			cli.conn.Write([]byte("Usage: /setChannelTitle [title]\n"))
@@ -460,14 +647,6 @@ func handleCommand(cli *client, msg string) {
 		response := fmt.Sprintf("Travel token: %s\n", jwt)
 		cli.conn.Write([]byte(response))
 		
-	case "whisper":
-		if len(args) < 3 {
-			cli.conn.Write([]byte("Usage: /whisper [username] [message]\n"))
-		} else {
-			targetUsername := args[1]
-			message := strings.Join(args[2:], " ")
-			whisper(cli, targetUsername, message)
-		}
 	case "moveTo":
 		if len(args) < 3 {
 			cli.conn.Write([]byte("Usage: /moveTo [x] [y]\n"))
@@ -481,12 +660,48 @@ func handleCommand(cli *client, msg string) {
 			}
 		}
 		*/
+	case "create":
+		if len(args) < 2 {
+			cli.conn.Write([]byte("Usage: /create [channel_name]\n"))
+		} else {
+			channelName := args[1]
+			createChannel(cli, channelName)
+		}
+	case "join":
+		if len(args) < 2 {
+			cli.conn.Write([]byte("Usage: /join [channel_name]\n"))
+		} else {
+			channelName := args[1]
+			joinChannel(cli, channelName)
+		}
+	case "part":
+		partChannel(cli)
+	case "whisper":
+		if len(args) < 3 {
+			cli.conn.Write([]byte("Usage: /whisper [username] [message]\n"))
+		} else {
+			targetUsername := args[1]
+			message := strings.Join(args[2:], " ")
+			whisper(cli, targetUsername, message)
+		}
+	case "history":
+		showHistory(cli, args)
+	case "setcell", "fill", "spawnpoint":
+		builderCommand(cli, command, args[1:])
+	case "inventory", "pickup", "drop", "give":
+		itemCommand(cli, command, args[1:])
+	case "trade":
+		tradeCommand(cli, args[1:])
+	case "attack":
+		attackCommand(cli, args[1:])
 	case "help":
 		help(cli)
 	default:
+		commandLabel = "unknown"
 		response := fmt.Sprintf("Unknown command: /%s\n", msg)
 		cli.conn.Write([]byte(response))
 	}
+	metricCommands.inc(commandLabel)
 }
 
 func listUsers(cli *client) {
@@ -500,6 +715,11 @@ func listUsers(cli *client) {
 }
 
 func privateMessage(cli *client, targetUsername, message string) {
+	if isMuted(cli) {
+		cli.conn.Write([]byte("You are muted and cannot send messages.\n"))
+		return
+	}
+
 	targetClient, ok := clients.Load(targetUsername)
 	if !ok {
 		response := fmt.Sprintf("User '%s' not found.\n", targetUsername)
@@ -512,27 +732,34 @@ func privateMessage(cli *client, targetUsername, message string) {
 }
 
 func muteUserGlobal(cli *client, targetUsername string) {
-	targetClient, ok := clients.Load(targetUsername)
+	_, ok := clients.Load(targetUsername)
 	if !ok {
 		response := fmt.Sprintf("User '%s' not found.\n", targetUsername)
 		cli.conn.Write([]byte(response))
 		return
 	}
 
-	targetClient.(*client).muted = true
+	// Mutes are sanctions, so the one isMuted checks is the one recorded here
+	if _, err := muteUser(targetUsername, "", cli.username, 0); err != nil {
+		cli.conn.Write([]byte(fmt.Sprintf("Failed to mute '%s': %v\n", targetUsername, err)))
+		return
+	}
 	response := fmt.Sprintf("You have muted '%s'.\n", targetUsername)
 	cli.conn.Write([]byte(response))
 }
 
 func unmuteUserGlobal(cli *client, targetUsername string) {
-	targetClient, ok := clients.Load(targetUsername)
+	_, ok := clients.Load(targetUsername)
 	if !ok {
 		response := fmt.Sprintf("User '%s' not found.\n", targetUsername)
 		cli.conn.Write([]byte(response))
 		return
 	}
 
-	targetClient.(*client).muted = false
+	if _, err := unmuteUser(targetUsername); err != nil {
+		cli.conn.Write([]byte(fmt.Sprintf("Failed to unmute '%s': %v\n", targetUsername, err)))
+		return
+	}
 	response := fmt.Sprintf("You have unmuted '%s'.\n", targetUsername)
 	cli.conn.Write([]byte(response))
 }
@@ -545,7 +772,8 @@ func createChannel(cli *client, channelName string) {
 	}
 
 	newChannel := &channel{
-		name: channelName,
+		name:    channelName,
+		history: newChatHistory(channelHistoryLimit),
 	}
 	channels.Store(channelName, newChannel)
 	response := fmt.Sprintf("Channel '%s' created.\n", channelName)
@@ -566,6 +794,7 @@ func joinChannel(cli *client, channelName string) {
 	cli.channel = newChannel.(*channel)
 	response := fmt.Sprintf("You have joined the channel '%s'.\n", channelName)
 	cli.conn.Write([]byte(response))
+	replayHistory(cli, cli.channel)
 }
 
 func partChannel(cli *client) {
@@ -587,6 +816,8 @@ func chatChannel(cli *client, msg string) {
 		return
 	}
 
+	cli.channel.history.add(cli.username, msg)
+	events.publish(EventChatChannel, chatEvent{Username: cli.username, Message: msg, Channel: cli.channel.name, X: cli.x, Y: cli.y})
 	response := fmt.Sprintf("[#%s] %s: %s", cli.channel.name, cli.username, msg)
 	cli.channel.clients.Range(func(_, v interface{}) bool {
 		client := v.(*client)
@@ -609,9 +840,11 @@ func setChannelTitle(cli *client, title string) {
 }
 
 func moveClient(cli *client, dx, dy int) {
+	gridMutex.Lock()
 	newX, newY := cli.x+dx, cli.y+dy
 
-	if newX < 0 || newX >= gridWidth || newY < 0 || newY >= gridHeight {
+	if !insideMapLocked(newX, newY) {
+		gridMutex.Unlock()
 		sendJSON(cli.conn, map[string]interface{}{
 			"type": "error",
 			"msg":  "You cannot move outside the grid",
@@ -619,12 +852,18 @@ func moveClient(cli *client, dx, dy int) {
 		return
 	}
 
-	newCell := grid[newY][newX]
-	switch newCell.Type {
-	case Empty:
-		removeFromGrid(cli)
+	newType := grid[newY][newX].Type
+	if isWalkable(newType) {
+		if insideMapLocked(cli.x, cli.y) {
+			removeFromGrid(cli)
+		}
 		cli.x, cli.y = newX, newY
 		addToGrid(cli)
+	}
+	gridMutex.Unlock()
+
+	switch {
+	case isWalkable(newType):
 		response := struct {
 			Action string `json:"action"`
 			Username string `json:"username"`
@@ -645,7 +884,7 @@ func moveClient(cli *client, dx, dy int) {
 	
 		cli.conn.Write(append(jsonResponse, '\n'))
 		broadcastLocation(cli)
-	case Mountain:
+	case newType == Mountain:
 		sendJSON(cli.conn, map[string]interface{}{
 			"type": "error",
 			"msg":  "You cannot move onto a mountain",
@@ -669,25 +908,30 @@ func addToGrid(cli *client) {
 }
 
 func addToGridDirectly(cli *client, x int, y int) {
-	fmt.Printf("Adding to Grid X(%d) Y(%d)\n", x, y)
+	cli.log.debug("adding to grid", "x", x, "y", y)
+
+	gridMutex.Lock()
+	defer gridMutex.Unlock()
 
 	// Check if y is within the grid bounds
 	if y < 0 || y >= len(grid) {
-		fmt.Printf("Error: Y coordinate (%d) is out of range\n", y)
+		cli.log.error("y coordinate is out of range", "y", y)
 		return
 	}
 
 	// Check if x is within the grid bounds
 	if x < 0 || x >= len(grid[y]) {
-		fmt.Printf("Error: X coordinate (%d) is out of range\n", x)
+		cli.log.error("x coordinate is out of range", "x", x)
 		return
 	}
 
+	cli.x, cli.y = x, y
 	cell := grid[y][x]
 	cell.Clients.Store(cli.username, cli)
 }
 
 func announceMap(cli *client) {
+	gridMutex.RLock()
 	gridInfo := make([][]CellInfo, len(grid))
 	for i := range grid {
 		gridInfo[i] = make([]CellInfo, len(grid[i]))
@@ -706,10 +950,14 @@ func announceMap(cli *client) {
 				})
 				return true
 			})
+			if entities := cellEntitiesLocked(grid[i][j]); len(entities) > 0 {
+				cellInfo.Entities = entities
+			}
 
 			gridInfo[i][j] = cellInfo
 		}
 	}
+	gridMutex.RUnlock()
 
 	payload := struct {
 		Action       string    `json:"action"`
@@ -721,7 +969,7 @@ func announceMap(cli *client) {
 
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		fmt.Println("Error marshaling grid data:", err)
+		cli.log.error("failed to marshal map", "err", err)
 		return
 	}
 
@@ -750,7 +998,22 @@ func newRateLimiter(maxTokens int, fillRate time.Duration) *rateLimiter {
 	}
 }
 
+// setLimit changes the limits, keeping the tokens the client has left.
+func (rl *rateLimiter) setLimit(maxTokens int, fillRate time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.maxTokens = maxTokens
+	rl.tokenFillRate = fillRate
+	if rl.tokens > maxTokens {
+		rl.tokens = maxTokens
+	}
+}
+
 func (rl *rateLimiter) isAllowed() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	now := time.Now()
 	elapsedTime := now.Sub(rl.lastCheck)
 	rl.tokens += int(elapsedTime / rl.tokenFillRate)
@@ -768,33 +1031,18 @@ func (rl *rateLimiter) isAllowed() bool {
 }
 
 func broadcastLocation(cli *client) {
-	response := struct {
-		Action   string `json:"action"`
-		Username string `json:"username"`
-		X        int    `json:"x"`
-		Y        int    `json:"y"`
-	}{
-		Action:   "user_moved",
-		Username: cli.username,
-		X:        cli.x,
-		Y:        cli.y,
-	}
+	// Trades need both players to stay put
+	trades.cancel(cli.username, fmt.Sprintf("%s moved", cli.username))
+	publishPlayerEvent(EventPlayerMoved, cli, "")
+	broadcastEntityMoved(playerEntityInfo(cli), cli.username)
+}
 
-	jsonResponse, err := json.Marshal(response)
-	if err != nil {
+func broadcastSay(cli *client, message string) {
+	message, ok := filterChatMessage(cli, message)
+	if !ok {
 		return
 	}
 
-	clients.Range(func(_, v interface{}) bool {
-		client := v.(*client)
-		if client.username != cli.username {
-			client.conn.Write(append(jsonResponse, '\n'))
-		}
-		return true
-	})
-}
-
-func broadcastSay(cli *client, message string) {
 	response := struct {
 		Action   string `json:"action"`
 		Username string `json:"username"`
@@ -805,6 +1053,10 @@ func broadcastSay(cli *client, message string) {
 		Message: message,
 	}
 
+	defer observeBroadcast("say", time.Now())
+	globalHistory.add(cli.username, message)
+	events.publish(EventChatSay, chatEvent{Username: cli.username, Message: message, X: cli.x, Y: cli.y})
+
 	jsonResponse, err := json.Marshal(response)
 	if err != nil {
 		return
@@ -849,6 +1101,12 @@ func (pq *priorityQueue) Pop() interface{} {
 }
 
 func aStarPathfinding(start, target cellInfo, grid *[][]*Cell) []cellInfo {
+	return aStarPathfindingLimited(start, target, grid, 0)
+}
+
+// aStarPathfindingLimited gives up once it has looked at limit cells, when the
+// limit is above zero.
+func aStarPathfindingLimited(start, target cellInfo, grid *[][]*Cell, limit int) []cellInfo {
 	// Initialize the priority queue with the starting position
 	pq := &priorityQueue{}
 	heap.Init(pq)
@@ -864,7 +1122,10 @@ func aStarPathfinding(start, target cellInfo, grid *[][]*Cell) []cellInfo {
 		return abs(a.X-b.X) + abs(a.Y-b.Y)
 	}
 
-	for pq.Len() > 0 {
+	for visited := 0; pq.Len() > 0; visited++ {
+		if limit > 0 && visited >= limit {
+			break
+		}
 		current := heap.Pop(pq).(*priorityQueueItem).value
 
 		// If the target is reached, build the path and return it
@@ -886,7 +1147,7 @@ func aStarPathfinding(start, target cellInfo, grid *[][]*Cell) []cellInfo {
 
 		for _, neighbor := range neighbors {
 			// Skip if the neighbor is out of bounds or is not an "Empty" cell
-			if neighbor.X < 0 || neighbor.Y < 0 || neighbor.X >= len(*grid) || neighbor.Y >= len((*grid)[0]) || (*grid)[neighbor.X][neighbor.Y].Type != "Empty" {
+			if neighbor.X < 0 || neighbor.Y < 0 || neighbor.Y >= len(*grid) || neighbor.X >= len((*grid)[neighbor.Y]) || !isWalkable((*grid)[neighbor.Y][neighbor.X].Type) {
 				continue
 			}
 
@@ -910,27 +1171,63 @@ func abs(x int) int {
 	return x
 }
 
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func whisper(cli *client, targetUsername, message string) {
+	// Muted players can neither whisper nor leave mail
+	if isMuted(cli) {
+		cli.conn.Write([]byte("You are muted and cannot send messages.\n"))
+		return
+	}
+
+	message, ok := filterChatMessage(cli, message)
+	if !ok {
+		return
+	}
+
 	targetClient, ok := clients.Load(targetUsername)
 	if !ok {
-		response := fmt.Sprintf("User '%s' not found.\n", targetUsername)
-		cli.conn.Write([]byte(response))
+		// Asking the peers can take a while, so it must not hold up the sender's connection
+		go whisperRemote(cli, targetUsername, message)
 		return
 	}
 
-	whisperMessage := map[string]interface{}{
-		"type":     "whisper",
-		"from":     cli.username,
-		"message":  message,
+	sendJSON(targetClient.(*client).conn, whisperMessage(cli.username, serverName, message))
+	sendWhisperReceipt(cli, whisperReceipt{Delivered: true, To: targetUsername, Server: serverName, Status: "delivered"}, "Message sent.")
+}
+
+// whisperRemote delivers a whisper to a user who may be playing on another
+// server of the cluster, or leaves it in their mailbox.
+func whisperRemote(cli *client, targetUsername, message string) {
+	receipt := forwardWhisper(cli.username, targetUsername, message)
+	if receipt.Delivered {
+		sendWhisperReceipt(cli, receipt, "Message sent.")
+		return
 	}
-	jsonData, err := json.Marshal(whisperMessage)
+
+	// Keep the message until the user logs in again
+	err := mailboxes.deposit(targetUsername, cli.username, message)
 	if err != nil {
-		cli.conn.Write([]byte("Error encoding JSON.\n"))
+		sendWhisperReceipt(cli, receipt, fmt.Sprintf("Could not leave a message for '%s': %v", targetUsername, err))
 		return
 	}
+	sendWhisperReceipt(cli, receipt, fmt.Sprintf("User '%s' is offline. The message will be delivered when they log in.", targetUsername))
+}
 
-	targetClient.(*client).conn.Write(jsonData)
-	cli.conn.Write([]byte("Message sent.\n"))
+func sendWhisperReceipt(cli *client, receipt whisperReceipt, message string) {
+	sendJSON(cli.conn, map[string]interface{}{
+		"type":      "whisper_receipt",
+		"to":        receipt.To,
+		"server":    receipt.Server,
+		"status":    receipt.Status,
+		"delivered": receipt.Delivered,
+		"message":   message,
+	})
 }
 
 func decodeSessionToken(token string) (string, string, error) {
@@ -952,10 +1249,12 @@ func decodeSessionToken(token string) (string, string, error) {
 	return payload.ServerName, payload.Username, nil
 }
 
+// initGrid creates an empty map of the configured size.
 func initGrid() {
-	grid = make([][]*Cell, gridHeight)
+	cfg := currentConfig()
+	grid = make([][]*Cell, cfg.GridHeight)
 	for i := range grid {
-		grid[i] = make([]*Cell, gridWidth)
+		grid[i] = make([]*Cell, cfg.GridWidth)
 		for j := range grid[i] {
 			grid[i][j] = &Cell{
 				Type:    Empty, // Assign the default type for now
@@ -963,18 +1262,42 @@ func initGrid() {
 			}
 		}
 	}
+	updateGridSize()
+}
+
+// updateGridSize sets gridWidth and gridHeight from the current map. Callers must hold gridMutex.
+func updateGridSize() {
+	gridHeight = len(grid)
+	gridWidth = 0
+	if len(grid) > 0 {
+		gridWidth = len(grid[0])
+	}
 }
 
 func help(cli *client) {
 	helpMessages := []map[string]string{
 		{"command": "/help", "description": "Show this help message."},
+		{"command": "/say [message]", "description": "Send a message to everyone on the server."},
+		{"command": "/local [message]", "description": "Send a message to players in your cell."},
+		{"command": "/shout [message]", "description": "Send a message to players within a few cells of you."},
+		{"command": "/zone [message]", "description": "Send a message to players in your zone."},
 		{"command": "/whisper [username] [message]", "description": "Send a private message to the specified user."},
+		{"command": "/create [channel_name]", "description": "Create a chat channel."},
+		{"command": "/join [channel_name]", "description": "Join a chat channel and see its recent messages."},
+		{"command": "/part", "description": "Leave the current chat channel."},
+		{"command": "/history [channel] [page]", "description": "Show older messages of your channel, or of /say with 'global'."},
 		{"command": "/list", "description": "List all connected users."},
 		{"command": "/mute [username]", "description": "Mute the specified user."},
 		{"command": "/unmute [username]", "description": "Unmute the specified user."},
 		{"command": "/move [direction]", "description": "Move to an adjacent cell in the specified direction (north, east, south, or west)."},
 		{"command": "/travel", "description": "Generate a JWT to travel to another server."},
 		{"command": "/map", "description": "Show the current 2D grid map."},
+		{"command": "/attack [target]", "description": "Attack an NPC or creature in or next to your cell, by ID or name."},
+	}
+	helpMessages = append(helpMessages, itemHelp...)
+	helpMessages = append(helpMessages, tradeHelp...)
+	if cli.hasScope(ScopeMapEdit) {
+		helpMessages = append(helpMessages, builderHelp...)
 	}
 
 	helpData := map[string]interface{}{
@@ -1062,338 +1385,192 @@ func announceMove(cli *client, msg string) {
 func sendJSON(conn net.Conn, data interface{}) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		fmt.Println("Error marshaling JSON data:", err)
+		serverLog.error("failed to marshal message", "err", err)
 		return
 	}
 	conn.Write(append(jsonData, '\n'))
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
-	response := HealthResponse{Status: "OK"}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	writeAPIData(w, http.StatusOK, HealthResponse{Status: "OK"})
 }
 
 func loadUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
-
-	if jwterr != nil || !token.Valid {
-		fmt.Println("Invalid Token was received")
-		w.WriteHeader(http.StatusUnauthorized)
+	var req LoadUserRequest
+	if !decodeAPIRequest(w, r, &req) {
 		return
 	}
 
-	var req LoadUserRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	errs := fieldErrors{}
+	errs.required("username", req.Username)
+	if writeFieldErrors(w, errs) {
 		return
 	}
 
 	loadedUsers[req.Username] = req
-	w.WriteHeader(http.StatusOK)
+	auditUsers(r, req.Username)
+	auditCells(r, req.X, req.Y)
+	writeAPIData(w, http.StatusOK, req)
 }
 
 func startAPI() {
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/healthz", healthHandler)
-	http.HandleFunc("/api/loadUser", loadUserHandler)
-	http.HandleFunc("/api/kickUser", kickUserHandler)
-	http.HandleFunc("/api/sendAnnouncement", sendAnnouncementHandler)
-	http.HandleFunc("/api/kickAllUsers", kickAllUsersHandler)
-	http.HandleFunc("/api/sendMessageToUser", sendMessageToUserHandler)
-	http.HandleFunc("/api/moveUser", moveUserHandler)
-	http.HandleFunc("/api/sendMessageToCell", sendMessageToCellHandler)
-	http.HandleFunc("/api/muteUser", muteUserHandler)
-	http.HandleFunc("/api/saveMap", saveMapHandler)
-	http.HandleFunc("/api/loadMap", loadMapHandler)
-	http.HandleFunc("/api/addCell", addCellHandler)
-	http.HandleFunc("/api/deleteCell", deleteCellHandler)
-	http.HandleFunc("/api/kickAllUsersInCell", kickUsersInCellHandler)
-
-
-	fmt.Println("Starting API server on :5000")
-	http.ListenAndServe(":5000", nil)
+	registerAPIRoutes(http.DefaultServeMux, apiRoutes())
+
+	go registerWithPeers()
+
+	addr := currentConfig().APIAddr
+	serverLog.info("starting API server", "addr", addr)
+	http.ListenAndServe(addr, nil)
 }
 
 func kickUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	var req kickUserRequest
+	if !decodeAPIRequest(w, r, &req) {
 		return
 	}
 
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+	errs := fieldErrors{}
+	errs.required("username", req.Username)
+	if writeFieldErrors(w, errs) {
 		return
 	}
 
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
+	auditUsers(r, req.Username)
 
-	if jwterr != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
+	if err := kickUser(req.Username, req.Reason, apiSubject(r)); err != nil {
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, err.Error())
 		return
 	}
 
-	var req struct {
-		Username string `json:"username"`
-	}
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	kicked := false
-
-	// Iterate over the clients sync.Map to find the user and disconnect them
-	clients.Range(func(_, v interface{}) bool {
-		cli := v.(*client)
-		if cli.username == req.Username {
-			cli.kicked = true
-			// Send "you have been kicked" message to the kicked user
-			sendJSON(cli.conn, map[string]string{
-				"action":  "kicked",
-				"message": "You have been kicked.",
-			})
-
-			cli.conn.Close()
-			kicked = true
-			return false
-		}
-		return true
-	})
-
-	// Send an announcement to all connected clients that the user has been kicked
-	if kicked {
-		announcement := map[string]string{
-			"action":   "announcement",
-			"username": req.Username,
-			"message":  "has been kicked from the server.",
-		}
-		clients.Range(func(_, v interface{}) bool {
-			cli := v.(*client)
-			sendJSON(cli.conn, announcement)
-			return true
-		})
+	writeAPIData(w, http.StatusOK, apiMessage{Message: "User kicked"})
+}
 
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusNotFound)
+// kickUser disconnects an online user on behalf of an operator.
+func kickUser(username, reason, actor string) error {
+	v, ok := clients.Load(username)
+	if !ok {
+		return errUserOffline
 	}
+
+	cli := v.(*client)
+	serverLog.info("user kicked", "actor", actor, "user", cli.username, "reason", reason)
+	kickClient(cli, reason)
+	return nil
 }
 
 func sendAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	var req announcementRequest
+	if !decodeAPIRequest(w, r, &req) {
 		return
 	}
 
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+	errs := fieldErrors{}
+	errs.required("message", req.Message)
+	if writeFieldErrors(w, errs) {
 		return
 	}
 
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
-
-	if jwterr != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
+	sendAnnouncement(req.Message)
 
-	var req struct {
-		Message string `json:"message"`
-	}
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
+	writeAPIData(w, http.StatusOK, apiMessage{Message: "Announcement sent"})
+}
 
+// sendAnnouncement broadcasts a server announcement to all connected clients.
+func sendAnnouncement(message string) {
 	announcement := struct {
 		Action  string `json:"action"`
 		Message string `json:"message"`
 	}{
 		Action:  "announcement",
-		Message: req.Message,
+		Message: message,
 	}
 
-	// Broadcast the message to all connected clients
+	start := time.Now()
 	clients.Range(func(_, v interface{}) bool {
 		cli := v.(*client)
 		sendJSON(cli.conn, announcement)
 		return true
 	})
-
-	w.WriteHeader(http.StatusOK)
+	observeBroadcast("announcement", start)
 }
 
 func kickAllUsersHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	// Decode and verify the JWT
-	token, err := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
-
-	if err != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
+	kicked := kickedUsers{Usernames: []string{}}
 
 	// Iterate over the clients sync.Map and disconnect all users
 	clients.Range(func(_, v interface{}) bool {
 		cli := v.(*client)
+		auditUsers(r, cli.username)
+		kicked.Usernames = append(kicked.Usernames, cli.username)
 		cli.conn.Close()
 		return true
 	})
 
-	w.WriteHeader(http.StatusOK)
+	writeAPIData(w, http.StatusOK, kicked)
 }
 
 func sendMessageToUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	var payload sendMessagePayload
+	if !decodeAPIRequest(w, r, &payload) {
 		return
 	}
 
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+	errs := fieldErrors{}
+	errs.required("to_username", payload.ToUsername)
+	errs.required("message", payload.Message)
+	if writeFieldErrors(w, errs) {
 		return
 	}
 
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
+	auditUsers(r, payload.ToUsername)
 
-	if jwterr != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	receipt := whisperReceipt{Delivered: true, To: payload.ToUsername, Server: serverName, Status: "delivered"}
+	if !deliverLocalWhisper(payload) {
+		// Only route messages that originate here, so peers never bounce them back and forth
+		if payload.FromServer != "" && payload.FromServer != serverName {
+			receipt = whisperReceipt{Delivered: false, To: payload.ToUsername, Status: "offline"}
+		} else {
+			receipt = forwardWhisper(payload.FromUsername, payload.ToUsername, payload.Message)
+		}
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	var payload sendMessagePayload
-	err := decoder.Decode(&payload)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if !receipt.Delivered {
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, fmt.Sprintf("%s is not online on any server", payload.ToUsername))
 		return
 	}
-
-	toClient, ok := clients.Load(payload.ToUsername)
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	toCli := toClient.(*client)
-	sendJSON(toCli.conn, map[string]interface{}{
-		"action":       "private_message",
-		"from":       payload.FromUsername,
-		"fromServer": payload.FromServer,
-		"to": payload.ToUsername,
-		"message":    payload.Message,
-	})
-
-	w.WriteHeader(http.StatusOK)
+	writeAPIData(w, http.StatusOK, receipt)
 }
 
 func moveUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+	var payload moveUserPayload
+	if !decodeAPIRequest(w, r, &payload) {
 		return
 	}
 
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
-
-	if jwterr != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
+	errs := fieldErrors{}
+	errs.required("username", payload.Username)
+	if writeFieldErrors(w, errs) {
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	var payload moveUserPayload
-	err := decoder.Decode(&payload)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
+	auditUsers(r, payload.Username)
 
 	cli, ok := clients.Load(payload.Username)
 	if !ok {
-		w.WriteHeader(http.StatusNotFound)
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, "User is not online")
 		return
 	}
 
 	client := cli.(*client)
-
-	//if !isValidMove(client.x, client.y, payload.X, payload.Y) {
-	//	w.WriteHeader(http.StatusBadRequest)
-	//	return
-	//}
+	auditCells(r, payload.X, payload.Y)
 
 	// Move the user and announce to all connected clients
-	moveClient(client, payload.X, payload.Y)
+	if err := teleportClient(client, payload.X, payload.Y, false); err != nil {
+		writeTeleportError(w, err)
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
+	writeAPIData(w, http.StatusOK, playerInfo(client))
 }
 
 func isValidMove(currentX, currentY, targetX, targetY int) bool {
@@ -1402,8 +1579,8 @@ func isValidMove(currentX, currentY, targetX, targetY int) bool {
 		return false
 	}
 
-	// Check if the target cell is not a mountain cell
-	if grid[targetX][targetY].Type != Empty {
+	// Check if the target cell can be walked on
+	if !isWalkable(grid[targetX][targetY].Type) {
 		return false
 	}
 
@@ -1416,51 +1593,38 @@ func isValidMove(currentX, currentY, targetX, targetY int) bool {
 }
 
 func sendMessageToCellHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	var payload cellMessageRequest
+	if !decodeAPIRequest(w, r, &payload) {
 		return
 	}
 
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
+	gridMutex.RLock()
+	width, height := gridWidth, gridHeight
+	gridMutex.RUnlock()
 
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
-
-	if jwterr != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	// Check if coordinates are within the grid bounds
+	errs := fieldErrors{}
+	errs.required("message", payload.Message)
+	if payload.X < 0 || payload.X >= width {
+		errs.add("x", "must be between 0 and %d", width-1)
 	}
-
-	// Parse JSON payload
-	var payload struct {
-		X       int    `json:"x"`
-		Y       int    `json:"y"`
-		Message string `json:"message"`
+	if payload.Y < 0 || payload.Y >= height {
+		errs.add("y", "must be between 0 and %d", height-1)
 	}
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&payload)
-	if err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+	if writeFieldErrors(w, errs) {
 		return
 	}
 
-	// Check if coordinates are within the grid bounds
-	if payload.X < 0 || payload.Y < 0 || payload.X >= len(grid) || payload.Y >= len(grid[0]) {
-		http.Error(w, "Coordinates out of bounds", http.StatusBadRequest)
+	// Get the cell at the specified coordinates
+	gridMutex.RLock()
+	if !insideMapLocked(payload.X, payload.Y) {
+		gridMutex.RUnlock()
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, "Cell does not exist")
 		return
 	}
-
-	// Get the cell at the specified coordinates
-	cell := grid[payload.X][payload.Y]
+	cell := grid[payload.Y][payload.X]
+	gridMutex.RUnlock()
+	auditCells(r, payload.X, payload.Y)
 
 	// Send the message to all clients in the cell
 	cell.Clients.Range(func(_, v interface{}) bool {
@@ -1469,6 +1633,8 @@ func sendMessageToCellHandler(w http.ResponseWriter, r *http.Request) {
 		sendJSON(cli.conn, jsonMessage)
 		return true
 	})
+
+	writeAPIData(w, http.StatusOK, apiMessage{Message: "Message sent"})
 }
 
 func mute(cli *client, args []string) {
@@ -1504,377 +1670,254 @@ func unmute(cli *client, args []string) {
 }
 
 func muteUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	var payload sanctionRequest
+	if !decodeAPIRequest(w, r, &payload) {
 		return
 	}
 
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	errs := fieldErrors{}
+	errs.required("username", payload.Username)
+	if payload.DurationSeconds < 0 {
+		errs.add("duration_seconds", "must not be negative")
 	}
-
-	// Decode and verify the JWT
-	token, err := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
-
-	if err != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
+	if writeFieldErrors(w, errs) {
 		return
 	}
 
-	// Parse JSON payload
-	var payload struct {
-		Username string `json:"username"`
-	}
-	decoder := json.NewDecoder(r.Body)
-	perr := decoder.Decode(&payload)
-	if perr != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
-		return
-	}
+	auditUsers(r, payload.Username)
 
-	if payload.Username == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Missing username parameter"))
+	sanction, err := muteUser(payload.Username, payload.Reason, apiSubject(r), time.Duration(payload.DurationSeconds)*time.Second)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error saving sanctions: %v", err))
 		return
 	}
 
-	var userFound bool
-
-	clients.Range(func(_, v interface{}) bool {
-		client := v.(*client)
-		if client.username == payload.Username {
-			client.muted = true
-			userFound = true
-			return false
-		}
-		return true
-	})
-
-	if userFound {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("User muted"))
-	} else {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("User not found"))
-	}
+	writeAPIData(w, http.StatusOK, sanction)
 }
 
-func saveMapHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+// muteUser mutes a user for the duration, or until unmuted when it is zero.
+func muteUser(username, reason, moderator string, duration time.Duration) (*Sanction, error) {
+	// Mutes are recorded by username so they also apply after a reconnect
+	sanction, err := moderation.issue(SanctionMute, username, "", reason, moderator, duration)
+	if err != nil {
+		return nil, err
 	}
 
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	if v, ok := clients.Load(username); ok {
+		sendJSON(v.(*client).conn, describeSanction(sanction))
 	}
+	return sanction, nil
+}
 
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
+// saveCurrentMap writes the running map to the map file. The map is held
+// still while it is written.
+func saveCurrentMap() error {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
 
-	if jwterr != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
+	return saveMap(grid, mapFilename)
+}
 
-	err := saveMap(grid, "map.json")
+func saveMapHandler(w http.ResponseWriter, r *http.Request) {
+	err := saveCurrentMap()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Error saving map: %v", err)))
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error saving map: %v", err))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Map saved"))
+	writeAPIData(w, http.StatusOK, apiMessage{Message: "Map saved"})
 }
 
 func loadMapHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	if err := reloadMap(apiSubject(r)); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error loading map: %v", err))
 		return
 	}
 
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
-
-	if jwterr != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
+	writeAPIData(w, http.StatusOK, apiMessage{Message: "Map loaded and announced to clients"})
+}
 
-	newGrid, err := loadMap("map.json")
+// reloadMap replaces the map with the map file, moving players off cells they can
+// no longer stand on, and sends everyone the new map. The load can be undone.
+func reloadMap(author string) error {
+	newGrid, err := loadMap(mapFilename)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Error loading map: %v", err)))
-		return
+		return err
 	}
+	after := cellTypesOf(newGrid)
 
-	gridMutex.Lock()
-	grid = newGrid
-	gridMutex.Unlock()
-
-	clients.Range(func(_, v interface{}) bool {
-		client := v.(*client)
+	mapHistory.mu.Lock()
+	defer mapHistory.mu.Unlock()
 
-		// Check if the new cell is empty
-		if grid[client.x][client.y].Type != Empty {
-			// If not, find an adjacent empty cell
-			adjacentEmpty := false
-			for dx := -1; dx <= 1; dx++ {
-				for dy := -1; dy <= 1; dy++ {
-					newX, newY := client.x+dx, client.y+dy
-
-					if newX >= 0 && newX < len(grid) && newY >= 0 && newY < len(grid[0]) && grid[newX][newY].Type == Empty {
-						client.x, client.y = newX, newY
-						adjacentEmpty = true
-						break
-					}
-				}
-				if adjacentEmpty {
-					break
-				}
-			}
-			// If no adjacent empty cell is found, notify the client
-			if !adjacentEmpty {
-				client.conn.Write([]byte("Your position could not be updated due to an obstacle. Please reconnect.\n"))
-				client.conn.Close()
-				return true
-			}
-		}
+	gridMutex.RLock()
+	before := snapshotCellTypesLocked()
+	fromWidth, fromHeight := gridWidth, gridHeight
+	gridMutex.RUnlock()
 
-		announceMap(client)
-		return true
+	reshapeMap(after, 0, 0)
+	mapHistory.recordLocked(&mapHistoryEntry{
+		mapEdit:  mapEdit{ID: newMapEditID(), Kind: "load", Author: author, Time: time.Now().UTC(), Cells: []cellChange{}},
+		Reshape:  &mapReshape{FromWidth: fromWidth, FromHeight: fromHeight, Width: gridWidth, Height: gridHeight},
+		reshaped: diffReshape(before, after, 0, 0),
 	})
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Map loaded and announced to clients"))
+	return nil
 }
 
+// addCellHandler places a cell on an Empty cell of the map. The map never grows
+// to make room: cells outside it are rejected, and /api/resizeMap grows it.
 func addCellHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	var req addCellRequest
+	if !decodeAPIRequest(w, r, &req) {
 		return
 	}
 
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	if req.Type == "" {
+		req.Type = Empty
 	}
 
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
+	gridMutex.RLock()
+	width, height := gridWidth, gridHeight
+	gridMutex.RUnlock()
 
-	if jwterr != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	errs := fieldErrors{}
+	if req.X < 0 || req.X >= width {
+		errs.add("x", "must be inside the map, between 0 and %d", width-1)
 	}
-
-	var req addCellRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid request payload"))
-		return
+	if req.Y < 0 || req.Y >= height {
+		errs.add("y", "must be inside the map, between 0 and %d", height-1)
 	}
-
-	gridMutex.Lock()
-	defer gridMutex.Unlock()
-
-	// Check if the cell already exists
-	if req.X >= 0 && req.X < len(grid) && req.Y >= 0 && req.Y < len(grid[req.X]) {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Cell already exists"))
+	if !isCellType(req.Type) {
+		errs.add("type", "must be one of %s", strings.Join(cellTypeNames(), ", "))
+	}
+	if writeFieldErrors(w, errs) {
 		return
 	}
 
-	// Extend the grid to accommodate the new cell
-	if req.X >= len(grid) {
-		for i := len(grid); i <= req.X; i++ {
-			grid = append(grid, []*Cell{})
-		}
-	}
+	auditCells(r, req.X, req.Y)
 
-	for i := range grid {
-		for j := len(grid[i]); j <= req.Y; j++ {
-			grid[i] = append(grid[i], &Cell{
-				Type:    Empty,
-				Clients: sync.Map{},
-			})
+	result, err := applyMapEdit("addCell", apiSubject(r), func() ([]cellChange, error) {
+		if insideMapLocked(req.X, req.Y) && grid[req.Y][req.X].Type != Empty {
+			return nil, errCellTaken
 		}
+		return []cellChange{{X: req.X, Y: req.Y, To: req.Type}}, nil
+	})
+	switch {
+	case err == errCellTaken:
+		writeAPIError(w, http.StatusConflict, ErrConflict, "Cell already exists")
+		return
+	case err != nil:
+		writeMapEditError(w, err)
+		return
 	}
 
-	// Add the new cell
-	grid[req.X][req.Y] = &Cell{
-		Type:    req.Type,
-		Clients: sync.Map{},
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Cell added successfully"))
+	auditMapEdit(r, result)
+	writeAPIData(w, http.StatusOK, CellInfo{Type: req.Type, Clients: []ClientInfo{}, X: req.X, Y: req.Y})
 }
 
-func findEmptyAdjacentCell(x, y int) (int, int) {
-	directions := [][2]int{{0, 1}, {1, 0}, {0, -1}, {-1, 0}}
-	for _, d := range directions {
-		newX := x + d[0]
-		newY := y + d[1]
-		if newX >= 0 && newX < len(grid) && newY >= 0 && newY < len(grid[newX]) && grid[newX][newY].Type == Empty {
-			return newX, newY
-		}
+// setCellType changes the type of an existing cell and sends everyone the change.
+func setCellType(x, y int, cellType CellType, author string) error {
+	if !isCellType(cellType) {
+		return fmt.Errorf("unknown cell type %q, expected one of %s", cellType, strings.Join(cellTypeNames(), ", "))
+	}
+
+	_, err := applyMapEdit("set", author, func() ([]cellChange, error) {
+		return []cellChange{{X: x, Y: y, To: cellType}}, nil
+	})
+	if err == errOutsideMap {
+		return fmt.Errorf("(%d, %d) is outside the map", x, y)
 	}
-	return -1, -1
+	return err
 }
 
+// deleteCellHandler clears a cell back to Empty. The map keeps its size.
 func deleteCellHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	var req deleteCellRequest
+	if !decodeAPIRequest(w, r, &req) {
 		return
 	}
 
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
+	auditCells(r, req.X, req.Y)
 
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
+	result, err := applyMapEdit("delete", apiSubject(r), func() ([]cellChange, error) {
+		return []cellChange{{X: req.X, Y: req.Y, To: Empty}}, nil
 	})
-
-	if jwterr != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
+	if err == errOutsideMap {
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, "Cell does not exist")
 		return
 	}
-
-	var req deleteCellRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid request payload"))
+		writeMapEditError(w, err)
 		return
 	}
 
-	gridMutex.Lock()
-	defer gridMutex.Unlock()
-
-	if req.X < 0 || req.X >= len(grid) || req.Y < 0 || req.Y >= len(grid[req.X]) {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Cell does not exist"))
-		return
-	}
-
-	cell := grid[req.X][req.Y]
-	cell.Clients.Range(func(_, v interface{}) bool {
-		client := v.(*client)
-		newX, newY := findEmptyAdjacentCell(req.X, req.Y)
-		if newX != -1 && newY != -1 {
-			moveClient(client, newX, newY)
-		} else {
-			// If no empty adjacent cell is found, disconnect the client
-			client.conn.Close()
-		}
-		return true
-	})
-
-	grid[req.X] = append(grid[req.X][:req.Y], grid[req.X][req.Y+1:]...)
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Cell deleted successfully"))
+	auditMapEdit(r, result)
+	writeAPIData(w, http.StatusOK, result)
 }
 
 func kickUsersInCellHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	rpgAuthHeader := r.Header.Get("RPG_AUTH")
-	if rpgAuthHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	// Decode and verify the JWT
-	token, jwterr := jwt.Parse(rpgAuthHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apijwtSecret), nil
-	})
-
-	if jwterr != nil || !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
 	var req kickUsersInCellRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid request payload"))
+	if !decodeAPIRequest(w, r, &req) {
 		return
 	}
 
 	gridMutex.Lock()
 	defer gridMutex.Unlock()
 
-	if req.X < 0 || req.X >= len(grid) || req.Y < 0 || req.Y >= len(grid[req.X]) {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Cell does not exist"))
+	if !insideMapLocked(req.X, req.Y) {
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, "Cell does not exist")
 		return
 	}
 
-	cell := grid[req.X][req.Y]
+	cell := grid[req.Y][req.X]
+	auditCells(r, req.X, req.Y)
+	kicked := kickedUsers{Usernames: []string{}}
 	cell.Clients.Range(func(_, v interface{}) bool {
 		client := v.(*client)
+		auditUsers(r, client.username)
+		kicked.Usernames = append(kicked.Usernames, client.username)
 		client.conn.Close()
 		return true
 	})
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("All users in the cell have been kicked"))
+	writeAPIData(w, http.StatusOK, kicked)
 }
 
 func stopServer() {
-    close(stopChan)
+	stopOnce.Do(func() {
+		if stopChan != nil {
+			close(stopChan)
+		}
+		// Unblock Accept so startServer notices the stop signal
+		if serverListener != nil {
+			serverListener.Close()
+		}
+	})
+}
+
+func shutdownHandler(w http.ResponseWriter, r *http.Request) {
+	serverLog.warn("shutdown requested", "actor", apiSubject(r))
+
+	clients.Range(func(_, v interface{}) bool {
+		cli := v.(*client)
+		auditUsers(r, cli.username)
+		cli.kicked = true
+		sendJSON(cli.conn, map[string]string{
+			"action":  "shutdown",
+			"message": "The server is shutting down.",
+		})
+		cli.conn.Close()
+		return true
+	})
+
+	writeAPIData(w, http.StatusOK, apiMessage{Message: "Server shutting down"})
+
+	go stopServer()
 }
 
 func announceEventJSON(cli *client, username, action, message string) {
+	defer observeBroadcast(action, time.Now())
+	events.publish("player."+action, playerEvent{Username: username, X: cli.x, Y: cli.y})
+
 	announcement := struct {
 		Action  string `json:"action"`
 		Username string `json:"username"`
@@ -349,6 +349,7 @@ func createTestJWT() string {
 		"nbf": time.Now().Unix(),
 		"iat": time.Now().Unix(),
 		"jti": "testJti",
+		"roles": []string{RoleOperator},
 	})
 
 	tokenString, err := token.SignedString([]byte(apijwtSecret))
@@ -534,11 +535,10 @@ func checkUserMessageViaAPIReceived(t *testing.T, conn net.Conn, toUsername, fro
 	fmt.Println(msg)
 
 	var fromMsg struct {
-		Action string `json:"action"`
+		Type string `json:"type"`
 		Message  string `json:"message"`
 		From string `json:"from"`
-		FromServer  string `json:"fromServer"`
-		To  string `json:"to"`
+		Server  string `json:"server"`
 	}
 
 	err = json.Unmarshal([]byte(msg), &fromMsg)
@@ -546,7 +546,7 @@ func checkUserMessageViaAPIReceived(t *testing.T, conn net.Conn, toUsername, fro
 		t.Fatalf("Failed to parse JSON: %v", err)
 	}
 
-	if fromMsg.Action != "private_message" || fromMsg.To != toUsername || fromMsg.From != fromUsername || fromMsg.Message != expectedMsg {
+	if fromMsg.Type != "whisper" || fromMsg.Server != serverName || fromMsg.From != fromUsername || fromMsg.Message != expectedMsg {
 		t.Fatalf("Unexpected user message received: %+v", fromMsg)
 	}
 }
@@ -801,7 +801,7 @@ func TestMuteUserHandler(t *testing.T) {
 			cli := v.(*client)
 			if cli.username == "testUser2" {
 				fmt.Println("User Found!")
-				if (!cli.muted) {
+				if (!isMuted(cli)) {
 					t.Fatalf("Failed to mute user: %+v", cli.username)
 				}
 				return false
@@ -827,7 +827,7 @@ func TestSaveMapHandler(t *testing.T) {
 	time.Sleep(5 * time.Second)
 
 
-	req, err := http.NewRequest("GET", "http://localhost:5000/api/saveMap", nil)
+	req, err := http.NewRequest("POST", "http://localhost:5000/api/saveMap", nil)
 	if err != nil {
 		t.Fatal("Failed to create message request")
 	}
@@ -888,7 +888,7 @@ func TestLoadMapHandler(t *testing.T) {
 
 
 
-	req, err := http.NewRequest("GET", "http://localhost:5000/api/loadMap", nil)
+	req, err := http.NewRequest("POST", "http://localhost:5000/api/loadMap", nil)
 	if err != nil {
 		t.Fatal("Failed to create message request")
 	}
@@ -937,8 +937,8 @@ func TestAddCellHandler(t *testing.T) {
 		X int `json:"x"`
 		Y int `json:"y"`
 	}{
-		X: 250,
-		Y: 250,
+		X: 2,
+		Y: 3,
 	}
 
 	payloadBytes, err := json.Marshal(payload)
@@ -970,9 +970,9 @@ func TestAddCellHandler(t *testing.T) {
 	time.Sleep(2 * time.Second)
 
 	// Verify that the cell was added
-	ok := grid[250][250]
+	ok := grid[3][2]
 	if ok == nil {
-		t.Fatalf("Cell was not added at position (250, 250)")
+		t.Fatalf("Cell was not added at position (2, 3)")
 	}
 	
 	fmt.Println("TestAddCellHandler: PASSED")
@@ -0,0 +1,921 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	stampsFilename = "stamps.json"
+	// Most cells a single edit may change
+	maxEditCells = maxRegionCells
+	// Largest brush of /api/drawLine, in cells across
+	maxBrushSize = 9
+	// Largest width or height a map can be resized to
+	maxMapSize = 1000
+)
+
+// Anchors of a resize, as the fraction of the added or removed width and height
+// taken from the left and top
+var resizeAnchors = map[string][2]int{
+	"top-left":     {0, 0},
+	"top":          {1, 0},
+	"top-right":    {2, 0},
+	"left":         {0, 1},
+	"center":       {1, 1},
+	"right":        {2, 1},
+	"bottom-left":  {0, 2},
+	"bottom":       {1, 2},
+	"bottom-right": {2, 2},
+}
+
+var errEditTooLarge = fmt.Errorf("An edit may change at most %d cells", maxEditCells)
+
+var errCellTaken = errors.New("The cell is not Empty")
+
+var stamps = newStampStore(stampsFilename)
+
+// IDs of applied map edits and other map changes
+var nextMapEditID uint64
+
+// cellChange sets one cell to a new type. From is filled in when the edit is applied.
+type cellChange struct {
+	X    int      `json:"x"`
+	Y    int      `json:"y"`
+	From CellType `json:"from,omitempty"`
+	To   CellType `json:"to"`
+}
+
+// mapEdit is a set of cell changes applied to the map as one step.
+type mapEdit struct {
+	ID     uint64       `json:"id"`
+	Kind   string       `json:"kind"`
+	Author string       `json:"author"`
+	Time   time.Time    `json:"time"`
+	Cells  []cellChange `json:"cells"`
+}
+
+type mapEditResult struct {
+	Edit      mapEdit           `json:"edit"`
+	Relocated []relocatedPlayer `json:"relocated"`
+}
+
+// resizeRequest changes the size of the map. The anchor is the part of the map that
+// stays in place, and new cells get the fill type.
+type resizeRequest struct {
+	Width  int      `json:"width"`
+	Height int      `json:"height"`
+	Anchor string   `json:"anchor,omitempty"`
+	Fill   CellType `json:"fill,omitempty"`
+}
+
+type mapResizeResult struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Offset of the old cells on the resized map
+	OffsetX   int               `json:"offset_x"`
+	OffsetY   int               `json:"offset_y"`
+	Relocated []relocatedPlayer `json:"relocated"`
+}
+
+type fillRectRequest struct {
+	mapRect
+	Type CellType `json:"type"`
+}
+
+type floodFillRequest struct {
+	X    int      `json:"x"`
+	Y    int      `json:"y"`
+	Type CellType `json:"type"`
+}
+
+type drawLineRequest struct {
+	FromX int      `json:"from_x"`
+	FromY int      `json:"from_y"`
+	ToX   int      `json:"to_x"`
+	ToY   int      `json:"to_y"`
+	Type  CellType `json:"type"`
+	// Width in cells of the square brush, 1 when not given
+	Brush int `json:"brush,omitempty"`
+}
+
+type stampRequest struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	// Name of a saved stamp, or Stamp for a one-off pattern
+	Name  string `json:"name,omitempty"`
+	Stamp *stamp `json:"stamp,omitempty"`
+}
+
+// stamp is a reusable pattern of cells placed with its top-left corner on a cell.
+// Each character of Rows is looked up in Legend, and characters missing from it
+// leave the cell underneath unchanged.
+type stamp struct {
+	Name   string              `json:"name,omitempty"`
+	Rows   []string            `json:"rows"`
+	Legend map[string]CellType `json:"legend"`
+}
+
+// stampStore keeps the saved stamps in a JSON file.
+type stampStore struct {
+	mu       sync.Mutex
+	filename string
+	stamps   map[string]*stamp
+}
+
+func newStampStore(filename string) *stampStore {
+	return &stampStore{
+		filename: filename,
+		stamps:   make(map[string]*stamp),
+	}
+}
+
+func (ss *stampStore) load() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	byteValue, err := ioutil.ReadFile(ss.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []*stamp
+	err = json.Unmarshal(byteValue, &list)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range list {
+		ss.stamps[s.Name] = s
+	}
+	return nil
+}
+
+// save writes the stamps to disk. Callers must hold ss.mu.
+func (ss *stampStore) save() error {
+	list := []*stamp{}
+	for _, s := range ss.stamps {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	jsonData, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ss.filename, jsonData, 0644)
+}
+
+func (ss *stampStore) put(s *stamp) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.stamps[s.Name] = s
+	return ss.save()
+}
+
+func (ss *stampStore) get(name string) (*stamp, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	s, ok := ss.stamps[name]
+	return s, ok
+}
+
+func (ss *stampStore) list() []*stamp {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	list := []*stamp{}
+	for _, s := range ss.stamps {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// validate checks the pattern of a stamp.
+func (s *stamp) validate(errs fieldErrors, field string) {
+	if len(s.Rows) == 0 {
+		errs.add(field+".rows", "must not be empty")
+	}
+	for key, cellType := range s.Legend {
+		if len([]rune(key)) != 1 {
+			errs.add(field+".legend", "keys must be single characters")
+		} else if !isCellType(cellType) {
+			errs.add(field+".legend", "values must be one of %s", strings.Join(cellTypeNames(), ", "))
+		}
+	}
+}
+
+// insideMapLocked reports whether a cell is on the map. Callers must hold gridMutex.
+func insideMapLocked(x, y int) bool {
+	return y >= 0 && y < len(grid) && x >= 0 && x < len(grid[y])
+}
+
+// applyMapEdit builds an edit while holding the map lock and applies all of it,
+// or nothing when the builder fails. Players left on cells they cannot stand on
+// are moved to the nearest cell they can, everyone is sent the changed cells, and
+// the edit is recorded so it can be undone.
+func applyMapEdit(kind, author string, build func() ([]cellChange, error)) (*mapEditResult, error) {
+	mapHistory.mu.Lock()
+	defer mapHistory.mu.Unlock()
+
+	result, err := editCells(kind, author, build)
+	if err == nil && result.Edit.ID != 0 {
+		mapHistory.recordLocked(&mapHistoryEntry{mapEdit: result.Edit})
+	}
+	return result, err
+}
+
+// editCells is applyMapEdit without recording the edit. Callers must hold mapHistory.mu.
+func editCells(kind, author string, build func() ([]cellChange, error)) (*mapEditResult, error) {
+	gridMutex.Lock()
+	changes, err := build()
+	if err == nil && len(changes) > maxEditCells {
+		err = errEditTooLarge
+	}
+	for _, change := range changes {
+		if err != nil {
+			break
+		}
+		if !insideMapLocked(change.X, change.Y) {
+			err = errOutsideMap
+		} else if !isCellType(change.To) {
+			err = fmt.Errorf("unknown cell type %q", change.To)
+		}
+	}
+	if err != nil {
+		gridMutex.Unlock()
+		return nil, err
+	}
+
+	edit := mapEdit{Kind: kind, Author: author, Time: time.Now().UTC(), Cells: []cellChange{}}
+	seen := make(map[[2]int]bool)
+	displaced := []*client{}
+	for _, change := range changes {
+		cell := grid[change.Y][change.X]
+		if seen[[2]int{change.X, change.Y}] || cell.Type == change.To {
+			continue
+		}
+		seen[[2]int{change.X, change.Y}] = true
+
+		change.From = cell.Type
+		cell.Type = change.To
+		edit.Cells = append(edit.Cells, change)
+		if !isWalkable(change.To) {
+			cell.Clients.Range(func(_, v interface{}) bool {
+				displaced = append(displaced, v.(*client))
+				return true
+			})
+		}
+	}
+	if len(edit.Cells) > 0 {
+		edit.ID = newMapEditID()
+	}
+	gridMutex.Unlock()
+
+	result := &mapEditResult{Edit: edit, Relocated: []relocatedPlayer{}}
+	if len(edit.Cells) == 0 {
+		return result, nil
+	}
+
+	broadcastMapEdit(edit)
+	result.Relocated = relocateDisplaced(displaced)
+	serverLog.info("map edited", "id", edit.ID, "kind", kind, "author", author, "cells", len(edit.Cells), "relocated", len(result.Relocated))
+	return result, nil
+}
+
+func newMapEditID() uint64 {
+	return atomic.AddUint64(&nextMapEditID, 1)
+}
+
+// broadcastMapEdit sends the changed cells of an edit to every client in one message.
+func broadcastMapEdit(edit mapEdit) {
+	defer observeBroadcast("map_edit", time.Now())
+	events.publish(EventMapEdited, edit)
+
+	type changedCell struct {
+		X    int      `json:"x"`
+		Y    int      `json:"y"`
+		Type CellType `json:"type"`
+	}
+	message := struct {
+		Action string        `json:"action"`
+		ID     uint64        `json:"id"`
+		Kind   string        `json:"kind"`
+		Cells  []changedCell `json:"cells"`
+	}{
+		Action: "map_edit",
+		ID:     edit.ID,
+		Kind:   edit.Kind,
+	}
+	for _, change := range edit.Cells {
+		message.Cells = append(message.Cells, changedCell{X: change.X, Y: change.Y, Type: change.To})
+	}
+
+	clients.Range(func(_, v interface{}) bool {
+		sendJSON(v.(*client).conn, message)
+		return true
+	})
+}
+
+// relocateDisplaced moves players off cells they can no longer stand on.
+func relocateDisplaced(displaced []*client) []relocatedPlayer {
+	relocated := []relocatedPlayer{}
+	for _, cli := range displaced {
+		x, y, ok := nearestWalkableCell(cli.x, cli.y)
+		if !ok {
+			cli.log.warn("no walkable cell left to move the player to")
+			continue
+		}
+		fromX, fromY := cli.x, cli.y
+		if err := teleportClient(cli, x, y, false); err != nil {
+			cli.log.warn("failed to move displaced player", "err", err)
+			continue
+		}
+		relocated = append(relocated, relocatedPlayer{Username: cli.username, FromX: fromX, FromY: fromY, X: x, Y: y})
+	}
+	return relocated
+}
+
+// nearestWalkableCell searches rings of growing distance around a cell for one
+// players can stand on.
+func nearestWalkableCell(x, y int) (int, int, bool) {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	return nearestWalkableCellLocked(x, y, false)
+}
+
+// nearestWalkableCellLocked is nearestWalkableCell for callers holding gridMutex.
+// With includeStart the cell itself is checked first.
+func nearestWalkableCellLocked(x, y int, includeStart bool) (int, int, bool) {
+	if includeStart && insideMapLocked(x, y) && isWalkable(grid[y][x].Type) {
+		return x, y, true
+	}
+	if len(grid) == 0 {
+		return 0, 0, false
+	}
+	maxDistance := len(grid) + len(grid[0])
+	for d := 1; d <= maxDistance; d++ {
+		for dx := -d; dx <= d; dx++ {
+			dy := d - abs(dx)
+			for _, ny := range []int{y - dy, y + dy} {
+				nx := x + dx
+				if insideMapLocked(nx, ny) && isWalkable(grid[ny][nx].Type) {
+					return nx, ny, true
+				}
+				if dy == 0 {
+					break
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// resizeOffset is where the old top-left cell ends up on a map resized around the anchor.
+func resizeOffset(anchor string, oldWidth, oldHeight, width, height int) (int, int) {
+	a := resizeAnchors[anchor]
+	return (width - oldWidth) * a[0] / 2, (height - oldHeight) * a[1] / 2
+}
+
+// resizeMap changes the size of the map, keeping the cells that still fit and
+// filling new ones with the fill type. Players keep their cell when it stays,
+// and the others are moved to the nearest walkable cell. Everyone is sent the new map.
+func resizeMap(width, height int, anchor string, fill CellType, author string) (*mapResizeResult, error) {
+	if _, ok := resizeAnchors[anchor]; !ok {
+		return nil, fmt.Errorf("unknown anchor %q", anchor)
+	}
+	if !isCellType(fill) {
+		return nil, fmt.Errorf("unknown cell type %q", fill)
+	}
+
+	mapHistory.mu.Lock()
+	defer mapHistory.mu.Unlock()
+
+	gridMutex.RLock()
+	before := snapshotCellTypesLocked()
+	oldWidth, oldHeight := gridWidth, gridHeight
+	gridMutex.RUnlock()
+
+	offsetX, offsetY := resizeOffset(anchor, oldWidth, oldHeight, width, height)
+	after := make([][]CellType, height)
+	for y := range after {
+		after[y] = make([]CellType, width)
+		for x := range after[y] {
+			oldX, oldY := x-offsetX, y-offsetY
+			if oldY >= 0 && oldY < len(before) && oldX >= 0 && oldX < len(before[oldY]) {
+				after[y][x] = before[oldY][oldX]
+			} else {
+				after[y][x] = fill
+			}
+		}
+	}
+
+	relocated := reshapeMap(after, offsetX, offsetY)
+	mapHistory.recordLocked(&mapHistoryEntry{
+		mapEdit:  mapEdit{ID: newMapEditID(), Kind: "resize", Author: author, Time: time.Now().UTC(), Cells: []cellChange{}},
+		Reshape:  &mapReshape{FromWidth: oldWidth, FromHeight: oldHeight, Width: width, Height: height, OffsetX: offsetX, OffsetY: offsetY},
+		reshaped: diffReshape(before, after, offsetX, offsetY),
+	})
+
+	result := &mapResizeResult{Width: width, Height: height, OffsetX: offsetX, OffsetY: offsetY, Relocated: relocated}
+	serverLog.info("map resized", "width", width, "height", height, "anchor", anchor, "author", author, "relocated", len(relocated))
+	events.publish(EventMapResized, result)
+	return result, nil
+}
+
+// snapshotCellTypesLocked copies the type of every cell. Callers must hold gridMutex.
+func snapshotCellTypesLocked() [][]CellType {
+	return cellTypesOf(grid)
+}
+
+func cellTypesOf(cells [][]*Cell) [][]CellType {
+	types := make([][]CellType, len(cells))
+	for y := range cells {
+		types[y] = make([]CellType, len(cells[y]))
+		for x, cell := range cells[y] {
+			types[y][x] = cell.Type
+		}
+	}
+	return types
+}
+
+// reshapeMap replaces the map with one of the given cell types. Cells of the old map
+// move by the offset and keep their players and entities. Players whose cell is gone,
+// or turned into one they cannot stand on, are moved to the nearest walkable cell, and
+// so are entities whose cell is gone. Everyone is sent the new map. Callers must hold
+// mapHistory.mu.
+func reshapeMap(types [][]CellType, offsetX, offsetY int) []relocatedPlayer {
+	inside := func(x, y int) bool {
+		return y >= 0 && y < len(types) && x >= 0 && x < len(types[y])
+	}
+
+	gridMutex.Lock()
+	type placement struct {
+		cli          *client
+		fromX, fromY int
+		fromType     CellType
+		kept         bool
+	}
+	placements := []placement{}
+	clients.Range(func(_, v interface{}) bool {
+		cli := v.(*client)
+		if !insideMapLocked(cli.x, cli.y) {
+			return true
+		}
+		kept := inside(cli.x+offsetX, cli.y+offsetY)
+		if !kept {
+			removeFromGrid(cli)
+		}
+		placements = append(placements, placement{cli: cli, fromX: cli.x, fromY: cli.y, fromType: grid[cli.y][cli.x].Type, kept: kept})
+		return true
+	})
+	// Entities whose cell is gone
+	dropped := []*entity{}
+	entities.Range(func(_, v interface{}) bool {
+		e := v.(*entity)
+		if insideMapLocked(e.x, e.y) && !inside(e.x+offsetX, e.y+offsetY) {
+			grid[e.y][e.x].Entities.Delete(e.ID)
+			dropped = append(dropped, e)
+		}
+		return true
+	})
+
+	reshaped := make([][]*Cell, len(types))
+	for y := range reshaped {
+		reshaped[y] = make([]*Cell, len(types[y]))
+		for x := range reshaped[y] {
+			if insideMapLocked(x-offsetX, y-offsetY) {
+				reshaped[y][x] = grid[y-offsetY][x-offsetX]
+				reshaped[y][x].Type = types[y][x]
+			} else {
+				reshaped[y][x] = &Cell{Type: types[y][x], Clients: sync.Map{}}
+			}
+		}
+	}
+	grid = reshaped
+	updateGridSize()
+
+	entities.Range(func(_, v interface{}) bool {
+		e := v.(*entity)
+		e.x, e.y = e.x+offsetX, e.y+offsetY
+		return true
+	})
+	for _, e := range dropped {
+		if len(grid) == 0 || len(grid[0]) == 0 {
+			entities.Delete(e.ID)
+			continue
+		}
+		x, y := clamp(e.x, 0, gridWidth-1), clamp(e.y, 0, gridHeight-1)
+		if nx, ny, ok := nearestWalkableCellLocked(x, y, true); ok {
+			x, y = nx, ny
+		}
+		e.x, e.y = x, y
+		grid[y][x].Entities.Store(e.ID, e)
+	}
+
+	relocated := []relocatedPlayer{}
+	for _, p := range placements {
+		cli := p.cli
+		cli.x, cli.y = p.fromX+offsetX, p.fromY+offsetY
+		if p.kept {
+			cellType := grid[cli.y][cli.x].Type
+			if cellType == p.fromType || isWalkable(cellType) {
+				continue
+			}
+			removeFromGrid(cli)
+		}
+		if len(grid) == 0 || len(grid[0]) == 0 {
+			cli.log.warn("no cell left to move the player to")
+			continue
+		}
+
+		// Start from the nearest cell still on the map
+		x, y := clamp(cli.x, 0, gridWidth-1), clamp(cli.y, 0, gridHeight-1)
+		if nx, ny, ok := nearestWalkableCellLocked(x, y, true); ok {
+			x, y = nx, ny
+		}
+		cli.x, cli.y = x, y
+		addToGrid(cli)
+		relocated = append(relocated, relocatedPlayer{Username: cli.username, FromX: p.fromX, FromY: p.fromY, X: x, Y: y})
+	}
+	type move struct {
+		cli  *client
+		x, y int
+	}
+	moved := []move{}
+	for _, p := range placements {
+		if p.cli.x != p.fromX || p.cli.y != p.fromY {
+			moved = append(moved, move{cli: p.cli, x: p.cli.x, y: p.cli.y})
+		}
+	}
+	gridMutex.Unlock()
+
+	for _, m := range moved {
+		sendJSON(m.cli.conn, map[string]interface{}{
+			"action":   "move",
+			"username": m.cli.username,
+			"x":        m.x,
+			"y":        m.y,
+		})
+	}
+	clients.Range(func(_, v interface{}) bool {
+		announceMap(v.(*client))
+		return true
+	})
+	// Moved players are announced like any other move, after the new map
+	for _, m := range moved {
+		broadcastLocation(m.cli)
+	}
+	return relocated
+}
+
+func clamp(v, low, high int) int {
+	if v < low {
+		return low
+	}
+	if v > high {
+		return high
+	}
+	return v
+}
+
+// rectChanges sets every cell of a rectangle to the type.
+func rectChanges(area mapRect, cellType CellType) []cellChange {
+	changes := []cellChange{}
+	for y := area.Y; y < area.Y+area.Height; y++ {
+		for x := area.X; x < area.X+area.Width; x++ {
+			changes = append(changes, cellChange{X: x, Y: y, To: cellType})
+		}
+	}
+	return changes
+}
+
+// floodChanges sets the cell and every cell of the same type connected to it
+// horizontally or vertically to the type. Callers must hold gridMutex.
+func floodChanges(x, y int, cellType CellType) ([]cellChange, error) {
+	if !insideMapLocked(x, y) {
+		return nil, errOutsideMap
+	}
+	original := grid[y][x].Type
+	if original == cellType {
+		return []cellChange{}, nil
+	}
+
+	changes := []cellChange{}
+	visited := map[[2]int]bool{{x, y}: true}
+	queue := [][2]int{{x, y}}
+	for len(queue) > 0 {
+		cell := queue[0]
+		queue = queue[1:]
+		changes = append(changes, cellChange{X: cell[0], Y: cell[1], To: cellType})
+		if len(changes) > maxEditCells {
+			return nil, errEditTooLarge
+		}
+
+		for _, d := range [][2]int{{0, 1}, {1, 0}, {0, -1}, {-1, 0}} {
+			next := [2]int{cell[0] + d[0], cell[1] + d[1]}
+			if !visited[next] && insideMapLocked(next[0], next[1]) && grid[next[1]][next[0]].Type == original {
+				visited[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return changes, nil
+}
+
+// lineChanges draws a straight line with a square brush. Brush cells that fall
+// off the map are skipped. Callers must hold gridMutex.
+func lineChanges(req drawLineRequest) ([]cellChange, error) {
+	if !insideMapLocked(req.FromX, req.FromY) || !insideMapLocked(req.ToX, req.ToY) {
+		return nil, errOutsideMap
+	}
+	brush := req.Brush
+	if brush == 0 {
+		brush = 1
+	}
+	// The brush is centred on the line, leaning up and left when its width is even
+	low := (brush - 1) / 2
+
+	changes := []cellChange{}
+	plot := func(x, y int) {
+		for by := y - low; by < y-low+brush; by++ {
+			for bx := x - low; bx < x-low+brush; bx++ {
+				if insideMapLocked(bx, by) {
+					changes = append(changes, cellChange{X: bx, Y: by, To: req.Type})
+				}
+			}
+		}
+	}
+
+	// Bresenham's line algorithm
+	x, y := req.FromX, req.FromY
+	dx, dy := abs(req.ToX-x), -abs(req.ToY-y)
+	sx, sy := 1, 1
+	if req.ToX < x {
+		sx = -1
+	}
+	if req.ToY < y {
+		sy = -1
+	}
+	errTerm := dx + dy
+	for {
+		plot(x, y)
+		if x == req.ToX && y == req.ToY {
+			break
+		}
+		e2 := 2 * errTerm
+		if e2 >= dy {
+			errTerm += dy
+			x += sx
+		}
+		if e2 <= dx {
+			errTerm += dx
+			y += sy
+		}
+	}
+	return changes, nil
+}
+
+// stampChanges places a stamp with its top-left corner on the cell. The whole
+// stamp must fit on the map. Callers must hold gridMutex.
+func stampChanges(s *stamp, x, y int) ([]cellChange, error) {
+	changes := []cellChange{}
+	for row, line := range s.Rows {
+		for col, r := range []rune(line) {
+			if !insideMapLocked(x+col, y+row) {
+				return nil, errOutsideMap
+			}
+			if cellType, ok := s.Legend[string(r)]; ok {
+				changes = append(changes, cellChange{X: x + col, Y: y + row, To: cellType})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// writeMapEditError maps a failed edit onto an API error.
+func writeMapEditError(w http.ResponseWriter, err error) {
+	switch {
+	case err == errOutsideMap:
+		writeAPIError(w, http.StatusBadRequest, ErrValidationFailed, "The edit reaches outside the map")
+	case err == errEditTooLarge:
+		writeAPIError(w, http.StatusBadRequest, ErrValidationFailed, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+	}
+}
+
+func validateCellType(errs fieldErrors, field string, cellType CellType) {
+	if !isCellType(cellType) {
+		errs.add(field, "must be one of %s", strings.Join(cellTypeNames(), ", "))
+	}
+}
+
+// auditMapEdit notes the cells and players an edit touched.
+func auditMapEdit(r *http.Request, result *mapEditResult) {
+	for _, change := range result.Edit.Cells {
+		auditCells(r, change.X, change.Y)
+	}
+	for _, player := range result.Relocated {
+		auditUsers(r, player.Username)
+	}
+}
+
+func fillRectHandler(w http.ResponseWriter, r *http.Request) {
+	var req fillRectRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	req.mapRect.validate(errs, "width")
+	validateCellType(errs, "type", req.Type)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	result, err := applyMapEdit("rect", apiSubject(r), func() ([]cellChange, error) {
+		return rectChanges(req.mapRect, req.Type), nil
+	})
+	if err != nil {
+		writeMapEditError(w, err)
+		return
+	}
+
+	auditMapEdit(r, result)
+	writeAPIData(w, http.StatusOK, result)
+}
+
+func floodFillHandler(w http.ResponseWriter, r *http.Request) {
+	var req floodFillRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	validateCellType(errs, "type", req.Type)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	result, err := applyMapEdit("flood", apiSubject(r), func() ([]cellChange, error) {
+		return floodChanges(req.X, req.Y, req.Type)
+	})
+	if err != nil {
+		writeMapEditError(w, err)
+		return
+	}
+
+	auditMapEdit(r, result)
+	writeAPIData(w, http.StatusOK, result)
+}
+
+func drawLineHandler(w http.ResponseWriter, r *http.Request) {
+	var req drawLineRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	validateCellType(errs, "type", req.Type)
+	if req.Brush < 0 || req.Brush > maxBrushSize {
+		errs.add("brush", "must be between 1 and %d", maxBrushSize)
+	}
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	result, err := applyMapEdit("line", apiSubject(r), func() ([]cellChange, error) {
+		return lineChanges(req)
+	})
+	if err != nil {
+		writeMapEditError(w, err)
+		return
+	}
+
+	auditMapEdit(r, result)
+	writeAPIData(w, http.StatusOK, result)
+}
+
+func stampMapHandler(w http.ResponseWriter, r *http.Request) {
+	var req stampRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	s := req.Stamp
+	switch {
+	case req.Name != "" && s != nil:
+		errs.add("name", "cannot be combined with stamp")
+	case req.Name != "":
+		var ok bool
+		if s, ok = stamps.get(req.Name); !ok {
+			errs.add("name", "no stamp is saved under this name")
+		}
+	case s != nil:
+		s.validate(errs, "stamp")
+	default:
+		errs.add("name", "is required unless a stamp is given")
+	}
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	result, err := applyMapEdit("stamp", apiSubject(r), func() ([]cellChange, error) {
+		return stampChanges(s, req.X, req.Y)
+	})
+	if err != nil {
+		writeMapEditError(w, err)
+		return
+	}
+
+	auditMapEdit(r, result)
+	writeAPIData(w, http.StatusOK, result)
+}
+
+func resizeMapHandler(w http.ResponseWriter, r *http.Request) {
+	var req resizeRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	if req.Anchor == "" {
+		req.Anchor = "top-left"
+	}
+	if req.Fill == "" {
+		req.Fill = Empty
+	}
+
+	errs := fieldErrors{}
+	if req.Width < 1 || req.Width > maxMapSize {
+		errs.add("width", "must be between 1 and %d", maxMapSize)
+	}
+	if req.Height < 1 || req.Height > maxMapSize {
+		errs.add("height", "must be between 1 and %d", maxMapSize)
+	}
+	if _, ok := resizeAnchors[req.Anchor]; !ok {
+		anchors := []string{}
+		for anchor := range resizeAnchors {
+			anchors = append(anchors, anchor)
+		}
+		sort.Strings(anchors)
+		errs.add("anchor", "must be one of %s", strings.Join(anchors, ", "))
+	}
+	validateCellType(errs, "fill", req.Fill)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	result, err := resizeMap(req.Width, req.Height, req.Anchor, req.Fill, apiSubject(r))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+		return
+	}
+
+	for _, player := range result.Relocated {
+		auditUsers(r, player.Username)
+	}
+	writeAPIData(w, http.StatusOK, result)
+}
+
+func listStampsHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIData(w, http.StatusOK, stamps.list())
+}
+
+func saveStampHandler(w http.ResponseWriter, r *http.Request) {
+	var req stamp
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	errs.required("name", req.Name)
+	req.validate(errs, "stamp")
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	if err := stamps.put(&req); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error saving stamps: %v", err))
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, &req)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestFillRectRelocatesPlayers(t *testing.T) {
+	initGrid()
+	trapped, trappedLines := newPipeClient(t, "trapped", 2, 2)
+	_, watcher := newPipeClient(t, "watcher", 20, 20)
+
+	var result mapEditResult
+	resp := postJSON(t, fillRectHandler, "/api/fillRect", `{"x": 0, "y": 0, "width": 5, "height": 4, "type": "Mountain"}`, &result)
+	if !resp.OK || result.Edit.ID == 0 || result.Edit.Kind != "rect" || len(result.Edit.Cells) != 20 {
+		t.Fatalf("Unexpected fill response %+v %+v", resp, result)
+	}
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 5; x++ {
+			if grid[y][x].Type != Mountain {
+				t.Fatalf("Expected (%d, %d) to be filled", x, y)
+			}
+		}
+	}
+	if grid[4][0].Type != Empty || grid[0][5].Type != Empty {
+		t.Fatalf("Expected the fill to stop at the rectangle")
+	}
+
+	if len(result.Relocated) != 1 || result.Relocated[0].Username != "trapped" || !isWalkable(grid[trapped.y][trapped.x].Type) {
+		t.Fatalf("Expected the player to be moved off the mountain, got %+v at (%d, %d)", result.Relocated, trapped.x, trapped.y)
+	}
+	if msg := expectAction(t, watcher, "map_edit"); len(msg["cells"].([]interface{})) != 20 {
+		t.Fatalf("Expected one message with every changed cell, got %+v", msg)
+	}
+	expectAction(t, trappedLines, "move")
+
+	// The map never grows or shrinks, and a partly outside edit changes nothing
+	resp = postJSON(t, fillRectHandler, "/api/fillRect", fmt.Sprintf(`{"x": %d, "y": 0, "width": 5, "height": 1, "type": "Water"}`, gridWidth-2), nil)
+	if resp.Error == nil || resp.Error.Code != ErrValidationFailed {
+		t.Fatalf("Expected a rectangle off the map to be refused, got %+v", resp)
+	}
+	if grid[0][gridWidth-2].Type != Empty || len(grid) != gridHeight || len(grid[0]) != gridWidth {
+		t.Fatalf("Expected the map to be left alone")
+	}
+
+	// Sides whose product overflows are refused before any cell is built
+	resp = postJSON(t, fillRectHandler, "/api/fillRect", `{"x": 0, "y": 0, "width": 4294967296, "height": 4294967296, "type": "Water"}`, nil)
+	if resp.Error == nil || resp.Error.Code != ErrValidationFailed {
+		t.Fatalf("Expected a huge rectangle to be refused, got %+v", resp)
+	}
+}
+
+func TestFloodFillAndLines(t *testing.T) {
+	initGrid()
+	// A wall splitting the top rows of the map
+	for y := 0; y < 3; y++ {
+		grid[y][3].Type = Mountain
+	}
+	for x := 0; x < 4; x++ {
+		grid[3][x].Type = Mountain
+	}
+
+	var result mapEditResult
+	if resp := postJSON(t, floodFillHandler, "/api/floodFill", `{"x": 0, "y": 0, "type": "Water"}`, &result); !resp.OK || len(result.Edit.Cells) != 9 {
+		t.Fatalf("Expected the walled-in 3x3 area to be filled, got %+v %+v", resp, result)
+	}
+	if grid[2][2].Type != Water || grid[0][4].Type != Empty {
+		t.Fatalf("Expected the flood to stop at the wall")
+	}
+
+	if resp := postJSON(t, drawLineHandler, "/api/drawLine", `{"from_x": 10, "from_y": 10, "to_x": 14, "to_y": 12, "type": "Water"}`, &result); !resp.OK || len(result.Edit.Cells) != 5 {
+		t.Fatalf("Expected a line of five cells, got %+v %+v", resp, result)
+	}
+	if grid[10][10].Type != Water || grid[12][14].Type != Water {
+		t.Fatalf("Expected the line to reach both ends")
+	}
+
+	// A wide brush along the edge of the map is clipped to it
+	if resp := postJSON(t, drawLineHandler, "/api/drawLine", fmt.Sprintf(`{"from_x": 0, "from_y": %d, "to_x": 4, "to_y": %[1]d, "type": "Mountain", "brush": 3}`, gridHeight-1), &result); !resp.OK || len(result.Edit.Cells) != 12 {
+		t.Fatalf("Expected a clipped brush stroke of twelve cells, got %+v %+v", resp, result)
+	}
+	if resp := postJSON(t, drawLineHandler, "/api/drawLine", `{"from_x": 0, "from_y": 0, "to_x": 300, "to_y": 0, "type": "Water"}`, nil); resp.Error == nil {
+		t.Fatalf("Expected a line ending off the map to be refused")
+	}
+}
+
+func TestStamps(t *testing.T) {
+	initGrid()
+	previous := stamps
+	stamps = newStampStore(filepath.Join(t.TempDir(), "stamps.json"))
+	defer func() { stamps = previous }()
+
+	hut := `{"name": "hut", "rows": ["MMM", "M.M"], "legend": {"M": "Mountain", ".": "Empty"}}`
+	if resp := postJSON(t, saveStampHandler, "/api/saveStamp", hut, nil); !resp.OK {
+		t.Fatalf("Failed to save stamp: %+v", resp)
+	}
+	if resp := postJSON(t, saveStampHandler, "/api/saveStamp", `{"name": "bad", "rows": ["L"], "legend": {"L": "Lava"}}`, nil); resp.Error == nil || resp.Error.Fields["stamp.legend"] == "" {
+		t.Fatalf("Expected an unknown cell type to be refused, got %+v", resp)
+	}
+
+	reloaded := newStampStore(stamps.filename)
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("Failed to load stamps: %v", err)
+	}
+	if _, ok := reloaded.get("hut"); !ok {
+		t.Fatalf("Expected the stamp to be saved to disk")
+	}
+
+	grid[6][6].Type = Water
+	var result mapEditResult
+	if resp := postJSON(t, stampMapHandler, "/api/stampMap", `{"x": 5, "y": 5, "name": "hut"}`, &result); !resp.OK || len(result.Edit.Cells) != 6 {
+		t.Fatalf("Unexpected stamp response %+v %+v", resp, result)
+	}
+	if grid[5][5].Type != Mountain || grid[6][6].Type != Empty || grid[6][7].Type != Mountain {
+		t.Fatalf("Expected the stamp to be placed")
+	}
+
+	// Characters missing from the legend leave the cell alone
+	grid[20][21].Type = Water
+	grid[20][22].Type = Empty
+	if resp := postJSON(t, stampMapHandler, "/api/stampMap", `{"x": 20, "y": 20, "stamp": {"rows": ["M M"], "legend": {"M": "Mountain"}}}`, &result); !resp.OK || grid[20][21].Type != Water || grid[20][22].Type != Mountain {
+		t.Fatalf("Unexpected one-off stamp %+v %+v", resp, result)
+	}
+	if resp := postJSON(t, stampMapHandler, "/api/stampMap", fmt.Sprintf(`{"x": %d, "y": 0, "name": "hut"}`, gridWidth-2), nil); resp.Error == nil || grid[0][gridWidth-2].Type != Empty {
+		t.Fatalf("Expected a stamp that does not fit to be refused, got %+v", resp)
+	}
+}
+
+func TestDeleteCellKeepsMapSize(t *testing.T) {
+	initGrid()
+	grid[3][4].Type = Water
+
+	if resp := postJSON(t, deleteCellHandler, "/api/deleteCell", `{"x": 4, "y": 3}`, nil); !resp.OK {
+		t.Fatalf("Failed to delete cell: %+v", resp)
+	}
+	if grid[3][4].Type != Empty || len(grid) != gridHeight || len(grid[3]) != gridWidth {
+		t.Fatalf("Expected the cell to be cleared without resizing the map")
+	}
+	if resp := postJSON(t, deleteCellHandler, "/api/deleteCell", `{"x": 4, "y": 300}`, nil); resp.Error == nil || resp.Error.Code != ErrNotFound {
+		t.Fatalf("Expected a missing cell to be reported, got %+v", resp)
+	}
+}
+
+func TestAddCellKeepsMapSize(t *testing.T) {
+	initGrid()
+	isolateMapHistory(t)
+
+	if resp := postJSON(t, addCellHandler, "/api/addCell", `{"x": 4, "y": 3, "type": "Water"}`, nil); !resp.OK {
+		t.Fatalf("Failed to add cell: %+v", resp)
+	}
+	if grid[3][4].Type != Water || grid[4][3].Type != Empty {
+		t.Fatalf("Expected the cell at x=4, y=3 to be added")
+	}
+	if resp := postJSON(t, addCellHandler, "/api/addCell", `{"x": 4, "y": 3, "type": "Mountain"}`, nil); resp.Error == nil || resp.Error.Code != ErrConflict {
+		t.Fatalf("Expected a taken cell to be refused, got %+v", resp)
+	}
+	resp := postJSON(t, addCellHandler, "/api/addCell", fmt.Sprintf(`{"x": %d, "y": 0}`, gridWidth+2), nil)
+	if resp.Error == nil || resp.Error.Code != ErrValidationFailed || len(grid) != gridHeight || len(grid[0]) != gridWidth {
+		t.Fatalf("Expected a cell outside the map to be refused without resizing, got %+v", resp)
+	}
+}
+
+func TestResizeMap(t *testing.T) {
+	initGrid()
+	t.Cleanup(initGrid)
+	grid[5][5].Type = Mountain
+	corner, _ := newPipeClient(t, "corner", 1, 1)
+	far, _ := newPipeClient(t, "far", 24, 24)
+	middle, middleLines := newPipeClient(t, "middle", 10, 10)
+
+	// Centred, the map gains two columns on the left and loses two rows at the top
+	var result mapResizeResult
+	resp := postJSON(t, resizeMapHandler, "/api/resizeMap", `{"width": 30, "height": 20, "anchor": "center", "fill": "Water"}`, &result)
+	if !resp.OK || result.OffsetX != 2 || result.OffsetY != -2 {
+		t.Fatalf("Unexpected resize %+v %+v", resp, result)
+	}
+	if gridWidth != 30 || gridHeight != 20 || len(grid) != 20 || len(grid[19]) != 30 {
+		t.Fatalf("Expected a 30x20 map, got %dx%d", gridWidth, gridHeight)
+	}
+	if grid[3][7].Type != Mountain || grid[0][0].Type != Water || grid[0][2].Type != Empty {
+		t.Fatalf("Expected the old cells to be kept around the anchor and new ones filled")
+	}
+
+	if middle.x != 12 || middle.y != 8 || !cellHasClient(12, 8, "middle") {
+		t.Fatalf("Expected a player on a kept cell to stay on it, got (%d, %d)", middle.x, middle.y)
+	}
+	if msg := expectAction(t, middleLines, "move"); msg["x"] != float64(12) || msg["y"] != float64(8) {
+		t.Fatalf("Unexpected move message %+v", msg)
+	}
+	expectAction(t, middleLines, "map")
+	// Other players hear of the moves after the new map
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg := expectAction(t, middleLines, "user_moved")
+		seen[fmt.Sprintf("%v (%v, %v)", msg["username"], msg["x"], msg["y"])] = true
+	}
+	if !seen["corner (3, 0)"] || !seen["far (26, 19)"] {
+		t.Fatalf("Expected the moved players to be announced, got %v", seen)
+	}
+
+	if len(result.Relocated) != 2 || corner.x != 3 || corner.y != 0 || far.x != 26 || far.y != 19 || !cellHasClient(26, 19, "far") {
+		t.Fatalf("Expected players on removed cells to be moved onto the map, got %+v", result.Relocated)
+	}
+
+	resp = postJSON(t, resizeMapHandler, "/api/resizeMap", `{"width": 0, "height": 20, "anchor": "middle"}`, nil)
+	if resp.Error == nil || resp.Error.Fields["width"] == "" || resp.Error.Fields["anchor"] == "" {
+		t.Fatalf("Expected the size and anchor to be validated, got %+v", resp)
+	}
+}
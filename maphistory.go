@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of map changes that can be undone
+	mapHistoryLimit = 100
+	// Most cells kept across the whole history, so a few changes of a large map
+	// cannot hold on to unbounded memory
+	mapHistoryCellLimit = 1000000
+	// Number of changes listed by /api/mapHistory when no limit is given
+	mapHistoryDefaultLimit = 20
+)
+
+var (
+	errNothingToUndo   = errors.New("There is no map change to undo")
+	errNothingToRedo   = errors.New("There is no undone map change to redo")
+	errHistoryConflict = errors.New("The map has changed since, so the change cannot be reverted")
+)
+
+var mapHistory = newMapHistoryLog(mapHistoryLimit)
+
+// mapReshape describes a change that replaced the whole map, such as a resize or a load.
+type mapReshape struct {
+	FromWidth  int `json:"from_width"`
+	FromHeight int `json:"from_height"`
+	Width      int `json:"width"`
+	Height     int `json:"height"`
+	// Offset of the old cells on the new map
+	OffsetX int `json:"offset_x"`
+	OffsetY int `json:"offset_y"`
+}
+
+// mapHistoryEntry is a recorded map change. Edits of single cells keep their
+// changes in Cells, and changes of the whole map keep the cells they removed,
+// added or changed.
+type mapHistoryEntry struct {
+	mapEdit
+	Reshape  *mapReshape `json:"reshape,omitempty"`
+	Undone   bool        `json:"undone"`
+	UndoneBy string      `json:"undone_by,omitempty"`
+	UndoneAt *time.Time  `json:"undone_at,omitempty"`
+
+	reshaped *reshapeCells
+}
+
+// reshapeCells is what a change of the whole map needs to be turned back and
+// forth: the cells that are only on one side of it, the kept cells whose type
+// changed, and a hash of each side to tell whether the map is still as it was.
+type reshapeCells struct {
+	// Cells of the old map that are gone, at their old position
+	removed []cellChange
+	// Cells that were not on the old map, at their new position
+	added []cellChange
+	// Kept cells whose type changed, at their new position
+	changed    []cellChange
+	beforeHash uint64
+	afterHash  uint64
+}
+
+type mapRevertResult struct {
+	Entry     mapHistoryEntry   `json:"entry"`
+	Relocated []relocatedPlayer `json:"relocated"`
+}
+
+// mapHistoryLog keeps the recent map changes for undo and redo. Holding mu
+// serialises every change of the map, so the history is always in the order the
+// changes were applied.
+type mapHistoryLog struct {
+	mu    sync.Mutex
+	limit int
+	// Most cells kept by the entries together
+	cellLimit int
+	// Applied changes, oldest first
+	done []*mapHistoryEntry
+	// Undone changes, most recently undone last
+	undone []*mapHistoryEntry
+}
+
+func newMapHistoryLog(limit int) *mapHistoryLog {
+	return &mapHistoryLog{limit: limit, cellLimit: mapHistoryCellLimit}
+}
+
+// recordLocked adds an applied change, dropping the changes that could be redone
+// and the oldest changes once there are too many or they keep too many cells.
+// The newest change is always kept. Callers must hold h.mu.
+func (h *mapHistoryLog) recordLocked(entry *mapHistoryEntry) {
+	h.done = append(h.done, entry)
+	if len(h.done) > h.limit {
+		h.done = h.done[len(h.done)-h.limit:]
+	}
+	h.undone = nil
+
+	cells := 0
+	for i := len(h.done) - 1; i >= 0; i-- {
+		cells += h.done[i].cellCount()
+		if cells > h.cellLimit && i < len(h.done)-1 {
+			h.done = h.done[i+1:]
+			break
+		}
+	}
+}
+
+// cellCount is the number of cells the entry keeps.
+func (e *mapHistoryEntry) cellCount() int {
+	n := len(e.Cells)
+	if e.reshaped != nil {
+		n += len(e.reshaped.removed) + len(e.reshaped.added) + len(e.reshaped.changed)
+	}
+	return n
+}
+
+// diffReshape finds the cells a change of the whole map removed, added or
+// changed, where the old cells moved by the offset.
+func diffReshape(before, after [][]CellType, offsetX, offsetY int) *reshapeCells {
+	rc := &reshapeCells{beforeHash: hashCellTypes(before), afterHash: hashCellTypes(after)}
+	for y := range before {
+		for x, from := range before[y] {
+			nx, ny := x+offsetX, y+offsetY
+			switch {
+			case !insideTypes(after, nx, ny):
+				rc.removed = append(rc.removed, cellChange{X: x, Y: y, From: from})
+			case after[ny][nx] != from:
+				rc.changed = append(rc.changed, cellChange{X: nx, Y: ny, From: from, To: after[ny][nx]})
+			}
+		}
+	}
+	for y := range after {
+		for x, to := range after[y] {
+			if !insideTypes(before, x-offsetX, y-offsetY) {
+				rc.added = append(rc.added, cellChange{X: x, Y: y, To: to})
+			}
+		}
+	}
+	return rc
+}
+
+// rebuild turns the current cell types into the map before the change when
+// undo is set, or after it otherwise. It fails when the current map is not
+// the one the change left, or started from.
+func (rc *reshapeCells) rebuild(current [][]CellType, r *mapReshape, undo bool) ([][]CellType, bool) {
+	if undo {
+		if hashCellTypes(current) != rc.afterHash {
+			return nil, false
+		}
+		types := make([][]CellType, r.FromHeight)
+		for y := range types {
+			types[y] = make([]CellType, r.FromWidth)
+			for x := range types[y] {
+				if insideTypes(current, x+r.OffsetX, y+r.OffsetY) {
+					types[y][x] = current[y+r.OffsetY][x+r.OffsetX]
+				}
+			}
+		}
+		for _, c := range rc.removed {
+			types[c.Y][c.X] = c.From
+		}
+		for _, c := range rc.changed {
+			types[c.Y-r.OffsetY][c.X-r.OffsetX] = c.From
+		}
+		return types, true
+	}
+
+	if hashCellTypes(current) != rc.beforeHash {
+		return nil, false
+	}
+	types := make([][]CellType, r.Height)
+	for y := range types {
+		types[y] = make([]CellType, r.Width)
+		for x := range types[y] {
+			if insideTypes(current, x-r.OffsetX, y-r.OffsetY) {
+				types[y][x] = current[y-r.OffsetY][x-r.OffsetX]
+			}
+		}
+	}
+	for _, c := range rc.added {
+		types[c.Y][c.X] = c.To
+	}
+	for _, c := range rc.changed {
+		types[c.Y][c.X] = c.To
+	}
+	return types, true
+}
+
+func insideTypes(types [][]CellType, x, y int) bool {
+	return y >= 0 && y < len(types) && x >= 0 && x < len(types[y])
+}
+
+// hashCellTypes hashes the size and cell types of a map.
+func hashCellTypes(types [][]CellType) uint64 {
+	h := fnv.New64a()
+	for _, row := range types {
+		for _, t := range row {
+			h.Write([]byte(t))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{1})
+	}
+	return h.Sum64()
+}
+
+// list returns up to limit changes, newest first. Undone changes that can still
+// be redone are included.
+func (h *mapHistoryLog) list(limit int) []mapHistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := []mapHistoryEntry{}
+	for i := 0; i < len(h.undone) && len(entries) < limit; i++ {
+		entries = append(entries, *h.undone[i])
+	}
+	for i := len(h.done) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, *h.done[i])
+	}
+	return entries
+}
+
+// undo reverts the most recent change.
+func (h *mapHistoryLog) undo(author string) (*mapRevertResult, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.done) == 0 {
+		return nil, errNothingToUndo
+	}
+	entry := h.done[len(h.done)-1]
+
+	relocated, err := revertMapChange(entry, true, author)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	entry.Undone, entry.UndoneBy, entry.UndoneAt = true, author, &now
+	h.done = h.done[:len(h.done)-1]
+	h.undone = append(h.undone, entry)
+
+	serverLog.info("map change undone", "id", entry.ID, "kind", entry.Kind, "author", author)
+	events.publish(EventMapUndone, *entry)
+	return &mapRevertResult{Entry: *entry, Relocated: relocated}, nil
+}
+
+// redo applies the most recently undone change again.
+func (h *mapHistoryLog) redo(author string) (*mapRevertResult, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.undone) == 0 {
+		return nil, errNothingToRedo
+	}
+	entry := h.undone[len(h.undone)-1]
+
+	relocated, err := revertMapChange(entry, false, author)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Undone, entry.UndoneBy, entry.UndoneAt = false, "", nil
+	h.undone = h.undone[:len(h.undone)-1]
+	h.done = append(h.done, entry)
+
+	serverLog.info("map change redone", "id", entry.ID, "kind", entry.Kind, "author", author)
+	events.publish(EventMapRedone, *entry)
+	return &mapRevertResult{Entry: *entry, Relocated: relocated}, nil
+}
+
+// revertMapChange takes the map back to before the change, or forward to after
+// it, checking first that the map is still as the change left it. Callers must
+// hold mapHistory.mu.
+func revertMapChange(entry *mapHistoryEntry, undo bool, author string) ([]relocatedPlayer, error) {
+	if entry.Reshape != nil {
+		offsetX, offsetY := -entry.Reshape.OffsetX, -entry.Reshape.OffsetY
+		if !undo {
+			offsetX, offsetY = entry.Reshape.OffsetX, entry.Reshape.OffsetY
+		}
+
+		gridMutex.RLock()
+		current := snapshotCellTypesLocked()
+		gridMutex.RUnlock()
+		to, ok := entry.reshaped.rebuild(current, entry.Reshape, undo)
+		if !ok {
+			return nil, errHistoryConflict
+		}
+		return reshapeMap(to, offsetX, offsetY), nil
+	}
+
+	kind := "redo"
+	if undo {
+		kind = "undo"
+	}
+	result, err := editCells(kind, author, func() ([]cellChange, error) {
+		changes := []cellChange{}
+		for _, change := range entry.Cells {
+			from, to := change.To, change.From
+			if !undo {
+				from, to = change.From, change.To
+			}
+			if !insideMapLocked(change.X, change.Y) || grid[change.Y][change.X].Type != from {
+				return nil, errHistoryConflict
+			}
+			changes = append(changes, cellChange{X: change.X, Y: change.Y, To: to})
+		}
+		return changes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Relocated, nil
+}
+
+// writeMapHistoryError maps a failed undo or redo onto an API error.
+func writeMapHistoryError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNothingToUndo, errNothingToRedo, errHistoryConflict:
+		writeAPIError(w, http.StatusConflict, ErrConflict, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+	}
+}
+
+// auditMapRevert notes the cells and players an undo or redo touched.
+func auditMapRevert(r *http.Request, result *mapRevertResult) {
+	for _, change := range result.Entry.Cells {
+		auditCells(r, change.X, change.Y)
+	}
+	for _, player := range result.Relocated {
+		auditUsers(r, player.Username)
+	}
+}
+
+func mapHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	limit := mapHistoryDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			writeFieldErrors(w, fieldErrors{"limit": "must be a positive integer"})
+			return
+		}
+	}
+
+	writeAPIData(w, http.StatusOK, mapHistory.list(limit))
+}
+
+func undoMapEditHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := mapHistory.undo(apiSubject(r))
+	if err != nil {
+		writeMapHistoryError(w, err)
+		return
+	}
+
+	auditMapRevert(r, result)
+	writeAPIData(w, http.StatusOK, result)
+}
+
+func redoMapEditHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := mapHistory.redo(apiSubject(r))
+	if err != nil {
+		writeMapHistoryError(w, err)
+		return
+	}
+
+	auditMapRevert(r, result)
+	writeAPIData(w, http.StatusOK, result)
+}
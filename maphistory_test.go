@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+// isolateMapHistory gives a test an empty map history.
+func isolateMapHistory(t *testing.T) {
+	previous := mapHistory
+	mapHistory = newMapHistoryLog(mapHistoryLimit)
+	t.Cleanup(func() { mapHistory = previous })
+}
+
+func TestMapUndoRedo(t *testing.T) {
+	initGrid()
+	isolateMapHistory(t)
+	_, watcher := newPipeClient(t, "watcher", 20, 20)
+
+	if resp := postJSON(t, undoMapEditHandler, "/api/undoMapEdit", ``, nil); resp.Error == nil || resp.Error.Code != ErrConflict {
+		t.Fatalf("Expected nothing to undo, got %+v", resp)
+	}
+
+	postJSON(t, fillRectHandler, "/api/fillRect", `{"x": 0, "y": 0, "width": 2, "height": 2, "type": "Water"}`, nil)
+	postJSON(t, floodFillHandler, "/api/floodFill", `{"x": 0, "y": 0, "type": "Mountain"}`, nil)
+	expectAction(t, watcher, "map_edit")
+	expectAction(t, watcher, "map_edit")
+
+	var result mapRevertResult
+	if resp := postJSON(t, undoMapEditHandler, "/api/undoMapEdit", ``, &result); !resp.OK || result.Entry.Kind != "flood" || !result.Entry.Undone || result.Entry.UndoneBy == "" {
+		t.Fatalf("Unexpected undo %+v %+v", resp, result)
+	}
+	if grid[1][1].Type != Water {
+		t.Fatalf("Expected the flood fill to be undone, got %s", grid[1][1].Type)
+	}
+	if msg := expectAction(t, watcher, "map_edit"); msg["kind"] != "undo" || len(msg["cells"].([]interface{})) != 4 {
+		t.Fatalf("Expected the undo to be sent to clients, got %+v", msg)
+	}
+
+	var entries []mapHistoryEntry
+	getJSON(t, mapHistoryHandler, "/api/mapHistory", &entries)
+	if len(entries) != 2 || entries[0].Kind != "flood" || !entries[0].Undone || entries[1].Kind != "rect" || entries[1].Undone || entries[1].Author == "" {
+		t.Fatalf("Unexpected history %+v", entries)
+	}
+
+	if resp := postJSON(t, redoMapEditHandler, "/api/redoMapEdit", ``, &result); !resp.OK || result.Entry.Undone || grid[1][1].Type != Mountain {
+		t.Fatalf("Expected the flood fill to be redone, got %+v %+v", resp, result)
+	}
+
+	// A new change after an undo cannot be followed by a redo
+	postJSON(t, undoMapEditHandler, "/api/undoMapEdit", ``, nil)
+	postJSON(t, fillRectHandler, "/api/fillRect", `{"x": 5, "y": 5, "width": 1, "height": 1, "type": "Water"}`, nil)
+	if resp := postJSON(t, redoMapEditHandler, "/api/redoMapEdit", ``, nil); resp.Error == nil || resp.Error.Code != ErrConflict {
+		t.Fatalf("Expected nothing to redo, got %+v", resp)
+	}
+}
+
+func TestMapUndoResize(t *testing.T) {
+	initGrid()
+	t.Cleanup(initGrid)
+	isolateMapHistory(t)
+	grid[0][0].Type = Mountain
+	player, _ := newPipeClient(t, "player", 10, 10)
+	edge, _ := newPipeClient(t, "edge", 1, 1)
+
+	postJSON(t, resizeMapHandler, "/api/resizeMap", `{"width": 20, "height": 20, "anchor": "bottom-right"}`, nil)
+	if gridWidth != 20 || player.x != 5 || player.y != 5 {
+		t.Fatalf("Expected the map to shrink around the bottom right, got width %d and player at (%d, %d)", gridWidth, player.x, player.y)
+	}
+
+	if resp := postJSON(t, undoMapEditHandler, "/api/undoMapEdit", ``, nil); !resp.OK {
+		t.Fatalf("Failed to undo resize: %+v", resp)
+	}
+	if gridWidth != 25 || gridHeight != 25 || grid[0][0].Type != Mountain {
+		t.Fatalf("Expected the cut cells to come back, got %dx%d", gridWidth, gridHeight)
+	}
+	if player.x != 10 || player.y != 10 || !cellHasClient(10, 10, "player") || !cellHasClient(edge.x, edge.y, "edge") {
+		t.Fatalf("Expected the players to move back with the cells, got (%d, %d)", player.x, player.y)
+	}
+
+	if resp := postJSON(t, redoMapEditHandler, "/api/redoMapEdit", ``, nil); !resp.OK || gridWidth != 20 || player.x != 5 {
+		t.Fatalf("Expected the resize to be redone, got %+v", resp)
+	}
+
+	// The map no longer matches the recorded change
+	grid[0][0].Type = Water
+	if resp := postJSON(t, undoMapEditHandler, "/api/undoMapEdit", ``, nil); resp.Error == nil || resp.Error.Code != ErrConflict {
+		t.Fatalf("Expected a conflict, got %+v", resp)
+	}
+}
+
+func TestMapHistoryKeepsOnlyReshapedCells(t *testing.T) {
+	initGrid()
+	t.Cleanup(initGrid)
+	isolateMapHistory(t)
+	grid[3][24].Type = Water
+
+	postJSON(t, resizeMapHandler, "/api/resizeMap", `{"width": 26, "height": 25, "fill": "Grass"}`, nil)
+	postJSON(t, resizeMapHandler, "/api/resizeMap", `{"width": 24, "height": 25}`, nil)
+	grow, shrink := mapHistory.done[0].reshaped, mapHistory.done[1].reshaped
+	if len(grow.added) != 25 || len(grow.removed) != 0 || len(grow.changed) != 0 || len(shrink.removed) != 50 || len(shrink.added) != 0 {
+		t.Fatalf("Expected only the added and removed columns to be kept, got %d and %d cells", mapHistory.done[0].cellCount(), mapHistory.done[1].cellCount())
+	}
+
+	postJSON(t, undoMapEditHandler, "/api/undoMapEdit", ``, nil)
+	postJSON(t, undoMapEditHandler, "/api/undoMapEdit", ``, nil)
+	if gridWidth != 25 || grid[3][24].Type != Water {
+		t.Fatalf("Expected the removed cells to come back, got width %d", gridWidth)
+	}
+	postJSON(t, redoMapEditHandler, "/api/redoMapEdit", ``, nil)
+	if gridWidth != 26 || grid[3][25].Type != Grass || grid[3][24].Type != Water {
+		t.Fatalf("Expected the added cells to come back, got width %d", gridWidth)
+	}
+
+	// Old changes are dropped once the history keeps too many cells
+	mapHistory.cellLimit = 30
+	postJSON(t, fillRectHandler, "/api/fillRect", `{"x": 0, "y": 0, "width": 3, "height": 3, "type": "Mountain"}`, nil)
+	if len(mapHistory.done) != 1 || len(mapHistory.done[0].Cells) != 9 {
+		t.Fatalf("Expected only the newest change to be kept, got %d", len(mapHistory.done))
+	}
+}
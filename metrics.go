@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content type of the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Latency buckets, in seconds, for broadcasts and API requests
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// metricCollector writes its samples in the Prometheus text format.
+type metricCollector interface {
+	writeMetric(w io.Writer)
+}
+
+// counterVec is a set of counters told apart by label values.
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	keys   map[string][]string
+}
+
+// gaugeFunc is a gauge whose value is read when the metrics are scraped.
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a set of histograms told apart by label values.
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+	keys    map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+		keys:    make(map[string][]string),
+	}
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels renders label pairs, with extra appended, as {a="1",b="2"}.
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabelValue(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys(keys map[string][]string) []string {
+	sorted := []string{}
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func (c *counterVec) add(delta float64, labelValues ...string) {
+	key := labelKey(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.keys[key]; !ok {
+		c.keys[key] = labelValues
+	}
+	c.values[key] += delta
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[labelKey(labelValues)]
+}
+
+func (c *counterVec) writeMetric(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeMetricHeader(w, c.name, c.help, "counter")
+	// Unlabelled counters are always exposed, starting at zero
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.keys) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, formatLabels(c.labels, c.keys[key]), c.values[key])
+	}
+}
+
+func (g *gaugeFunc) writeMetric(w io.Writer) {
+	writeMetricHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %g\n", g.name, g.value())
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := labelKey(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+		h.keys[key] = labelValues
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *histogramVec) writeMetric(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.keys) {
+		series, values := h.series[key], h.keys[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", fmt.Sprintf("%g", bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, values), series.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), series.count)
+	}
+}
+
+var (
+	metricConnectionsAccepted = newCounterVec("rpg_connections_accepted_total", "Game connections accepted by the listener.")
+	metricConnectionsRejected = newCounterVec("rpg_connections_rejected_total", "Game connections refused before the player joined.", "reason")
+	metricCommands            = newCounterVec("rpg_commands_total", "Slash commands processed, by command.", "command")
+	metricRateLimited         = newCounterVec("rpg_rate_limited_total", "Commands and chat messages refused by a rate limiter, by limiter.", "limiter")
+	metricBytesReceived       = newCounterVec("rpg_bytes_received_total", "Bytes read from game connections.")
+	metricBytesSent           = newCounterVec("rpg_bytes_sent_total", "Bytes written to game connections.")
+	metricWriteErrors         = newCounterVec("rpg_write_errors_total", "Failed writes to game connections.")
+	metricBroadcastDuration   = newHistogramVec("rpg_broadcast_duration_seconds", "Time taken to fan a message out to its recipients.", latencyBuckets, "kind")
+	metricAPIRequests         = newCounterVec("rpg_api_requests_total", "Admin API requests, by endpoint, method and status.", "endpoint", "method", "status")
+	metricAPIDuration         = newHistogramVec("rpg_api_request_duration_seconds", "Admin API request latency, by endpoint.", latencyBuckets, "endpoint")
+)
+
+var metricCollectors = []metricCollector{
+	&gaugeFunc{name: "rpg_connected_clients", help: "Players currently connected.", value: func() float64 {
+		count := 0
+		clients.Range(func(_, _ interface{}) bool {
+			count++
+			return true
+		})
+		return float64(count)
+	}},
+	&gaugeFunc{name: "rpg_map_width", help: "Width of the map in cells.", value: func() float64 {
+		gridMutex.RLock()
+		defer gridMutex.RUnlock()
+		if len(grid) == 0 {
+			return 0
+		}
+		return float64(len(grid[0]))
+	}},
+	&gaugeFunc{name: "rpg_map_height", help: "Height of the map in cells.", value: func() float64 {
+		gridMutex.RLock()
+		defer gridMutex.RUnlock()
+		return float64(len(grid))
+	}},
+	metricConnectionsAccepted,
+	metricConnectionsRejected,
+	metricCommands,
+	metricRateLimited,
+	metricBytesReceived,
+	metricBytesSent,
+	metricWriteErrors,
+	metricBroadcastDuration,
+	metricAPIRequests,
+	metricAPIDuration,
+}
+
+// meteredConn counts the traffic and write errors of a game connection.
+type meteredConn struct {
+	net.Conn
+}
+
+func (mc meteredConn) Read(b []byte) (int, error) {
+	n, err := mc.Conn.Read(b)
+	if n > 0 {
+		metricBytesReceived.add(float64(n))
+	}
+	return n, err
+}
+
+func (mc meteredConn) Write(b []byte) (int, error) {
+	n, err := mc.Conn.Write(b)
+	if n > 0 {
+		metricBytesSent.add(float64(n))
+	}
+	if err != nil {
+		metricWriteErrors.inc()
+	}
+	return n, err
+}
+
+// observeBroadcast records how long a broadcast started at start took.
+func observeBroadcast(kind string, start time.Time) {
+	metricBroadcastDuration.observe(time.Since(start).Seconds(), kind)
+}
+
+// instrumentAPI counts the requests to an endpoint and how long they take.
+func instrumentAPI(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		metricAPIRequests.inc(endpoint, r.Method, fmt.Sprintf("%d", recorder.status))
+		metricAPIDuration.observe(time.Since(start).Seconds(), endpoint)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	for _, collector := range metricCollectors {
+		collector.writeMetric(w)
+	}
+}
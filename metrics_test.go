@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricExpositionFormat(t *testing.T) {
+	counter := newCounterVec("test_requests_total", "Requests.", "path")
+	counter.inc(`/a"b`)
+	counter.add(2, "/c")
+
+	histogram := newHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "kind")
+	histogram.observe(0.05, "say")
+	histogram.observe(0.5, "say")
+
+	var out bytes.Buffer
+	counter.writeMetric(&out)
+	histogram.writeMetric(&out)
+
+	expected := []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{path="/a\"b"} 1`,
+		`test_requests_total{path="/c"} 2`,
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{kind="say",le="0.1"} 1`,
+		`test_latency_seconds_bucket{kind="say",le="1"} 2`,
+		`test_latency_seconds_bucket{kind="say",le="+Inf"} 2`,
+		`test_latency_seconds_sum{kind="say"} 0.55`,
+		`test_latency_seconds_count{kind="say"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestCommandAndTrafficMetrics(t *testing.T) {
+	initGrid()
+	server, peer := net.Pipe()
+	defer peer.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := peer.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	cli := &client{
+		conn:               meteredConn{server},
+		username:           "metered",
+		commandRateLimiter: newRateLimiter(1, time.Hour),
+		mutedUsernames:     make(map[string]bool),
+	}
+
+	sent := metricBytesSent.value()
+	helps := metricCommands.value("help")
+	unknown := metricCommands.value("unknown")
+	limited := metricRateLimited.value("command")
+
+	handleCommand(cli, "/help\n")
+	handleCommand(cli, "/dance\n")
+
+	if metricCommands.value("help") != helps+1 {
+		t.Fatalf("Expected the help command to be counted")
+	}
+	if metricRateLimited.value("command") != limited+1 || metricCommands.value("unknown") != unknown {
+		t.Fatalf("Expected the second command to be rate limited")
+	}
+	if metricBytesSent.value() <= sent {
+		t.Fatalf("Expected the help text to be counted as sent bytes")
+	}
+
+	server.Close()
+	errors := metricWriteErrors.value()
+	cli.conn.Write([]byte("lost\n"))
+	if metricWriteErrors.value() != errors+1 {
+		t.Fatalf("Expected the failed write to be counted")
+	}
+}
+
+func TestMetricsEndpointCountsAPIRequests(t *testing.T) {
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, apiRoutes())
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/saveMap", nil))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != metricsContentType {
+		t.Fatalf("Unexpected metrics response %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`rpg_api_requests_total{endpoint="/api/saveMap",method="GET",status="405"}`,
+		"# TYPE rpg_connected_clients gauge",
+		"# TYPE rpg_map_width gauge",
+		"rpg_connections_accepted_total ",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("Missing %q in metrics output", line)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SanctionMute SanctionKind = "mute"
+	SanctionBan  SanctionKind = "ban"
+)
+
+const sanctionsFilename = "sanctions.json"
+
+var moderation = newModerationStore(sanctionsFilename)
+
+type SanctionKind string
+
+// Sanction is a mute or ban issued by a moderator. A nil ExpiresAt means
+// the sanction is permanent until it is lifted.
+type Sanction struct {
+	ID        int          `json:"id"`
+	Kind      SanctionKind `json:"kind"`
+	Username  string       `json:"username,omitempty"`
+	IP        string       `json:"ip,omitempty"`
+	Reason    string       `json:"reason"`
+	Moderator string       `json:"moderator"`
+	IssuedAt  time.Time    `json:"issued_at"`
+	ExpiresAt *time.Time   `json:"expires_at,omitempty"`
+}
+
+type moderationStore struct {
+	mu        sync.Mutex
+	filename  string
+	nextID    int
+	sanctions map[int]*Sanction
+}
+
+type sanctionRequest struct {
+	Username        string `json:"username,omitempty"`
+	IP              string `json:"ip,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+	DurationSeconds int    `json:"duration_seconds,omitempty"`
+}
+
+type liftSanctionRequest struct {
+	ID int `json:"id"`
+}
+
+type unmuteRequest struct {
+	Username string `json:"username"`
+}
+
+func newModerationStore(filename string) *moderationStore {
+	return &moderationStore{
+		filename:  filename,
+		nextID:    1,
+		sanctions: make(map[int]*Sanction),
+	}
+}
+
+// isActive reports whether the sanction is still in force at the given time.
+func (s *Sanction) isActive(now time.Time) bool {
+	return s.ExpiresAt == nil || now.Before(*s.ExpiresAt)
+}
+
+// matches reports whether the sanction applies to the username or IP address.
+func (s *Sanction) matches(username, ip string) bool {
+	if s.Username != "" && s.Username == username {
+		return true
+	}
+	return s.IP != "" && s.IP == ip
+}
+
+// load reads previously issued sanctions from disk. A missing file is not an error.
+func (ms *moderationStore) load() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	byteValue, err := ioutil.ReadFile(ms.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []*Sanction
+	err = json.Unmarshal(byteValue, &list)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range list {
+		ms.sanctions[s.ID] = s
+		if s.ID >= ms.nextID {
+			ms.nextID = s.ID + 1
+		}
+	}
+	return nil
+}
+
+// replace takes over the sanctions of another store, such as one freshly loaded from disk.
+func (ms *moderationStore) replace(other *moderationStore) {
+	other.mu.Lock()
+	sanctions, nextID := other.sanctions, other.nextID
+	other.mu.Unlock()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.sanctions = sanctions
+	if nextID > ms.nextID {
+		ms.nextID = nextID
+	}
+}
+
+// save writes the active sanctions to disk. Callers must hold ms.mu.
+func (ms *moderationStore) save() error {
+	list := ms.activeLocked(time.Now())
+	jsonData, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ms.filename, jsonData, 0644)
+}
+
+// activeLocked drops expired sanctions and returns the remaining ones ordered by ID.
+func (ms *moderationStore) activeLocked(now time.Time) []*Sanction {
+	list := []*Sanction{}
+	for id, s := range ms.sanctions {
+		if !s.isActive(now) {
+			delete(ms.sanctions, id)
+			continue
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// issue records a new sanction. A duration of zero makes it permanent.
+func (ms *moderationStore) issue(kind SanctionKind, username, ip, reason, moderator string, duration time.Duration) (*Sanction, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	s := &Sanction{
+		ID:        ms.nextID,
+		Kind:      kind,
+		Username:  username,
+		IP:        ip,
+		Reason:    reason,
+		Moderator: moderator,
+		IssuedAt:  now,
+	}
+	if duration > 0 {
+		expiresAt := now.Add(duration)
+		s.ExpiresAt = &expiresAt
+	}
+	ms.nextID++
+	ms.sanctions[s.ID] = s
+
+	// A sanction that is not on disk would be gone after a restart
+	if err := ms.save(); err != nil {
+		delete(ms.sanctions, s.ID)
+		ms.nextID--
+		return nil, err
+	}
+	return s, nil
+}
+
+// lift removes a sanction by ID and returns it.
+func (ms *moderationStore) lift(id int) (*Sanction, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	s, ok := ms.sanctions[id]
+	if !ok {
+		return nil, false, nil
+	}
+	delete(ms.sanctions, id)
+
+	return s, true, ms.save()
+}
+
+// liftAll removes every sanction of the given kind issued against the username.
+func (ms *moderationStore) liftAll(kind SanctionKind, username string) ([]*Sanction, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	lifted := []*Sanction{}
+	for id, s := range ms.sanctions {
+		if s.Kind == kind && s.Username == username {
+			delete(ms.sanctions, id)
+			lifted = append(lifted, s)
+		}
+	}
+	if len(lifted) == 0 {
+		return lifted, nil
+	}
+
+	return lifted, ms.save()
+}
+
+// find returns the active sanction of the given kind for the username or IP, if any.
+// When several apply, the one that lasts the longest wins.
+func (ms *moderationStore) find(kind SanctionKind, username, ip string) (*Sanction, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var found *Sanction
+	for _, s := range ms.activeLocked(time.Now()) {
+		if s.Kind != kind || !s.matches(username, ip) {
+			continue
+		}
+		if found == nil || s.ExpiresAt == nil || (found.ExpiresAt != nil && s.ExpiresAt.After(*found.ExpiresAt)) {
+			found = s
+		}
+	}
+	return found, found != nil
+}
+
+// list returns all active sanctions.
+func (ms *moderationStore) list() []*Sanction {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.activeLocked(time.Now())
+}
+
+// remoteIP returns the IP address part of the connection's remote address.
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// isMuted reports whether the client is currently under a mute. Expired
+// mutes no longer count.
+func isMuted(cli *client) bool {
+	_, ok := moderation.find(SanctionMute, cli.username, cli.ip)
+	return ok
+}
+
+// describeSanction builds the message shown to a sanctioned user.
+func describeSanction(s *Sanction) map[string]interface{} {
+	response := map[string]interface{}{
+		"action":    string(s.Kind),
+		"reason":    s.Reason,
+		"moderator": s.Moderator,
+	}
+	if s.ExpiresAt == nil {
+		response["message"] = fmt.Sprintf("You have been %s permanently.", pastTense(s.Kind))
+	} else {
+		response["message"] = fmt.Sprintf("You have been %s until %s.", pastTense(s.Kind), s.ExpiresAt.UTC().Format(time.RFC3339))
+		response["expires_at"] = s.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return response
+}
+
+func pastTense(kind SanctionKind) string {
+	switch kind {
+	case SanctionMute:
+		return "muted"
+	case SanctionBan:
+		return "banned"
+	}
+	return string(kind)
+}
+
+// kickClient disconnects a client with the given reason and tells everybody else about it.
+func kickClient(cli *client, reason string) {
+	cli.kicked = true
+	// Send "you have been kicked" message to the kicked user
+	response := map[string]string{
+		"action":  "kicked",
+		"message": "You have been kicked.",
+	}
+	if reason != "" {
+		response["reason"] = reason
+	}
+	sendJSON(cli.conn, response)
+	cli.conn.Close()
+	publishPlayerEvent(EventPlayerKicked, cli, reason)
+
+	// Send an announcement to all connected clients that the user has been kicked
+	announcement := map[string]string{
+		"action":   "announcement",
+		"username": cli.username,
+		"message":  "has been kicked from the server.",
+	}
+	if reason != "" {
+		announcement["reason"] = reason
+	}
+	clients.Range(func(_, v interface{}) bool {
+		other := v.(*client)
+		if other != cli {
+			sendJSON(other.conn, announcement)
+		}
+		return true
+	})
+}
+
+// unmuteUser lifts every mute of the user and returns the lifted sanctions.
+func unmuteUser(username string) ([]*Sanction, error) {
+	lifted, err := moderation.liftAll(SanctionMute, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := clients.Load(username); ok {
+		cli := v.(*client)
+		if !isMuted(cli) {
+			sendJSON(cli.conn, map[string]string{"action": "unmuted", "message": "You are no longer muted."})
+		}
+	}
+	return lifted, nil
+}
+
+func unmuteUserHandler(w http.ResponseWriter, r *http.Request) {
+	var payload unmuteRequest
+	if !decodeAPIRequest(w, r, &payload) {
+		return
+	}
+
+	errs := fieldErrors{}
+	errs.required("username", payload.Username)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	auditUsers(r, payload.Username)
+
+	lifted, err := unmuteUser(payload.Username)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error saving sanctions: %v", err))
+		return
+	}
+
+	if len(lifted) == 0 {
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, "User is not muted")
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, lifted)
+}
+
+func banUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req sanctionRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	if req.Username == "" && req.IP == "" {
+		errs.add("username", "is required when no ip is given")
+	}
+	if req.IP != "" && net.ParseIP(req.IP) == nil {
+		errs.add("ip", "must be an IP address")
+	}
+	if req.DurationSeconds < 0 {
+		errs.add("duration_seconds", "must not be negative")
+	}
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	if req.Username != "" {
+		auditUsers(r, req.Username)
+	}
+
+	sanction, err := moderation.issue(SanctionBan, req.Username, req.IP, req.Reason, apiSubject(r), time.Duration(req.DurationSeconds)*time.Second)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error saving sanctions: %v", err))
+		return
+	}
+
+	// Disconnect everybody the ban applies to
+	clients.Range(func(_, v interface{}) bool {
+		cli := v.(*client)
+		if sanction.matches(cli.username, cli.ip) {
+			auditUsers(r, cli.username)
+			sendJSON(cli.conn, describeSanction(sanction))
+			kickClient(cli, req.Reason)
+		}
+		return true
+	})
+
+	writeAPIData(w, http.StatusOK, sanction)
+}
+
+func listSanctionsHandler(w http.ResponseWriter, r *http.Request) {
+	kind := SanctionKind(r.URL.Query().Get("kind"))
+	username := r.URL.Query().Get("username")
+
+	if kind != "" && kind != SanctionMute && kind != SanctionBan {
+		writeFieldErrors(w, fieldErrors{"kind": fmt.Sprintf("must be %s or %s", SanctionMute, SanctionBan)})
+		return
+	}
+
+	list := []*Sanction{}
+	for _, s := range moderation.list() {
+		if kind != "" && s.Kind != kind {
+			continue
+		}
+		if username != "" && s.Username != username {
+			continue
+		}
+		list = append(list, s)
+	}
+
+	writeAPIData(w, http.StatusOK, list)
+}
+
+func liftSanctionHandler(w http.ResponseWriter, r *http.Request) {
+	var req liftSanctionRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	if req.ID < 1 {
+		errs.add("id", "must be a positive sanction ID")
+	}
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	sanction, ok, err := moderation.lift(req.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error saving sanctions: %v", err))
+		return
+	}
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, "Sanction not found")
+		return
+	}
+
+	if sanction.Username != "" {
+		auditUsers(r, sanction.Username)
+	}
+
+	if sanction.Kind == SanctionMute {
+		clients.Range(func(_, v interface{}) bool {
+			cli := v.(*client)
+			if sanction.matches(cli.username, cli.ip) && !isMuted(cli) {
+				sendJSON(cli.conn, map[string]string{"action": "unmuted", "message": "You are no longer muted."})
+			}
+			return true
+		})
+	}
+
+	writeAPIData(w, http.StatusOK, sanction)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModerationStoreBanByUsernameAndIP(t *testing.T) {
+	store := newModerationStore(filepath.Join(t.TempDir(), "sanctions.json"))
+
+	_, err := store.issue(SanctionBan, "griefer", "", "spamming", "testSubject", 0)
+	if err != nil {
+		t.Fatalf("Failed to issue ban: %v", err)
+	}
+	_, err = store.issue(SanctionBan, "", "10.0.0.7", "ban evasion", "testSubject", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to issue ban: %v", err)
+	}
+
+	if _, banned := store.find(SanctionBan, "griefer", "127.0.0.1"); !banned {
+		t.Fatalf("Expected griefer to be banned by username")
+	}
+	if ban, banned := store.find(SanctionBan, "newAccount", "10.0.0.7"); !banned || ban.Reason != "ban evasion" {
+		t.Fatalf("Expected 10.0.0.7 to be banned by IP, got %+v", ban)
+	}
+	if _, banned := store.find(SanctionBan, "innocent", "127.0.0.1"); banned {
+		t.Fatalf("Did not expect innocent to be banned")
+	}
+	if _, muted := store.find(SanctionMute, "griefer", ""); muted {
+		t.Fatalf("A ban should not count as a mute")
+	}
+}
+
+func TestModerationStoreExpiryAndLift(t *testing.T) {
+	store := newModerationStore(filepath.Join(t.TempDir(), "sanctions.json"))
+
+	_, err := store.issue(SanctionMute, "chatty", "", "caps lock", "testSubject", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to issue mute: %v", err)
+	}
+	ban, err := store.issue(SanctionBan, "chatty", "", "repeat offender", "testSubject", 0)
+	if err != nil {
+		t.Fatalf("Failed to issue ban: %v", err)
+	}
+
+	if _, muted := store.find(SanctionMute, "chatty", ""); !muted {
+		t.Fatalf("Expected chatty to be muted")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, muted := store.find(SanctionMute, "chatty", ""); muted {
+		t.Fatalf("Expected the mute to have expired")
+	}
+	if len(store.list()) != 1 {
+		t.Fatalf("Expected only the ban to remain, got %+v", store.list())
+	}
+
+	if _, ok, err := store.lift(ban.ID); err != nil || !ok {
+		t.Fatalf("Failed to lift ban: ok=%v err=%v", ok, err)
+	}
+	if _, banned := store.find(SanctionBan, "chatty", ""); banned {
+		t.Fatalf("Expected the ban to be lifted")
+	}
+}
+
+func TestModerationStorePersistence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sanctions.json")
+	store := newModerationStore(filename)
+
+	issued, err := store.issue(SanctionBan, "", "192.168.1.20", "botting", "testSubject", 0)
+	if err != nil {
+		t.Fatalf("Failed to issue ban: %v", err)
+	}
+
+	reloaded := newModerationStore(filename)
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("Failed to load sanctions: %v", err)
+	}
+
+	ban, banned := reloaded.find(SanctionBan, "anyone", "192.168.1.20")
+	if !banned || ban.ID != issued.ID || ban.Moderator != "testSubject" {
+		t.Fatalf("Ban was not persisted: %+v", ban)
+	}
+
+	next, err := reloaded.issue(SanctionMute, "someone", "", "", "testSubject", 0)
+	if err != nil {
+		t.Fatalf("Failed to issue mute: %v", err)
+	}
+	if next.ID <= issued.ID {
+		t.Fatalf("Expected sanction IDs to keep increasing, got %d after %d", next.ID, issued.ID)
+	}
+}
+
+func TestModerationStoreUnsavedSanctionIsDropped(t *testing.T) {
+	store := newModerationStore(filepath.Join(t.TempDir(), "missing", "sanctions.json"))
+
+	if _, err := store.issue(SanctionMute, "chatty", "", "caps lock", "testSubject", 0); err == nil {
+		t.Fatalf("Expected a sanction that cannot be saved to fail")
+	}
+	if _, muted := store.find(SanctionMute, "chatty", ""); muted {
+		t.Fatalf("Expected the unsaved mute not to apply")
+	}
+
+	// The ID of the dropped sanction is given out again
+	store.filename = filepath.Join(t.TempDir(), "sanctions.json")
+	s, err := store.issue(SanctionMute, "chatty", "", "caps lock", "testSubject", 0)
+	if err != nil {
+		t.Fatalf("Failed to issue mute: %v", err)
+	}
+	if s.ID != 1 {
+		t.Fatalf("Expected the first saved sanction to have ID 1, got %d", s.ID)
+	}
+}
+
+func TestMutedPlayerCannotWhisperOrMail(t *testing.T) {
+	previousModeration, previousMailboxes := moderation, mailboxes
+	moderation = newModerationStore(filepath.Join(t.TempDir(), "sanctions.json"))
+	mailboxes = newMailboxStore(filepath.Join(t.TempDir(), "mailbox.jsonl"))
+	defer func() { moderation, mailboxes = previousModeration, previousMailboxes }()
+
+	hush, hushLines := newPipeClient(t, "hush", 0, 0)
+	_, listenerLines := newPipeClient(t, "listener", 0, 0)
+	sanction, err := muteUser("hush", "spam", "testSubject", 0)
+	if err != nil {
+		t.Fatalf("Failed to mute: %v", err)
+	}
+	expectAction(t, hushLines, "mute")
+
+	whisper(hush, "listener", "psst")
+	expectLine(t, hushLines, "You are muted and cannot send messages.")
+	expectSilence(t, listenerLines)
+
+	whisper(hush, "offline", "psst")
+	expectLine(t, hushLines, "You are muted and cannot send messages.")
+	if mail, _ := mailboxes.collect("offline"); len(mail) != 0 {
+		t.Fatalf("Expected no mail to be left, got %+v", mail)
+	}
+
+	// Permanent sanctions carry no expiry at all
+	encoded, _ := json.Marshal(sanction)
+	if strings.Contains(string(encoded), "expires_at") {
+		t.Fatalf("Expected no expires_at for a permanent mute, got %s", encoded)
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behaviour states of NPCs
+const (
+	NPCIdle   = "idle"
+	NPCWander = "wander"
+	NPCPatrol = "patrol"
+	NPCFollow = "follow"
+	NPCFlee   = "flee"
+)
+
+var npcStates = []string{NPCIdle, NPCWander, NPCPatrol, NPCFollow, NPCFlee}
+
+// Component of an NPC holding its behaviour
+const behaviourComponent = "behaviour"
+
+// Farthest an NPC wanders from home or notices a player from
+const maxNPCRange = 50
+
+// Most cells an NPC looks at when finding a path, enough for any goal in range
+const maxNPCPathCells = (2*maxNPCRange + 1) * (2*maxNPCRange + 1)
+
+// Steps an NPC waits after failing to find a path before trying again
+const npcPathBackoff = 5
+
+var errNotNPC = errors.New("The entity is not an NPC")
+
+var npcs = newNPCEngine()
+
+// npcBehaviour is what an NPC does on each tick. Wandering NPCs walk to random
+// cells within Radius of where they started, patrolling NPCs walk their
+// Waypoints in order, and following or fleeing NPCs walk towards or away from
+// Target, or the nearest player when there is no target, while the player is
+// within Range. NPCs take a step every Every ticks.
+type npcBehaviour struct {
+	State     string     `json:"state"`
+	Radius    int        `json:"radius,omitempty"`
+	Waypoints []cellInfo `json:"waypoints,omitempty"`
+	Target    string     `json:"target,omitempty"`
+	Range     int        `json:"range,omitempty"`
+	Every     int        `json:"every,omitempty"`
+}
+
+// npcDefinition is an NPC of the NPC file.
+type npcDefinition struct {
+	Name       string                 `json:"name"`
+	X          int                    `json:"x"`
+	Y          int                    `json:"y"`
+	Behaviour  npcBehaviour           `json:"behaviour"`
+	Stats      *combatStats           `json:"stats,omitempty"`
+	Components map[string]interface{} `json:"components,omitempty"`
+}
+
+type setNPCBehaviourRequest struct {
+	ID        string       `json:"id"`
+	Behaviour npcBehaviour `json:"behaviour"`
+}
+
+type npcsLoaded struct {
+	Spawned []EntityInfo `json:"spawned"`
+}
+
+// npcProgress is where an NPC is in its behaviour.
+type npcProgress struct {
+	home     cellInfo
+	path     []cellInfo
+	waypoint int
+	ticks    int
+	// Steps left to wait after a path could not be found
+	backoff int
+}
+
+// npcEngine moves the NPCs on every tick.
+type npcEngine struct {
+	mu       sync.Mutex
+	progress map[string]*npcProgress
+	// IDs of the NPCs spawned from the NPC file
+	loaded []string
+	rand   *rand.Rand
+}
+
+func newNPCEngine() *npcEngine {
+	return &npcEngine{
+		progress: make(map[string]*npcProgress),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func isNPCState(state string) bool {
+	for _, known := range npcStates {
+		if state == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *npcBehaviour) validate(errs fieldErrors, field string) {
+	if !isNPCState(b.State) {
+		errs.add(field+".state", "must be one of %s", strings.Join(npcStates, ", "))
+	}
+	if b.Radius < 0 || b.Radius > maxNPCRange {
+		errs.add(field+".radius", "must be between 0 and %d", maxNPCRange)
+	}
+	if b.Range < 0 || b.Range > maxNPCRange {
+		errs.add(field+".range", "must be between 0 and %d", maxNPCRange)
+	}
+	if b.Every < 0 {
+		errs.add(field+".every", "must not be negative")
+	}
+	switch b.State {
+	case NPCWander:
+		if b.Radius == 0 {
+			errs.add(field+".radius", "is required to wander")
+		}
+	case NPCPatrol:
+		if len(b.Waypoints) == 0 {
+			errs.add(field+".waypoints", "are required to patrol")
+		}
+	case NPCFollow, NPCFlee:
+		if b.Range == 0 {
+			errs.add(field+".range", "is required to %s", b.State)
+		}
+	}
+}
+
+// loadNPCDefinitions reads the NPC file. A missing file defines no NPCs.
+func loadNPCDefinitions(filename string) ([]npcDefinition, error) {
+	byteValue, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var defs []npcDefinition
+	if err := json.Unmarshal(byteValue, &defs); err != nil {
+		return nil, err
+	}
+	errs := fieldErrors{}
+	for i, def := range defs {
+		field := fmt.Sprintf("[%d]", i)
+		errs.required(field+".name", def.Name)
+		def.Behaviour.validate(errs, field+".behaviour")
+		if def.Stats != nil {
+			if def.Stats.HP == 0 {
+				def.Stats.HP = def.Stats.MaxHP
+			}
+			def.Stats.validate(errs, field+".stats")
+		}
+	}
+	if len(errs) > 0 {
+		problems := []string{}
+		for field, problem := range errs {
+			problems = append(problems, field+" "+problem)
+		}
+		sort.Strings(problems)
+		return nil, fmt.Errorf("invalid NPCs: %s", strings.Join(problems, "; "))
+	}
+	return defs, nil
+}
+
+// load replaces the NPCs spawned from the NPC file with those it defines now.
+func (ng *npcEngine) load(filename string) ([]EntityInfo, error) {
+	defs, err := loadNPCDefinitions(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ng.mu.Lock()
+	previous := ng.loaded
+	ng.loaded = nil
+	for _, id := range previous {
+		delete(ng.progress, id)
+	}
+	ng.mu.Unlock()
+	// NPCs waiting to respawn are gone with the rest
+	combat.forget(previous)
+	for _, id := range previous {
+		removeEntity(id)
+	}
+
+	spawned := []EntityInfo{}
+	for _, def := range defs {
+		e := newEntity(EntityNPC, def.Name)
+		for name, c := range def.Components {
+			e.setComponent(name, c)
+		}
+		e.setComponent(behaviourComponent, def.Behaviour)
+		if def.Stats != nil {
+			e.setComponent(statsComponent, *def.Stats)
+		}
+		if err := spawnEntity(e, def.X, def.Y); err != nil {
+			serverLog.warn("failed to spawn NPC", "name", def.Name, "x", def.X, "y", def.Y, "err", err)
+			continue
+		}
+		ng.mu.Lock()
+		ng.loaded = append(ng.loaded, e.ID)
+		ng.mu.Unlock()
+		spawned = append(spawned, e.info())
+	}
+	serverLog.info("NPCs loaded", "file", filename, "count", len(spawned))
+	return spawned, nil
+}
+
+// setBehaviour gives an NPC a new behaviour, starting from where it stands.
+func (ng *npcEngine) setBehaviour(e *entity, b npcBehaviour) {
+	e.setComponent(behaviourComponent, b)
+
+	ng.mu.Lock()
+	delete(ng.progress, e.ID)
+	ng.mu.Unlock()
+}
+
+// home returns where an NPC started its behaviour.
+func (ng *npcEngine) home(id string) (cellInfo, bool) {
+	ng.mu.Lock()
+	defer ng.mu.Unlock()
+
+	p, ok := ng.progress[id]
+	if !ok {
+		return cellInfo{}, false
+	}
+	return p.home, true
+}
+
+// run ticks the NPCs and fights until stop is closed, at the configured interval.
+func (ng *npcEngine) run(stop chan struct{}) {
+	interval := time.Duration(currentConfig().NPCTickInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ng.tick()
+			combat.tick()
+
+			// The interval can be changed by a reload
+			if next := time.Duration(currentConfig().NPCTickInterval); next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
+		}
+	}
+}
+
+// tick moves every NPC one step along its behaviour.
+func (ng *npcEngine) tick() {
+	ng.mu.Lock()
+	defer ng.mu.Unlock()
+
+	seen := make(map[string]bool)
+	entities.Range(func(_, v interface{}) bool {
+		e := v.(*entity)
+		if e.Kind != EntityNPC {
+			return true
+		}
+		c, ok := e.component(behaviourComponent)
+		if !ok {
+			return true
+		}
+		b, ok := c.(npcBehaviour)
+		if !ok {
+			return true
+		}
+		seen[e.ID] = true
+		ng.step(e, b)
+		return true
+	})
+
+	// Forget the NPCs that were removed
+	for id := range ng.progress {
+		if !seen[id] {
+			delete(ng.progress, id)
+		}
+	}
+}
+
+// step moves an NPC one cell. Callers must hold ng.mu.
+func (ng *npcEngine) step(e *entity, b npcBehaviour) {
+	x, y := e.position()
+	here := cellInfo{X: x, Y: y}
+
+	p, ok := ng.progress[e.ID]
+	if !ok {
+		p = &npcProgress{home: here}
+		ng.progress[e.ID] = p
+	}
+	p.ticks++
+	if b.Every > 1 && p.ticks%b.Every != 0 {
+		return
+	}
+	if p.backoff > 0 {
+		p.backoff--
+		return
+	}
+
+	switch b.State {
+	case NPCIdle:
+		return
+
+	case NPCWander:
+		if len(p.path) == 0 {
+			goal, ok := ng.wanderGoal(p.home, b.Radius)
+			if !ok {
+				p.backoff = npcPathBackoff
+				return
+			}
+			if p.path = findPath(here, goal); len(p.path) == 0 {
+				p.backoff = npcPathBackoff
+			}
+		}
+
+	case NPCPatrol:
+		goal := b.Waypoints[p.waypoint%len(b.Waypoints)]
+		if here == goal {
+			p.waypoint = (p.waypoint + 1) % len(b.Waypoints)
+			goal = b.Waypoints[p.waypoint]
+			p.path = nil
+		}
+		if len(p.path) == 0 || p.path[len(p.path)-1] != goal {
+			p.path = findPath(here, goal)
+		}
+		if len(p.path) == 0 {
+			// Skip waypoints that cannot be reached
+			p.waypoint = (p.waypoint + 1) % len(b.Waypoints)
+			p.backoff = npcPathBackoff
+		}
+
+	case NPCFollow:
+		target, ok := npcTarget(b, here)
+		if !ok || distance(here, target) <= 1 {
+			p.path = nil
+			return
+		}
+		// The path is found again only once the player has moved off its end
+		if len(p.path) == 0 || p.path[len(p.path)-1] != target {
+			if p.path = findPath(here, target); len(p.path) == 0 {
+				p.backoff = npcPathBackoff
+			}
+		}
+
+	case NPCFlee:
+		threat, ok := npcTarget(b, here)
+		if !ok {
+			p.path = nil
+			return
+		}
+		p.path = nil
+		if next, ok := fleeStep(here, threat); ok {
+			p.path = []cellInfo{next}
+		}
+	}
+
+	if len(p.path) == 0 {
+		return
+	}
+	next := p.path[0]
+	if err := moveEntity(e, next.X, next.Y, false); err != nil {
+		// The map changed under the path, a new one is found on the next step
+		p.path = nil
+		return
+	}
+	p.path = p.path[1:]
+}
+
+// wanderGoal picks a random walkable cell within radius of home.
+func (ng *npcEngine) wanderGoal(home cellInfo, radius int) (cellInfo, bool) {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	for try := 0; try < 10; try++ {
+		x := home.X + ng.rand.Intn(2*radius+1) - radius
+		y := home.Y + ng.rand.Intn(2*radius+1) - radius
+		if insideMapLocked(x, y) && isWalkable(grid[y][x].Type) {
+			return cellInfo{X: x, Y: y}, true
+		}
+	}
+	return cellInfo{}, false
+}
+
+// findPath finds the steps from one cell to another over walkable cells. It
+// gives up on goals that are too far around walls for an NPC to reach.
+func findPath(from, to cellInfo) []cellInfo {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	if !insideMapLocked(from.X, from.Y) || !insideMapLocked(to.X, to.Y) {
+		return nil
+	}
+	return aStarPathfindingLimited(from, to, &grid, maxNPCPathCells)
+}
+
+// distance is the number of steps between two cells on an empty map.
+func distance(a, b cellInfo) int {
+	return abs(a.X-b.X) + abs(a.Y-b.Y)
+}
+
+// npcTarget finds the player an NPC follows or flees: its target, or the nearest
+// player, as long as they are within range.
+func npcTarget(b npcBehaviour, here cellInfo) (cellInfo, bool) {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	found := false
+	var nearest cellInfo
+	clients.Range(func(_, v interface{}) bool {
+		cli := v.(*client)
+		if b.Target != "" && cli.username != b.Target {
+			return true
+		}
+		at := cellInfo{X: cli.x, Y: cli.y}
+		d := distance(here, at)
+		if d <= b.Range && (!found || d < distance(here, nearest)) {
+			nearest, found = at, true
+		}
+		return true
+	})
+	return nearest, found
+}
+
+// fleeStep picks the walkable neighbour farthest from a threat, if any is farther
+// than the current cell.
+func fleeStep(here, threat cellInfo) (cellInfo, bool) {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	best, found := here, false
+	for _, next := range []cellInfo{{here.X - 1, here.Y}, {here.X + 1, here.Y}, {here.X, here.Y - 1}, {here.X, here.Y + 1}} {
+		if !insideMapLocked(next.X, next.Y) || !isWalkable(grid[next.Y][next.X].Type) {
+			continue
+		}
+		if distance(next, threat) > distance(best, threat) {
+			best, found = next, true
+		}
+	}
+	return best, found
+}
+
+func reloadNPCsHandler(w http.ResponseWriter, r *http.Request) {
+	spawned, err := npcs.load(currentConfig().NPCFile)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error loading NPCs: %v", err))
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, npcsLoaded{Spawned: spawned})
+}
+
+func setNPCBehaviourHandler(w http.ResponseWriter, r *http.Request) {
+	var req setNPCBehaviourRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	errs.required("id", req.ID)
+	req.Behaviour.validate(errs, "behaviour")
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	v, ok := entities.Load(req.ID)
+	if !ok {
+		writeEntityError(w, errEntityNotFound)
+		return
+	}
+	e := v.(*entity)
+	if e.Kind != EntityNPC {
+		writeAPIError(w, http.StatusConflict, ErrConflict, errNotNPC.Error())
+		return
+	}
+	npcs.setBehaviour(e, req.Behaviour)
+
+	writeAPIData(w, http.StatusOK, e.info())
+}
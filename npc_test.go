@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// spawnNPC places an NPC with a behaviour for a test.
+func spawnNPC(t *testing.T, x, y int, b npcBehaviour) *entity {
+	e := newEntity(EntityNPC, "npc")
+	e.setComponent(behaviourComponent, b)
+	if err := spawnEntity(e, x, y); err != nil {
+		t.Fatalf("Failed to spawn NPC: %v", err)
+	}
+	return e
+}
+
+func TestNPCBehaviours(t *testing.T) {
+	initGrid()
+	clearEntities(t)
+	ng := newNPCEngine()
+
+	// Patrols find their way around walls
+	grid[0][1].Type = Mountain
+	guard := spawnNPC(t, 0, 0, npcBehaviour{State: NPCPatrol, Waypoints: []cellInfo{{X: 2, Y: 0}, {X: 0, Y: 0}}})
+	_, lines := newPipeClient(t, "watcher", 10, 10)
+	for i := 0; i < 4; i++ {
+		ng.tick()
+	}
+	if x, y := guard.position(); x != 2 || y != 0 {
+		t.Fatalf("Expected the guard at its first waypoint, got (%d, %d)", x, y)
+	}
+	if msg := expectAction(t, lines, "user_moved"); msg["id"] != guard.ID || msg["kind"] != EntityNPC || msg["y"] != float64(1) {
+		t.Fatalf("Expected the guard's moves to be broadcast, got %+v", msg)
+	}
+	for i := 0; i < 4; i++ {
+		ng.tick()
+	}
+	if x, y := guard.position(); x != 0 || y != 0 {
+		t.Fatalf("Expected the guard back at its second waypoint, got (%d, %d)", x, y)
+	}
+	removeEntity(guard.ID)
+
+	// Followers stop next to the player, those fleeing move away
+	dog := spawnNPC(t, 10, 6, npcBehaviour{State: NPCFollow, Target: "watcher", Range: 10})
+	cat := spawnNPC(t, 12, 10, npcBehaviour{State: NPCFlee, Range: 3})
+	for i := 0; i < 5; i++ {
+		ng.tick()
+	}
+	if x, y := dog.position(); x != 10 || y != 9 {
+		t.Fatalf("Expected the dog next to the player, got (%d, %d)", x, y)
+	}
+	if x, y := cat.position(); distance(cellInfo{X: x, Y: y}, cellInfo{X: 10, Y: 10}) != 4 {
+		t.Fatalf("Expected the cat out of range of the player, got (%d, %d)", x, y)
+	}
+
+	// Wanderers stay near home
+	ng.setBehaviour(dog, npcBehaviour{State: NPCWander, Radius: 2})
+	for i := 0; i < 30; i++ {
+		ng.tick()
+		if x, y := dog.position(); abs(x-10) > 2 || abs(y-9) > 2 {
+			t.Fatalf("Expected the dog to wander within 2 cells of (10, 9), got (%d, %d)", x, y)
+		}
+	}
+}
+
+func TestLoadNPCs(t *testing.T) {
+	initGrid()
+	clearEntities(t)
+	ng := newNPCEngine()
+	filename := filepath.Join(t.TempDir(), "npcs.json")
+
+	ioutil.WriteFile(filename, []byte(`[{"name": "guard", "x": 3, "y": 4, "behaviour": {"state": "wander", "radius": 2}, "components": {"greeting": "Halt!"}}]`), 0644)
+	spawned, err := ng.load(filename)
+	if err != nil || len(spawned) != 1 || spawned[0].Name != "guard" || spawned[0].X != 3 || spawned[0].Components["greeting"] != "Halt!" {
+		t.Fatalf("Unexpected NPCs %+v %v", spawned, err)
+	}
+
+	// Loading again replaces the NPCs of the file
+	ioutil.WriteFile(filename, []byte(`[{"name": "merchant", "x": 1, "y": 1, "behaviour": {"state": "idle"}}]`), 0644)
+	if _, err := ng.load(filename); err != nil {
+		t.Fatalf("Failed to reload NPCs: %v", err)
+	}
+	if npcs := listEntities(EntityNPC); len(npcs) != 1 || npcs[0].Name != "merchant" {
+		t.Fatalf("Expected only the merchant, got %+v", npcs)
+	}
+
+	ioutil.WriteFile(filename, []byte(`[{"name": "ghost", "behaviour": {"state": "haunt"}}, {"name": "", "behaviour": {"state": "patrol"}}]`), 0644)
+	if _, err := ng.load(filename); err == nil {
+		t.Fatalf("Expected invalid NPCs to be refused")
+	}
+
+	merchant := listEntities(EntityNPC)[0]
+	if resp := postJSON(t, setNPCBehaviourHandler, "/api/setNPCBehaviour", `{"id": "`+merchant.ID+`", "behaviour": {"state": "follow"}}`, nil); resp.Error == nil || resp.Error.Fields["behaviour.range"] == "" {
+		t.Fatalf("Expected a follower without a range to be refused, got %+v", resp)
+	}
+	var info EntityInfo
+	if resp := postJSON(t, setNPCBehaviourHandler, "/api/setNPCBehaviour", `{"id": "`+merchant.ID+`", "behaviour": {"state": "follow", "range": 5}}`, &info); !resp.OK || info.Components[behaviourComponent].(map[string]interface{})["state"] != NPCFollow {
+		t.Fatalf("Failed to change behaviour: %+v %+v", resp, info)
+	}
+}
+
+func TestReloadNPCsForgetsRespawns(t *testing.T) {
+	initGrid()
+	clearEntities(t)
+	previousCombat := combat
+	combat = newCombatEngine()
+	defer func() { combat = previousCombat }()
+	ng := newNPCEngine()
+	filename := filepath.Join(t.TempDir(), "npcs.json")
+
+	ioutil.WriteFile(filename, []byte(`[{"name": "rat", "x": 3, "y": 4, "behaviour": {"state": "idle"}, "stats": {"hp": 5, "max_hp": 5}}]`), 0644)
+	spawned, err := ng.load(filename)
+	if err != nil || len(spawned) != 1 {
+		t.Fatalf("Unexpected NPCs %+v %v", spawned, err)
+	}
+	rat, _ := removeEntity(spawned[0].ID)
+	combat.respawns = append(combat.respawns, &pendingRespawn{ent: rat, x: 3, y: 4, ticks: 1})
+
+	ioutil.WriteFile(filename, []byte(`[{"name": "merchant", "x": 1, "y": 1, "behaviour": {"state": "idle"}}]`), 0644)
+	if _, err := ng.load(filename); err != nil {
+		t.Fatalf("Failed to reload NPCs: %v", err)
+	}
+	combat.tick()
+	if npcs := listEntities(EntityNPC); len(npcs) != 1 || npcs[0].Name != "merchant" {
+		t.Fatalf("Expected the removed rat not to respawn, got %+v", npcs)
+	}
+}
+
+func TestNPCPathsAreBounded(t *testing.T) {
+	initGrid()
+	clearEntities(t)
+	ng := newNPCEngine()
+
+	// Searches give up after the cells they may look at
+	from, to := cellInfo{X: 0, Y: 0}, cellInfo{X: 8, Y: 8}
+	if path := aStarPathfindingLimited(from, to, &grid, 10); len(path) != 0 {
+		t.Fatalf("Expected a bounded search to give up, got %v", path)
+	}
+	if path := findPath(from, to); len(path) != 16 {
+		t.Fatalf("Expected a path of 16 steps, got %v", path)
+	}
+
+	// NPCs that cannot get anywhere wait before looking again
+	for _, c := range []cellInfo{{X: 4, Y: 5}, {X: 6, Y: 5}, {X: 5, Y: 4}, {X: 5, Y: 6}} {
+		grid[c.Y][c.X].Type = Mountain
+	}
+	stuck := spawnNPC(t, 5, 5, npcBehaviour{State: NPCPatrol, Waypoints: []cellInfo{{X: 0, Y: 0}}})
+	ng.tick()
+	if p := ng.progress[stuck.ID]; p.backoff != npcPathBackoff {
+		t.Fatalf("Expected the NPC to back off after failing to find a path, got %+v", p)
+	}
+	for i := 0; i < npcPathBackoff; i++ {
+		ng.tick()
+	}
+	if p := ng.progress[stuck.ID]; p.backoff != 0 {
+		t.Fatalf("Expected the NPC to have waited out its backoff, got %+v", p)
+	}
+	ng.tick()
+	if p := ng.progress[stuck.ID]; p.backoff != npcPathBackoff {
+		t.Fatalf("Expected the NPC to back off again, got %+v", p)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const playersFilename = "players.json"
+
+var playerData = newPlayerStore(playersFilename)
+
+// playerRecord is what is kept about a player between sessions.
+type playerRecord struct {
+	Inventory inventory    `json:"inventory,omitempty"`
+	Stats     *combatStats `json:"stats,omitempty"`
+}
+
+func (pr *playerRecord) clone() *playerRecord {
+	c := *pr
+	c.Inventory = append(inventory(nil), pr.Inventory...)
+	if pr.Stats != nil {
+		stats := *pr.Stats
+		c.Stats = &stats
+	}
+	return &c
+}
+
+// playerStore keeps the records of players in a JSON file, by username.
+type playerStore struct {
+	mu       sync.Mutex
+	filename string
+	records  map[string]*playerRecord
+}
+
+func newPlayerStore(filename string) *playerStore {
+	return &playerStore{
+		filename: filename,
+		records:  make(map[string]*playerRecord),
+	}
+}
+
+// load reads the player records from disk. A missing file is not an error.
+func (ps *playerStore) load() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	byteValue, err := ioutil.ReadFile(ps.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(byteValue, &ps.records)
+}
+
+// save writes the player records to disk. Callers must hold ps.mu.
+func (ps *playerStore) save() error {
+	jsonData, err := json.Marshal(ps.records)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ps.filename, jsonData, 0644)
+}
+
+// get returns a copy of a player's record, empty for players never seen.
+func (ps *playerStore) get(username string) *playerRecord {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if record, ok := ps.records[username]; ok {
+		return record.clone()
+	}
+	return &playerRecord{}
+}
+
+// update changes the records of several players together. fn is given copies of
+// the records and the changes are only kept when it returns nil and they could
+// be saved, so a change spanning several players happens entirely or not at all.
+func (ps *playerStore) update(usernames []string, fn func(records map[string]*playerRecord) error) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	changed := make(map[string]*playerRecord, len(usernames))
+	for _, username := range usernames {
+		if record, ok := ps.records[username]; ok {
+			changed[username] = record.clone()
+		} else {
+			changed[username] = &playerRecord{}
+		}
+	}
+	if err := fn(changed); err != nil {
+		return err
+	}
+
+	previous := make(map[string]*playerRecord, len(changed))
+	for username, record := range changed {
+		previous[username] = ps.records[username]
+		ps.records[username] = record
+	}
+	if err := ps.save(); err != nil {
+		serverLog.error("failed to save players", "file", ps.filename, "err", err)
+		for username, record := range previous {
+			if record == nil {
+				delete(ps.records, username)
+			} else {
+				ps.records[username] = record
+			}
+		}
+		return err
+	}
+	return nil
+}
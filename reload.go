@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Settings, by config file name, that a reload applies while players are connected.
+// Changes to any other setting are reported as needing a restart.
+var reloadableSettings = map[string]bool{
+	"command_rate_limit":     true,
+	"command_rate_period":    true,
+	"chat_rate_limits":       true,
+	"chat_word_list":         true,
+	"chat_max_length":        true,
+	"chat_block_links":       true,
+	"chat_spam_repeat_limit": true,
+	"chat_spam_window":       true,
+	"motd":                   true,
+	"walkable_cells":         true,
+	"npc_tick_interval":      true,
+	"inventory_slots":        true,
+	"attack_cooldown":        true,
+	"respawn_delay":          true,
+	"log_level":              true,
+	"log_format":             true,
+}
+
+// configArgs are the command line arguments, kept so a reload layers them as at startup.
+var configArgs []string
+
+// reloadMu keeps reloads from the signal and the API from interleaving.
+var reloadMu sync.Mutex
+
+// reloadReport tells which settings a reload changed and which still need a restart.
+type reloadReport struct {
+	Changed         []string `json:"changed"`
+	RequiresRestart []string `json:"requires_restart"`
+	// Files that were read again whether or not they changed
+	Reloaded []string `json:"reloaded"`
+}
+
+// configSettingName returns the config file name of a Config field.
+func configSettingName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// reloadConfig reads the configuration, the chat word list and the sanctions again.
+// Everything is validated before anything is swapped, so a bad file leaves the
+// running settings untouched.
+func reloadConfig() (reloadReport, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	report := reloadReport{Changed: []string{}, RequiresRestart: []string{}}
+
+	cfg, err := loadConfig(configArgs)
+	if err != nil {
+		return report, err
+	}
+	words, err := loadWordList(cfg.ChatWordList)
+	if err != nil {
+		return report, err
+	}
+	sanctions := newModerationStore(moderation.filename)
+	if err := sanctions.load(); err != nil {
+		return report, err
+	}
+
+	// Settings that need a restart keep their running values
+	previous := currentConfig()
+	next := previous
+	oldValue, newValue, nextValue := reflect.ValueOf(previous), reflect.ValueOf(cfg), reflect.ValueOf(&next).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := configSettingName(oldValue.Type().Field(i))
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		if reloadableSettings[name] {
+			nextValue.Field(i).Set(newValue.Field(i))
+			report.Changed = append(report.Changed, name)
+		} else {
+			report.RequiresRestart = append(report.RequiresRestart, name)
+		}
+	}
+
+	applyReloadedConfig(next)
+	chatFilters.configure(next.chatFilterConfig(words))
+	moderation.replace(sanctions)
+	clients.Range(func(_, v interface{}) bool {
+		v.(*client).commandRateLimiter.setLimit(next.CommandRateLimit, time.Duration(next.CommandRatePeriod))
+		return true
+	})
+	report.Reloaded = []string{next.ChatWordList, moderation.filename}
+
+	serverLog.info("configuration reloaded", "changed", strings.Join(report.Changed, ","), "requires_restart", strings.Join(report.RequiresRestart, ","))
+	return report, nil
+}
+
+// watchReloadSignal reloads the configuration whenever the process receives SIGHUP.
+func watchReloadSignal() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if _, err := reloadConfig(); err != nil {
+			serverLog.error("failed to reload configuration, keeping the running settings", "err", err)
+		}
+	}
+}
+
+func reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	serverLog.info("configuration reload requested", "actor", apiSubject(r))
+
+	report, err := reloadConfig()
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, ErrInvalidConfig, err.Error())
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, report)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// isolateReload points a reload at temporary files and restores the running settings afterwards.
+func isolateReload(t *testing.T, configContents string) string {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configFile, []byte(configContents), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	previousConfig, previousModeration := currentConfig(), moderation
+	moderation = newModerationStore(filepath.Join(dir, "sanctions.json"))
+	t.Cleanup(func() {
+		moderation = previousModeration
+		applyReloadedConfig(previousConfig)
+		chatFilters.configure(previousConfig.chatFilterConfig(nil))
+	})
+	return dir
+}
+
+func TestReloadConfigAppliesSafeSettings(t *testing.T) {
+	initGrid()
+	dir := isolateReload(t, `{"motd": "Welcome back", "walkable_cells": ["Empty", "Grass"], "command_rate_limit": 1, "command_rate_period": "1h", "grid_width": 99}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "words.txt"), []byte("darn\n"), 0600); err != nil {
+		t.Fatalf("Failed to write word list: %v", err)
+	}
+	t.Setenv("CHAT_WORD_LIST", filepath.Join(dir, "words.txt"))
+	cli, _ := newPipeClient(t, "reloader", 0, 0)
+
+	report, err := reloadConfig()
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	changed := map[string]bool{}
+	for _, name := range report.Changed {
+		changed[name] = true
+	}
+	for _, name := range []string{"motd", "walkable_cells", "command_rate_limit", "command_rate_period", "chat_word_list"} {
+		if !changed[name] {
+			t.Errorf("Expected %s in the changed settings %v", name, report.Changed)
+		}
+	}
+	if len(report.RequiresRestart) != 1 || report.RequiresRestart[0] != "grid_width" {
+		t.Errorf("Expected only grid_width to need a restart, got %v", report.RequiresRestart)
+	}
+
+	cfg := currentConfig()
+	if cfg.MOTD != "Welcome back" || cfg.GridWidth == 99 || gridWidth == 99 {
+		t.Fatalf("Unexpected running config %+v", cfg)
+	}
+	if !isWalkable(Grass) || isWalkable(Water) {
+		t.Fatalf("Expected the terrain rules to change")
+	}
+	if filtered, err := chatFilters.Run(cli, "oh darn"); err != nil || filtered != "oh ****" {
+		t.Fatalf("Expected the new word list to apply, got %q (%v)", filtered, err)
+	}
+	if !cli.commandRateLimiter.isAllowed() || cli.commandRateLimiter.isAllowed() {
+		t.Fatalf("Expected the connected client to get the new command rate limit")
+	}
+}
+
+func TestReloadConfigKeepsSettingsOnError(t *testing.T) {
+	isolateReload(t, `{"motd": "Half applied", "log_format": "xml"}`)
+	before := currentConfig()
+
+	if _, err := reloadConfig(); err == nil {
+		t.Fatalf("Expected an invalid configuration to be rejected")
+	}
+	if currentConfig().MOTD != before.MOTD {
+		t.Fatalf("Expected the running settings to be kept")
+	}
+
+	req := httptest.NewRequest("POST", "/api/reloadConfig", nil)
+	w := httptest.NewRecorder()
+	reloadConfigHandler(w, req)
+
+	var resp apiResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusUnprocessableEntity || resp.Error == nil || resp.Error.Code != ErrInvalidConfig {
+		t.Fatalf("Unexpected response %d %+v (%v)", w.Code, resp, err)
+	}
+}
+
+func TestReloadConfigLiftsRemovedSanctions(t *testing.T) {
+	isolateReload(t, `{}`)
+	if _, err := moderation.issue(SanctionMute, "noisy", "", "spam", "testSubject", time.Hour); err != nil {
+		t.Fatalf("Failed to add mute: %v", err)
+	}
+	if err := ioutil.WriteFile(moderation.filename, []byte("[]"), 0600); err != nil {
+		t.Fatalf("Failed to clear sanctions file: %v", err)
+	}
+
+	if _, err := reloadConfig(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if _, muted := moderation.find(SanctionMute, "noisy", ""); muted {
+		t.Fatalf("Expected the mute removed from the file to be lifted")
+	}
+}
+
+func TestReloadConfigKeepsStartupSettings(t *testing.T) {
+	isolateReload(t, `{"server_name": "renamed", "api_secret": "another secret"}`)
+	name, secret := serverName, apijwtSecret
+
+	report, err := reloadConfig()
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if len(report.RequiresRestart) != 2 || serverName != name || apijwtSecret != secret || currentConfig().ServerName == "renamed" {
+		t.Fatalf("Expected the server name and secret to wait for a restart, got %+v", report)
+	}
+}
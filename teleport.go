@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+)
+
+var (
+	errOutsideMap  = errors.New("The cell is outside the map")
+	errNotWalkable = errors.New("The cell cannot be walked on")
+	errNoFreeCell  = errors.New("No cell in the target area can be walked on")
+)
+
+// mapRect is a rectangle of cells given by its top-left corner and size.
+type mapRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// zoneRef names one of the square zones used by /zone chat, counted in zones from the top-left.
+type zoneRef struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// teleportRequest moves a player to a cell, or to the best free cell of a zone.
+type teleportRequest struct {
+	Username string   `json:"username"`
+	X        *int     `json:"x,omitempty"`
+	Y        *int     `json:"y,omitempty"`
+	Zone     *zoneRef `json:"zone,omitempty"`
+	// Force allows cells the player could not walk onto
+	Force bool `json:"force,omitempty"`
+}
+
+// relocateRequest moves everyone inside From to the cells of To.
+type relocateRequest struct {
+	From  mapRect `json:"from"`
+	To    mapRect `json:"to"`
+	Force bool    `json:"force,omitempty"`
+}
+
+type relocatedPlayer struct {
+	Username string `json:"username"`
+	FromX    int    `json:"from_x"`
+	FromY    int    `json:"from_y"`
+	X        int    `json:"x"`
+	Y        int    `json:"y"`
+}
+
+type relocationResult struct {
+	Moved []relocatedPlayer `json:"moved"`
+}
+
+// targetCell is a cell players can be moved to, with the number already on it.
+type targetCell struct {
+	X, Y     int
+	Occupied int
+}
+
+func (r mapRect) contains(x, y int) bool {
+	return x >= r.X && x < r.X+r.Width && y >= r.Y && y < r.Y+r.Height
+}
+
+func (r mapRect) validate(errs fieldErrors, field string) {
+	if r.Width < 1 || r.Height < 1 {
+		errs.add(field, "width and height must be positive")
+	} else if r.Width > maxRegionCells || r.Height > maxRegionCells/r.Width {
+		// Bounded one side at a time, as the product of huge sides overflows
+		errs.add(field, "width times height must be at most %d", maxRegionCells)
+	}
+}
+
+// zoneRect returns the cells of a zone.
+func zoneRect(zone zoneRef) mapRect {
+	return mapRect{X: zone.X * zoneSize, Y: zone.Y * zoneSize, Width: zoneSize, Height: zoneSize}
+}
+
+// teleportClient moves a player straight to a cell, keeping the Clients of both
+// cells up to date, and tells the player and everyone else. Force skips the terrain check.
+func teleportClient(cli *client, x, y int, force bool) error {
+	gridMutex.Lock()
+	if y < 0 || y >= len(grid) || x < 0 || x >= len(grid[y]) {
+		gridMutex.Unlock()
+		return errOutsideMap
+	}
+	if !force && !isWalkable(grid[y][x].Type) {
+		gridMutex.Unlock()
+		return errNotWalkable
+	}
+
+	fromX, fromY := cli.x, cli.y
+	if fromY >= 0 && fromY < len(grid) && fromX >= 0 && fromX < len(grid[fromY]) {
+		removeFromGrid(cli)
+	}
+	cli.x, cli.y = x, y
+	addToGrid(cli)
+	gridMutex.Unlock()
+
+	cli.log.info("teleported", "from_x", fromX, "from_y", fromY, "x", x, "y", y)
+	sendJSON(cli.conn, map[string]interface{}{
+		"action":   "move",
+		"username": cli.username,
+		"x":        x,
+		"y":        y,
+	})
+	broadcastLocation(cli)
+	return nil
+}
+
+// targetCells lists the cells of a rectangle players can be moved to, empty
+// ones first, then by distance from the middle of the rectangle.
+func targetCells(area mapRect, force bool) []targetCell {
+	gridMutex.RLock()
+	defer gridMutex.RUnlock()
+
+	targets := []targetCell{}
+	for y := area.Y; y < area.Y+area.Height; y++ {
+		if y < 0 || y >= len(grid) {
+			continue
+		}
+		for x := area.X; x < area.X+area.Width; x++ {
+			if x < 0 || x >= len(grid[y]) || (!force && !isWalkable(grid[y][x].Type)) {
+				continue
+			}
+			target := targetCell{X: x, Y: y}
+			grid[y][x].Clients.Range(func(_, _ interface{}) bool {
+				target.Occupied++
+				return true
+			})
+			targets = append(targets, target)
+		}
+	}
+
+	// Doubled so the middle of even sized rectangles needs no fractions
+	midX, midY := 2*area.X+area.Width-1, 2*area.Y+area.Height-1
+	distance := func(t targetCell) int { return abs(2*t.X-midX) + abs(2*t.Y-midY) }
+	sort.SliceStable(targets, func(i, j int) bool {
+		if (targets[i].Occupied == 0) != (targets[j].Occupied == 0) {
+			return targets[i].Occupied == 0
+		}
+		return distance(targets[i]) < distance(targets[j])
+	})
+	return targets
+}
+
+// relocateClients moves everyone inside from to the cells of to, one player per
+// cell while there are enough free cells.
+func relocateClients(from, to mapRect, force bool) ([]relocatedPlayer, error) {
+	targets := targetCells(to, force)
+	if len(targets) == 0 {
+		return nil, errNoFreeCell
+	}
+
+	players := clientsInRect(from.X, from.Y, from.X+from.Width-1, from.Y+from.Height-1)
+	sort.Slice(players, func(i, j int) bool { return players[i].username < players[j].username })
+
+	moved := []relocatedPlayer{}
+	next := 0
+	for _, cli := range players {
+		// Players already inside the target area stay where they are
+		if to.contains(cli.x, cli.y) {
+			continue
+		}
+		target := targets[next%len(targets)]
+		next++
+
+		fromX, fromY := cli.x, cli.y
+		if err := teleportClient(cli, target.X, target.Y, force); err != nil {
+			cli.log.warn("failed to relocate", "err", err)
+			continue
+		}
+		moved = append(moved, relocatedPlayer{Username: cli.username, FromX: fromX, FromY: fromY, X: target.X, Y: target.Y})
+	}
+	return moved, nil
+}
+
+// writeTeleportError maps a teleport failure onto an API error.
+func writeTeleportError(w http.ResponseWriter, err error) {
+	switch err {
+	case errOutsideMap:
+		writeFieldErrors(w, fieldErrors{"x": "must be inside the map", "y": "must be inside the map"})
+	case errNotWalkable, errNoFreeCell:
+		writeAPIError(w, http.StatusConflict, ErrConflict, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+	}
+}
+
+func teleportUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req teleportRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	errs.required("username", req.Username)
+	if req.Zone != nil {
+		if req.X != nil || req.Y != nil {
+			errs.add("zone", "cannot be combined with x and y")
+		}
+	} else {
+		if req.X == nil {
+			errs.add("x", "is required unless a zone is given")
+		}
+		if req.Y == nil {
+			errs.add("y", "is required unless a zone is given")
+		}
+	}
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	auditUsers(r, req.Username)
+
+	v, ok := clients.Load(req.Username)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, errUserOffline.Error())
+		return
+	}
+	cli := v.(*client)
+
+	var x, y int
+	if req.Zone != nil {
+		targets := targetCells(zoneRect(*req.Zone), req.Force)
+		if len(targets) == 0 {
+			writeTeleportError(w, errNoFreeCell)
+			return
+		}
+		x, y = targets[0].X, targets[0].Y
+	} else {
+		x, y = *req.X, *req.Y
+	}
+	auditCells(r, x, y)
+
+	if err := teleportClient(cli, x, y, req.Force); err != nil {
+		writeTeleportError(w, err)
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, playerInfo(cli))
+}
+
+func relocateUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var req relocateRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	req.From.validate(errs, "from")
+	req.To.validate(errs, "to")
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	moved, err := relocateClients(req.From, req.To, req.Force)
+	if err != nil {
+		writeTeleportError(w, err)
+		return
+	}
+
+	for _, player := range moved {
+		auditUsers(r, player.Username)
+		auditCells(r, player.X, player.Y)
+	}
+	writeAPIData(w, http.StatusOK, relocationResult{Moved: moved})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postJSON sends a JSON body to a handler and decodes the enveloped response.
+func postJSON(t *testing.T, handler http.HandlerFunc, target, body string, into interface{}) apiResponse {
+	req := httptest.NewRequest("POST", target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return decodeAPIResponse(t, w, into)
+}
+
+func cellHasClient(x, y int, username string) bool {
+	_, ok := grid[y][x].Clients.Load(username)
+	return ok
+}
+
+func TestTeleportUser(t *testing.T) {
+	initGrid()
+	grid[4][3].Type = Mountain
+	traveller, lines := newPipeClient(t, "traveller", 0, 0)
+	_, watcher := newPipeClient(t, "watcher", 20, 20)
+
+	var info PlayerInfo
+	if resp := postJSON(t, teleportUserHandler, "/api/teleportUser", `{"username": "traveller", "x": 7, "y": 5}`, &info); !resp.OK || info.X != 7 || info.Y != 5 {
+		t.Fatalf("Unexpected teleport response %+v %+v", resp, info)
+	}
+	if cellHasClient(0, 0, "traveller") || !cellHasClient(7, 5, "traveller") {
+		t.Fatalf("Expected the player to be moved between the cells' client lists")
+	}
+	if msg := expectAction(t, lines, "move"); msg["x"] != float64(7) || msg["y"] != float64(5) {
+		t.Fatalf("Unexpected move message %+v", msg)
+	}
+	if msg := expectAction(t, watcher, "user_moved"); msg["username"] != "traveller" {
+		t.Fatalf("Unexpected broadcast %+v", msg)
+	}
+
+	if resp := postJSON(t, teleportUserHandler, "/api/teleportUser", `{"username": "traveller", "x": 3, "y": 4}`, nil); resp.Error == nil || resp.Error.Code != ErrConflict {
+		t.Fatalf("Expected a mountain to be refused, got %+v", resp)
+	}
+	if resp := postJSON(t, teleportUserHandler, "/api/teleportUser", `{"username": "traveller", "x": 3, "y": 4, "force": true}`, nil); !resp.OK || traveller.x != 3 || traveller.y != 4 {
+		t.Fatalf("Expected force to allow the mountain, got %+v", resp)
+	}
+	if resp := postJSON(t, teleportUserHandler, "/api/teleportUser", `{"username": "traveller", "x": 99, "y": 0}`, nil); resp.Error == nil || resp.Error.Fields["x"] == "" {
+		t.Fatalf("Expected a cell outside the map to be refused, got %+v", resp)
+	}
+	if resp := postJSON(t, teleportUserHandler, "/api/teleportUser", `{"username": "traveller", "x": 1, "zone": {"x": 1, "y": 1}}`, nil); resp.Error == nil || resp.Error.Fields["zone"] == "" {
+		t.Fatalf("Expected zone and coordinates together to be refused, got %+v", resp)
+	}
+
+	// A zone sends the player to the free walkable cell nearest its middle
+	grid[14][14].Type = Water
+	if resp := postJSON(t, teleportUserHandler, "/api/teleportUser", `{"username": "traveller", "zone": {"x": 1, "y": 1}}`, &info); !resp.OK || !zoneRect(zoneRef{X: 1, Y: 1}).contains(info.X, info.Y) || grid[info.Y][info.X].Type != Empty {
+		t.Fatalf("Unexpected zone teleport %+v %+v", resp, info)
+	}
+}
+
+func TestMoveUserUsesAbsoluteCoordinates(t *testing.T) {
+	initGrid()
+	cli, _ := newPipeClient(t, "walker", 2, 2)
+
+	var info PlayerInfo
+	if resp := postJSON(t, moveUserHandler, "/api/moveUser", `{"username": "walker", "x": 3, "y": 3}`, &info); !resp.OK || info.X != 3 || info.Y != 3 || cli.x != 3 {
+		t.Fatalf("Expected the user to be moved to (3, 3), got %+v %+v", resp, info)
+	}
+}
+
+func TestRelocateUsers(t *testing.T) {
+	initGrid()
+	grid[10][10].Type = Mountain
+	newPipeClient(t, "a", 0, 0)
+	newPipeClient(t, "b", 1, 0)
+	newPipeClient(t, "c", 1, 1)
+	newPipeClient(t, "outside", 5, 5)
+
+	var result relocationResult
+	resp := postJSON(t, relocateUsersHandler, "/api/relocateUsers", `{"from": {"x": 0, "y": 0, "width": 2, "height": 2}, "to": {"x": 10, "y": 10, "width": 2, "height": 2}}`, &result)
+	if !resp.OK || len(result.Moved) != 3 {
+		t.Fatalf("Unexpected relocation %+v %+v", resp, result)
+	}
+
+	seen := map[[2]int]bool{}
+	for _, moved := range result.Moved {
+		cell := [2]int{moved.X, moved.Y}
+		if seen[cell] || cell == [2]int{10, 10} || !cellHasClient(moved.X, moved.Y, moved.Username) || cellHasClient(moved.FromX, moved.FromY, moved.Username) {
+			t.Fatalf("Unexpected relocation of %+v in %+v", moved, result.Moved)
+		}
+		seen[cell] = true
+	}
+	if !cellHasClient(5, 5, "outside") {
+		t.Fatalf("Expected players outside the rectangle to stay")
+	}
+
+	resp = postJSON(t, relocateUsersHandler, "/api/relocateUsers", `{"from": {"x": 0, "y": 0, "width": 20, "height": 20}, "to": {"x": 10, "y": 10, "width": 1, "height": 1}}`, nil)
+	if resp.Error == nil || resp.Error.Code != ErrConflict {
+		t.Fatalf("Expected a target without walkable cells to be refused, got %+v", resp)
+	}
+
+	// Sides whose product overflows are refused before the grid is walked
+	resp = postJSON(t, relocateUsersHandler, "/api/relocateUsers", `{"from": {"x": 0, "y": 0, "width": 4294967296, "height": 4294967296}, "to": {"x": 0, "y": 0, "width": 4294967296, "height": 4294967296}}`, nil)
+	if resp.Error == nil || resp.Error.Code != ErrValidationFailed || resp.Error.Fields["from"] == "" || resp.Error.Fields["to"] == "" {
+		t.Fatalf("Expected huge rectangles to be refused, got %+v", resp)
+	}
+}
+
+func TestDisconnectLeavesCell(t *testing.T) {
+	initGrid()
+	serverSide, clientSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(serverSide)
+		close(done)
+	}()
+	go io.Copy(ioutil.Discard, clientSide)
+
+	clientSide.Write([]byte("leaver\n"))
+	var cli *client
+	for deadline := time.Now().Add(2 * time.Second); cli == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the player to join")
+		}
+		if v, ok := clients.Load("leaver"); ok {
+			cli = v.(*client)
+		}
+	}
+	x, y := spawnCell()
+	if !cellHasClient(x, y, "leaver") {
+		t.Fatalf("Expected the player on the spawn cell")
+	}
+
+	clientSide.Close()
+	<-done
+	if cellHasClient(x, y, "leaver") {
+		t.Fatalf("Expected a disconnected player to be taken off their cell")
+	}
+}
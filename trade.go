@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time a player has to answer a trade request
+const tradeRequestTimeout = time.Minute
+
+var trades = newTradeManager()
+
+var (
+	errNotTrading     = errors.New("You are not trading")
+	errAlreadyTrading = errors.New("You are already trading")
+	errTradeLocked    = errors.New("Both offers must be accepted first")
+)
+
+// Help of the trade commands
+var tradeHelp = []map[string]string{
+	{"command": "/trade [username]", "description": "Ask a player in or next to your cell to trade, or agree to their request."},
+	{"command": "/trade offer [item] [count]", "description": "Add items to your offer."},
+	{"command": "/trade remove [item] [count]", "description": "Take items out of your offer."},
+	{"command": "/trade accept", "description": "Accept both offers as they are. Any change to an offer takes the acceptance back."},
+	{"command": "/trade confirm", "description": "Complete the trade once both offers are accepted."},
+	{"command": "/trade cancel", "description": "Stop trading."},
+}
+
+// tradeSide is one player of a trade.
+type tradeSide struct {
+	username  string
+	offer     inventory
+	accepted  bool
+	confirmed bool
+}
+
+// tradeSession is a trade between two players. Trades have two phases: players
+// change their offers until both accept them, which locks the offers, then both
+// confirm the locked offers to swap the items. Changing an offer clears every
+// acceptance and confirmation and unlocks the offers.
+type tradeSession struct {
+	sides   [2]*tradeSide
+	started time.Time
+}
+
+type tradeRequest struct {
+	from string
+	at   time.Time
+}
+
+// tradeRecord is the event of a trade ending and the payload of its audit entry.
+type tradeRecord struct {
+	Players []string             `json:"players"`
+	Offers  map[string]inventory `json:"offers"`
+	Outcome string               `json:"outcome"`
+	Reason  string               `json:"reason,omitempty"`
+	Started time.Time            `json:"started"`
+}
+
+// tradeManager keeps the trade requests and the trades in progress.
+type tradeManager struct {
+	mu sync.Mutex
+	// Requests by the username of the player asked
+	requests map[string]tradeRequest
+	// Trades by the username of either player
+	sessions map[string]*tradeSession
+}
+
+func newTradeManager() *tradeManager {
+	return &tradeManager{
+		requests: make(map[string]tradeRequest),
+		sessions: make(map[string]*tradeSession),
+	}
+}
+
+// side returns the side of the player and the other side.
+func (ts *tradeSession) side(username string) (*tradeSide, *tradeSide) {
+	if ts.sides[0].username == username {
+		return ts.sides[0], ts.sides[1]
+	}
+	return ts.sides[1], ts.sides[0]
+}
+
+func (ts *tradeSession) locked() bool {
+	return ts.sides[0].accepted && ts.sides[1].accepted
+}
+
+// reset takes back every acceptance after an offer changed.
+func (ts *tradeSession) reset() {
+	for _, side := range ts.sides {
+		side.accepted, side.confirmed = false, false
+	}
+}
+
+func (ts *tradeSession) record(outcome, reason string) tradeRecord {
+	record := tradeRecord{Offers: make(map[string]inventory), Outcome: outcome, Reason: reason, Started: ts.started}
+	for _, side := range ts.sides {
+		record.Players = append(record.Players, side.username)
+		offer := side.offer
+		if offer == nil {
+			offer = inventory{}
+		}
+		record.Offers[side.username] = offer
+	}
+	return record
+}
+
+// request asks a player to trade, or starts the trade when they asked first.
+// It reports whether the trade started.
+func (tm *tradeManager) request(from, to *client) (bool, error) {
+	if !nearby(from, to) {
+		return false, errNotNearby
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if _, ok := tm.sessions[from.username]; ok {
+		return false, errAlreadyTrading
+	}
+	if _, ok := tm.sessions[to.username]; ok {
+		return false, fmt.Errorf("%s is already trading", to.username)
+	}
+
+	if req, ok := tm.requests[from.username]; ok && req.from == to.username && time.Since(req.at) < tradeRequestTimeout {
+		delete(tm.requests, from.username)
+		session := &tradeSession{
+			sides:   [2]*tradeSide{{username: to.username}, {username: from.username}},
+			started: time.Now().UTC(),
+		}
+		tm.sessions[from.username] = session
+		tm.sessions[to.username] = session
+		serverLog.info("trade started", "users", to.username+","+from.username)
+		return true, nil
+	}
+
+	tm.requests[to.username] = tradeRequest{from: from.username, at: time.Now()}
+	return false, nil
+}
+
+// change adds count of an item to a player's offer, or takes it out when count
+// is negative. Players can only offer what they carry.
+func (tm *tradeManager) change(cli *client, item string, count int) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	session, ok := tm.sessions[cli.username]
+	if !ok {
+		return errNotTrading
+	}
+	side, _ := session.side(cli.username)
+
+	var next inventory
+	var err error
+	if count > 0 {
+		def, ok := items.get(item)
+		if !ok {
+			return errUnknownItem
+		}
+		if playerData.get(cli.username).Inventory.count(item) < side.offer.count(item)+count {
+			return errNotEnoughItems
+		}
+		// Offers hold any number of stacks
+		next, err = side.offer.add(def, count, len(side.offer)+count)
+	} else {
+		next, err = side.offer.remove(item, -count)
+	}
+	if err != nil {
+		return err
+	}
+
+	side.offer = next
+	session.reset()
+	tm.notify(session, fmt.Sprintf("%s changed their offer.\n", cli.username))
+	return nil
+}
+
+// accept accepts both offers for a player, locking them once both have.
+func (tm *tradeManager) accept(cli *client) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	session, ok := tm.sessions[cli.username]
+	if !ok {
+		return errNotTrading
+	}
+	side, _ := session.side(cli.username)
+	side.accepted = true
+
+	if session.locked() {
+		tm.notify(session, "Both offers are locked. Type /trade confirm to complete the trade.\n")
+	} else {
+		tm.notify(session, fmt.Sprintf("%s accepted the offers.\n", cli.username))
+	}
+	return nil
+}
+
+// confirm confirms the locked offers for a player, and swaps the items once
+// both have. It reports whether the trade completed.
+func (tm *tradeManager) confirm(cli *client) (bool, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	session, ok := tm.sessions[cli.username]
+	if !ok {
+		return false, errNotTrading
+	}
+	if !session.locked() {
+		return false, errTradeLocked
+	}
+	side, other := session.side(cli.username)
+	side.confirmed = true
+	if !other.confirmed {
+		tm.notify(session, fmt.Sprintf("%s confirmed the trade.\n", cli.username))
+		return false, nil
+	}
+
+	// Both players are told why a swap failed, so it ends the trade rather than the command
+	if err := swapOffers(session); err != nil {
+		tm.endLocked(session, "failure", err.Error())
+		return false, nil
+	}
+	tm.endLocked(session, "success", "")
+	return true, nil
+}
+
+// cancel ends the trade of a player, if they are trading, and reports whether it did.
+func (tm *tradeManager) cancel(username, reason string) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	delete(tm.requests, username)
+	session, ok := tm.sessions[username]
+	if ok {
+		tm.endLocked(session, "cancelled", reason)
+	}
+	return ok
+}
+
+// endLocked ends a trade, tells both players and logs it for moderation.
+// Callers must hold tm.mu.
+func (tm *tradeManager) endLocked(session *tradeSession, outcome, reason string) {
+	for _, side := range session.sides {
+		delete(tm.sessions, side.username)
+	}
+
+	record := session.record(outcome, reason)
+	var message string
+	switch outcome {
+	case "success":
+		message = "The trade is complete.\n"
+	case "failure":
+		message = fmt.Sprintf("The trade failed: %s.\n", reason)
+	default:
+		message = fmt.Sprintf("The trade was cancelled: %s.\n", reason)
+	}
+	for _, side := range session.sides {
+		if v, ok := clients.Load(side.username); ok {
+			v.(*client).conn.Write([]byte(message))
+		}
+	}
+
+	serverLog.info("trade ended", "users", strings.Join(record.Players, ","), "outcome", outcome, "reason", reason)
+	payload, _ := json.Marshal(record)
+	entry := &auditEntry{
+		Time:    time.Now().UTC(),
+		Actor:   record.Players[0],
+		Action:  "trade",
+		Method:  "GAME",
+		Payload: string(payload),
+		Users:   record.Players,
+		Outcome: "success",
+	}
+	if outcome != "success" {
+		entry.Outcome = "failure"
+	}
+	recordAudit(entry)
+	if outcome == "success" {
+		events.publish(EventTradeCompleted, record)
+	} else {
+		events.publish(EventTradeCancelled, record)
+	}
+}
+
+// swapOffers moves the offered items between the inventories of both players
+// at once, or not at all when either no longer holds their offer or has no room
+// for the other's.
+func swapOffers(session *tradeSession) error {
+	a, b := session.sides[0], session.sides[1]
+	capacity := currentConfig().InventorySlots
+
+	err := playerData.update([]string{a.username, b.username}, func(records map[string]*playerRecord) error {
+		for _, side := range session.sides {
+			for _, slot := range side.offer {
+				next, err := records[side.username].Inventory.remove(slot.Item, slot.Count)
+				if err != nil {
+					return fmt.Errorf("%s no longer has %d %s", side.username, slot.Count, itemName(slot.Item))
+				}
+				records[side.username].Inventory = next
+			}
+		}
+		for _, pair := range [][2]*tradeSide{{a, b}, {b, a}} {
+			from, to := pair[0], pair[1]
+			for _, slot := range from.offer {
+				def, ok := items.get(slot.Item)
+				if !ok {
+					return fmt.Errorf("%s is no longer an item", slot.Item)
+				}
+				next, err := records[to.username].Inventory.add(def, slot.Count, capacity)
+				if err != nil {
+					return fmt.Errorf("%s has no room for the items", to.username)
+				}
+				records[to.username].Inventory = next
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	changes := []inventoryChange{}
+	for _, pair := range [][2]*tradeSide{{a, b}, {b, a}} {
+		from, to := pair[0], pair[1]
+		for _, slot := range from.offer {
+			changes = append(changes,
+				inventoryChange{Username: from.username, Item: slot.Item, Count: -slot.Count, Reason: "trade", Actor: to.username},
+				inventoryChange{Username: to.username, Item: slot.Item, Count: slot.Count, Reason: "trade", Actor: from.username},
+			)
+		}
+	}
+	itemsChanged(changes...)
+	return nil
+}
+
+// notify sends both players of a trade a message and the state of the trade.
+// Callers must hold tm.mu.
+func (tm *tradeManager) notify(session *tradeSession, message string) {
+	offers := make(map[string]inventory)
+	accepted := make(map[string]bool)
+	confirmed := make(map[string]bool)
+	for _, side := range session.sides {
+		offers[side.username] = side.offer
+		if side.offer == nil {
+			offers[side.username] = inventory{}
+		}
+		accepted[side.username] = side.accepted
+		confirmed[side.username] = side.confirmed
+	}
+
+	for _, side := range session.sides {
+		v, ok := clients.Load(side.username)
+		if !ok {
+			continue
+		}
+		cli := v.(*client)
+		_, other := session.side(side.username)
+		cli.conn.Write([]byte(message))
+		sendJSON(cli.conn, map[string]interface{}{
+			"action":    "trade",
+			"with":      other.username,
+			"locked":    session.locked(),
+			"offers":    offers,
+			"accepted":  accepted,
+			"confirmed": confirmed,
+		})
+	}
+}
+
+// describe lists the offers of a player's trade.
+func (tm *tradeManager) describe(username string) (string, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	session, ok := tm.sessions[username]
+	if !ok {
+		return "", errNotTrading
+	}
+	mine, other := session.side(username)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Trading with %s.\n", other.username)
+	for _, side := range []*tradeSide{mine, other} {
+		state := ""
+		if side.confirmed {
+			state = " (confirmed)"
+		} else if side.accepted {
+			state = " (accepted)"
+		}
+		fmt.Fprintf(&b, "%s offers%s:\n", side.username, state)
+		if len(side.offer) == 0 {
+			b.WriteString(" - nothing\n")
+		}
+		for _, slot := range side.offer {
+			fmt.Fprintf(&b, " - %d x %s (%s)\n", slot.Count, itemName(slot.Item), slot.Item)
+		}
+	}
+	return b.String(), nil
+}
+
+// tradeCommand runs /trade and its subcommands.
+func tradeCommand(cli *client, args []string) {
+	usage := func() {
+		cli.conn.Write([]byte("Usage: /trade [username], /trade offer|remove [item] [count], /trade accept|confirm|cancel\n"))
+	}
+
+	var reply string
+	var err error
+	if len(args) == 0 {
+		reply, err = trades.describe(cli.username)
+		if err != nil {
+			usage()
+			return
+		}
+		cli.conn.Write([]byte(reply))
+		return
+	}
+
+	switch args[0] {
+	case "offer", "remove":
+		if len(args) < 2 || len(args) > 3 {
+			usage()
+			return
+		}
+		count := 1
+		if len(args) == 3 {
+			n, convErr := strconv.Atoi(args[2])
+			if convErr != nil || n < 1 {
+				usage()
+				return
+			}
+			count = n
+		}
+		if args[0] == "remove" {
+			count = -count
+		}
+		err = trades.change(cli, args[1], count)
+
+	case "accept":
+		err = trades.accept(cli)
+
+	case "confirm":
+		_, err = trades.confirm(cli)
+
+	case "cancel":
+		if !trades.cancel(cli.username, fmt.Sprintf("%s cancelled", cli.username)) {
+			err = errNotTrading
+		}
+
+	default:
+		v, online := clients.Load(args[0])
+		if len(args) != 1 || !online || args[0] == cli.username {
+			reply = fmt.Sprintf("User '%s' not found.\n", args[0])
+			break
+		}
+		to := v.(*client)
+		var started bool
+		started, err = trades.request(cli, to)
+		if err != nil {
+			break
+		}
+		if started {
+			started := "Trading with %s. Add items with /trade offer [item] [count], then /trade accept.\n"
+			cli.conn.Write([]byte(fmt.Sprintf(started, to.username)))
+			to.conn.Write([]byte(fmt.Sprintf(started, cli.username)))
+		} else {
+			reply = fmt.Sprintf("Asked %s to trade.\n", to.username)
+			to.conn.Write([]byte(fmt.Sprintf("%s wants to trade with you. Type /trade %s to start.\n", cli.username, cli.username)))
+		}
+	}
+
+	if err != nil {
+		reply = fmt.Sprintf("Error: %v\n", err)
+	}
+	if reply != "" {
+		cli.conn.Write([]byte(reply))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrade(t *testing.T) {
+	initGrid()
+	isolateItems(t)
+	previousAudit, previousTrades := auditTrail, trades
+	auditTrail = newAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	trades = newTradeManager()
+	defer func() { auditTrail, trades = previousAudit, previousTrades }()
+
+	alice, aliceLines := newPipeClient(t, "alice", 5, 5)
+	alice.commandRateLimiter = newRateLimiter(100, time.Second)
+	bob, bobLines := newPipeClient(t, "bob", 6, 5)
+	bob.commandRateLimiter = newRateLimiter(100, time.Second)
+	changeItems("alice", "apple", 3, "grant", "test")
+	changeItems("bob", "sword", 1, "grant", "test")
+
+	handleCommand(alice, "/trade bob\n")
+	expectLine(t, aliceLines, "Asked bob to trade.")
+	expectLine(t, bobLines, "alice wants to trade with you.")
+	handleCommand(bob, "/trade alice\n")
+	expectLine(t, aliceLines, "Trading with bob.")
+
+	handleCommand(alice, "/trade offer apple 5\n")
+	expectLine(t, aliceLines, "Error: Not enough of the item")
+	handleCommand(alice, "/trade offer apple 2\n")
+	handleCommand(bob, "/trade offer sword\n")
+	handleCommand(alice, "/trade confirm\n")
+	expectLine(t, aliceLines, "Error: Both offers must be accepted first")
+
+	// Changing an offer after both accepted takes the acceptances back
+	handleCommand(alice, "/trade accept\n")
+	handleCommand(bob, "/trade accept\n")
+	expectLine(t, aliceLines, "Both offers are locked.")
+	handleCommand(bob, "/trade remove sword\n")
+	handleCommand(bob, "/trade offer sword\n")
+	handleCommand(alice, "/trade confirm\n")
+	expectLine(t, aliceLines, "Error: Both offers must be accepted first")
+
+	handleCommand(alice, "/trade accept\n")
+	handleCommand(bob, "/trade accept\n")
+	handleCommand(alice, "/trade confirm\n")
+	handleCommand(bob, "/trade confirm\n")
+	expectLine(t, aliceLines, "The trade is complete.")
+	expectLine(t, bobLines, "The trade is complete.")
+	if a, b := playerData.get("alice").Inventory, playerData.get("bob").Inventory; a.count("apple") != 1 || a.count("sword") != 1 || b.count("apple") != 2 || b.count("sword") != 0 {
+		t.Fatalf("Expected the offers to be swapped, got %+v and %+v", a, b)
+	}
+
+	// Offers are checked again when the items are swapped
+	handleCommand(bob, "/trade alice\n")
+	handleCommand(alice, "/trade bob\n")
+	handleCommand(alice, "/trade offer sword\n")
+	handleCommand(bob, "/trade offer apple 2\n")
+	handleCommand(alice, "/trade accept\n")
+	handleCommand(bob, "/trade accept\n")
+	changeItems("bob", "apple", -1, "remove", "test")
+	handleCommand(alice, "/trade confirm\n")
+	handleCommand(bob, "/trade confirm\n")
+	expectLine(t, aliceLines, "The trade failed: bob no longer has 2 Apple.")
+	if a := playerData.get("alice").Inventory; a.count("sword") != 1 || a.count("apple") != 1 {
+		t.Fatalf("Expected a failed trade to change nothing, got %+v", a)
+	}
+
+	// Moving away cancels a trade
+	handleCommand(alice, "/trade bob\n")
+	handleCommand(bob, "/trade alice\n")
+	moveClient(alice, 0, 1)
+	expectLine(t, bobLines, "The trade was cancelled: alice moved.")
+	handleCommand(bob, "/trade accept\n")
+	expectLine(t, bobLines, "Error: You are not trading")
+
+	entries, err := auditTrail.query(auditFilter{Action: "trade"})
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	if len(entries) != 3 || entries[0].Outcome != "success" || len(entries[0].Users) != 2 || entries[1].Outcome != "failure" || entries[2].Outcome != "failure" {
+		t.Fatalf("Expected the trades to be logged, got %+v", entries)
+	}
+}
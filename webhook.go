@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	webhooksFilename = "webhooks.json"
+	// Attempts made to deliver an event before it is given up on
+	webhookMaxAttempts = 5
+	// Events waiting for delivery per webhook before new ones are dropped
+	webhookQueueSize = 256
+	// How long to wait for a webhook endpoint to answer
+	webhookRequestTimeout = 5 * time.Second
+)
+
+// Delay before the first retry, doubled after every failed attempt
+var webhookRetryDelay = time.Second
+
+var webhookHTTPClient = &http.Client{Timeout: webhookRequestTimeout}
+
+var webhooks = newWebhookStore(webhooksFilename)
+
+// webhook is an outbound endpoint that receives world events. Every delivery
+// is signed with an HMAC-SHA256 of the body, keyed with the secret.
+type webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Types     []string  `json:"types,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	queue chan worldEvent
+	// Delivery statistics, only kept in memory
+	mu        sync.Mutex
+	delivered int
+	failed    int
+	lastError string
+}
+
+// webhookInfo is how a webhook is shown through the API, without its secret.
+type webhookInfo struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Types     []string  `json:"types,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Delivered int       `json:"delivered"`
+	Failed    int       `json:"failed"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type addWebhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Types  []string `json:"types,omitempty"`
+}
+
+type deleteWebhookRequest struct {
+	ID int `json:"id"`
+}
+
+type webhookStore struct {
+	mu       sync.Mutex
+	filename string
+	nextID   int
+	hooks    map[int]*webhook
+}
+
+func newWebhookStore(filename string) *webhookStore {
+	return &webhookStore{
+		filename: filename,
+		nextID:   1,
+		hooks:    make(map[int]*webhook),
+	}
+}
+
+func (ws *webhookStore) load() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	byteValue, err := ioutil.ReadFile(ws.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []*webhook
+	err = json.Unmarshal(byteValue, &list)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range list {
+		ws.startLocked(hook)
+	}
+	return nil
+}
+
+// save writes the webhooks to disk. Callers must hold ws.mu.
+func (ws *webhookStore) save() error {
+	list := []*webhook{}
+	for _, hook := range ws.hooks {
+		list = append(list, hook)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	jsonData, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ws.filename, jsonData, 0600)
+}
+
+// startLocked registers a webhook and starts its delivery worker. Callers must hold ws.mu.
+func (ws *webhookStore) startLocked(hook *webhook) {
+	hook.queue = make(chan worldEvent, webhookQueueSize)
+	ws.hooks[hook.ID] = hook
+	if hook.ID >= ws.nextID {
+		ws.nextID = hook.ID + 1
+	}
+	go hook.run()
+}
+
+func (ws *webhookStore) add(rawURL, secret string, types []string) (*webhook, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	hook := &webhook{
+		ID:        ws.nextID,
+		URL:       rawURL,
+		Secret:    secret,
+		Types:     types,
+		CreatedAt: time.Now().UTC(),
+	}
+	ws.startLocked(hook)
+	return hook, ws.save()
+}
+
+func (ws *webhookStore) remove(id int) (bool, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	hook, ok := ws.hooks[id]
+	if !ok {
+		return false, nil
+	}
+	delete(ws.hooks, id)
+	close(hook.queue)
+	return true, ws.save()
+}
+
+func (ws *webhookStore) list() []webhookInfo {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	list := []webhookInfo{}
+	for _, hook := range ws.hooks {
+		list = append(list, hook.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// dispatch queues an event on every webhook interested in it.
+func (ws *webhookStore) dispatch(event worldEvent) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for _, hook := range ws.hooks {
+		if !hook.wants(event.Type) {
+			continue
+		}
+		select {
+		case hook.queue <- event:
+		default:
+			hook.recordFailure(fmt.Errorf("queue full, dropped event %d", event.ID))
+		}
+	}
+}
+
+// consume dispatches the events of a bus subscription until it is closed.
+func (ws *webhookStore) consume(sub *eventSubscription) {
+	for event := range sub.events {
+		ws.dispatch(event)
+	}
+}
+
+func (hook *webhook) wants(eventType string) bool {
+	if len(hook.Types) == 0 {
+		return true
+	}
+	for _, t := range hook.Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (hook *webhook) info() webhookInfo {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+
+	return webhookInfo{
+		ID:        hook.ID,
+		URL:       hook.URL,
+		Types:     hook.Types,
+		CreatedAt: hook.CreatedAt,
+		Delivered: hook.delivered,
+		Failed:    hook.failed,
+		LastError: hook.lastError,
+	}
+}
+
+func (hook *webhook) recordFailure(err error) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+
+	hook.failed++
+	hook.lastError = err.Error()
+}
+
+// run delivers queued events one at a time, in order, until the webhook is removed.
+func (hook *webhook) run() {
+	for event := range hook.queue {
+		if err := hook.deliver(event); err != nil {
+			serverLog.warn("failed to deliver event to webhook", "event", event.ID, "webhook", hook.ID, "err", err)
+			hook.recordFailure(err)
+			continue
+		}
+		hook.mu.Lock()
+		hook.delivered++
+		hook.mu.Unlock()
+	}
+}
+
+// deliver posts an event, retrying with exponential backoff on network
+// errors, rate limiting and server errors.
+func (hook *webhook) deliver(event worldEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := hook.post(event, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt == webhookMaxAttempts {
+			return fmt.Errorf("attempt %d: %v", attempt, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth retrying.
+func (hook *webhook) post(event worldEvent, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", strconv.FormatUint(event.ID, 10))
+	req.Header.Set("X-Event-Type", event.Type)
+	req.Header.Set("X-Signature-256", "sha256="+signWebhookBody(hook.Secret, body))
+
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+}
+
+// signWebhookBody returns the hex encoded HMAC-SHA256 of a delivery body.
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIData(w, http.StatusOK, webhooks.list())
+}
+
+func addWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req addWebhookRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	errs := fieldErrors{}
+	errs.required("url", req.URL)
+	if u, err := url.Parse(req.URL); req.URL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		errs.add("url", "must be an http or https URL")
+	}
+	errs.required("secret", req.Secret)
+	if writeFieldErrors(w, errs) {
+		return
+	}
+
+	hook, err := webhooks.add(req.URL, req.Secret, req.Types)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error saving webhooks: %v", err))
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, hook.info())
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req deleteWebhookRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	ok, err := webhooks.remove(req.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Error saving webhooks: %v", err))
+		return
+	}
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, ErrNotFound, "Webhook not found")
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, apiMessage{Message: "Webhook deleted"})
+}